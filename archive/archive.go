@@ -0,0 +1,377 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbathe/goboro/atomicfile"
+	"github.com/bbathe/goboro/email"
+)
+
+// mbox file in the archive folder
+const mboxName = "goboro.mbox"
+
+var errNoMessages = errors.New("no messages found to import")
+
+// Entry is a message in the archive, with the tracking metadata from its headers
+type Entry struct {
+	MessageID string
+	NoticeID  string // from X-Goboro-Notice-ID, the outbox and tracking ID
+	Callsign  string // from X-Goboro-Callsign
+	From      string
+	To        []string
+	Subject   string
+	Date      time.Time // when it was sent
+	Raw       []byte    // the message as sent
+}
+
+// key identifies the message for finding duplicates, its Message-ID, or a hash of the message if it has none
+func (e Entry) key() string {
+	if e.MessageID != "" {
+		return e.MessageID
+	}
+
+	// mbox files change the line endings and quote From lines, see email.WriteMbox
+	data := bytes.ReplaceAll(e.Raw, []byte("\r\n"), []byte("\n"))
+	data = bytes.TrimRight(data, "\n")
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Archive is a local copy of every message sent, in a Maildir or an mbox file,
+// so the history doesn't depend on the sending mailbox
+type Archive struct {
+	dir  string
+	mbox bool
+
+	// mutex for the files
+	m sync.Mutex
+}
+
+// Open opens the archive in folder dir, creating it if needed, messages are kept in goboro.mbox
+// in dir if mbox is true, otherwise dir is a Maildir
+func Open(dir string, mbox bool) (*Archive, error) {
+	dirs := []string{dir}
+	if !mbox {
+		dirs = append(dirs, filepath.Join(dir, "tmp"), filepath.Join(dir, "new"), filepath.Join(dir, "cur"))
+	}
+	for _, d := range dirs {
+		err := os.MkdirAll(d, 0700)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	a := &Archive{
+		dir:  dir,
+		mbox: mbox,
+	}
+
+	return a, nil
+}
+
+// Add archives msg as it was sent at sentAt
+func (a *Archive) Add(msg *email.Message, sentAt time.Time) error {
+	data, err := msg.MIME(sentAt)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.add(data, msg.From, sentAt)
+}
+
+// add stores message data, caller must hold the lock
+func (a *Archive) add(data []byte, from string, date time.Time) error {
+	if a.mbox {
+		return email.AppendMbox(filepath.Join(a.dir, mboxName), from, date, data)
+	}
+
+	return writeMaildir(a.dir, date, data)
+}
+
+// List returns the archived messages, oldest first
+func (a *Archive) List() ([]Entry, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.list()
+}
+
+// list reads the archived messages, caller must hold the lock
+func (a *Archive) list() ([]Entry, error) {
+	var raw [][]byte
+	var err error
+	if a.mbox {
+		raw, err = readMbox(filepath.Join(a.dir, mboxName))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	} else {
+		raw, err = readMaildir(a.dir)
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return parseAll(raw), nil
+}
+
+// Export writes all the archived messages to mbox file fname, replacing it,
+// an mbox is one file to hand over that any mail program can open
+func (a *Archive) Export(fname string) error {
+	entries, err := a.List()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	// written in one go, so a failed export doesn't leave part of one behind
+	var b bytes.Buffer
+	for _, e := range entries {
+		err = email.WriteMbox(&b, e.From, e.Date, e.Raw)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+	err = atomicfile.WriteFile(fname, b.Bytes(), 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Import adds the messages in mbox file or Maildir folder path that aren't in the archive already,
+// matched by Message-ID or by content for messages without one, and returns the ones added
+func (a *Archive) Import(path string) ([]Entry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	var raw [][]byte
+	if fi.IsDir() {
+		raw, err = readMaildir(path)
+	} else {
+		raw, err = readMbox(path)
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, errNoMessages
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	existing, err := a.list()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	known := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		known[e.key()] = true
+	}
+
+	var added []Entry
+	for _, e := range parseAll(raw) {
+		if known[e.key()] {
+			continue
+		}
+
+		err = a.add(e.Raw, e.From, e.Date)
+		if err != nil {
+			log.Printf("%+v", err)
+			return added, err
+		}
+		added = append(added, e)
+		known[e.key()] = true
+	}
+
+	return added, nil
+}
+
+// writeMaildir delivers message data to the cur folder of Maildir dir, marked seen,
+// it's written to tmp first so readers never see part of a message
+func writeMaildir(dir string, date time.Time, data []byte) error {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	name := fmt.Sprintf("%d.%s.goboro", date.Unix(), hex.EncodeToString(b))
+
+	tmp := filepath.Join(dir, "tmp", name)
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	// Windows file names can't have the usual : before the flags, mail programs there use !
+	err = os.Rename(tmp, filepath.Join(dir, "cur", name+"!2,S"))
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// readMaildir returns the messages in the new and cur folders of Maildir dir,
+// whether their flags follow a : or a !
+func readMaildir(dir string) ([][]byte, error) {
+	var raw [][]byte
+	for _, sub := range []string{"new", "cur"} {
+		files, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+
+			// #nosec G304
+			data, err := os.ReadFile(filepath.Join(dir, sub, f.Name()))
+			if err != nil {
+				log.Printf("%+v", err)
+				return nil, err
+			}
+			raw = append(raw, data)
+		}
+	}
+
+	return raw, nil
+}
+
+// readMbox returns the messages in mboxrd file fname, undoing the From quoting
+func readMbox(fname string) ([][]byte, error) {
+	// #nosec G304
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	var raw [][]byte
+	var current *bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		// unquoted From lines only start messages, see email.AppendMbox
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if current != nil {
+				raw = append(raw, trimMessage(current.Bytes()))
+			}
+			current = new(bytes.Buffer)
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		if q := bytes.TrimLeft(line, ">"); len(q) < len(line) && bytes.HasPrefix(q, []byte("From ")) {
+			line = line[1:]
+		}
+		current.Write(line)
+	}
+	if current != nil {
+		raw = append(raw, trimMessage(current.Bytes()))
+	}
+
+	return raw, nil
+}
+
+// trimMessage drops the blank line that separates messages in an mbox
+func trimMessage(data []byte) []byte {
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	return bytes.TrimSuffix(data, []byte("\r"))
+}
+
+// parseAll parses the headers of the messages, oldest first
+func parseAll(raw [][]byte) []Entry {
+	entries := make([]Entry, 0, len(raw))
+	for _, data := range raw {
+		e, err := parse(data)
+		if err != nil {
+			// keep it, it's still part of the history
+			log.Printf("%+v", err)
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date.Before(entries[j].Date)
+	})
+
+	return entries
+}
+
+// parse reads the tracking metadata from the headers of message data
+func parse(data []byte) (Entry, error) {
+	e := Entry{
+		Raw: data,
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return e, err
+	}
+
+	var dec mime.WordDecoder
+	decode := func(name string) string {
+		v := msg.Header.Get(name)
+		if d, err := dec.DecodeHeader(v); err == nil {
+			return d
+		}
+		return v
+	}
+
+	e.MessageID = strings.TrimSpace(msg.Header.Get("Message-ID"))
+	e.NoticeID = decode("X-Goboro-Notice-ID")
+	e.Callsign = decode("X-Goboro-Callsign")
+	e.Subject = decode("Subject")
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		e.From = from.Address
+	}
+	if to, err := msg.Header.AddressList("To"); err == nil {
+		for _, a := range to {
+			e.To = append(e.To, a.Address)
+		}
+	}
+	e.Date, err = msg.Header.Date()
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
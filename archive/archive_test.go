@@ -0,0 +1,216 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+)
+
+// notice is a message to callsign with a body that needs From quoting in an mbox
+func notice(callsign string) *email.Message {
+	return &email.Message{
+		From:     "w1bureau@example.org",
+		To:       []string{strings.ToLower(callsign) + "@example.com"},
+		Subject:  "QSL cards waiting for " + callsign,
+		Body:     "Your cards are here.\n\nFrom the bureau\n>From the sorter\n",
+		Callsign: callsign,
+		NoticeID: "notice-" + callsign,
+	}
+}
+
+// addNotices archives a notice to each of callsigns, a minute apart
+func addNotices(t *testing.T, a *Archive, callsigns ...string) {
+	t.Helper()
+
+	sentAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, c := range callsigns {
+		err := a.Add(notice(c), sentAt.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkEntries checks the archive holds notices to callsigns, in order, with their bodies intact
+func checkEntries(t *testing.T, entries []Entry, callsigns ...string) {
+	t.Helper()
+
+	if len(entries) != len(callsigns) {
+		t.Fatalf("%d entries, want %d", len(entries), len(callsigns))
+	}
+	for i, c := range callsigns {
+		e := entries[i]
+		if e.Callsign != c || e.NoticeID != "notice-"+c || e.Subject != "QSL cards waiting for "+c {
+			t.Errorf("entry %d is %+v, want the notice to %s", i, e, c)
+		}
+		if e.MessageID == "" {
+			t.Errorf("entry %d has no Message-ID", i)
+		}
+		if e.From != "w1bureau@example.org" {
+			t.Errorf("entry %d from %q", i, e.From)
+		}
+		body := string(bytes.ReplaceAll(e.Raw, []byte("\r\n"), []byte("\n")))
+		if !strings.Contains(body, "\nFrom the bureau\n>From the sorter\n") {
+			t.Errorf("entry %d body quoting changed:\n%s", i, body)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, mbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mbox %v", mbox), func(t *testing.T) {
+			a, err := Open(t.TempDir(), mbox)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addNotices(t, a, "K1ABC", "N1XYZ")
+
+			entries, err := a.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, entries, "K1ABC", "N1XYZ")
+
+			// export and import into an empty archive
+			fname := filepath.Join(t.TempDir(), "export.mbox")
+			err = a.Export(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Open(t.TempDir(), !mbox)
+			if err != nil {
+				t.Fatal(err)
+			}
+			added, err := b.Import(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, added, "K1ABC", "N1XYZ")
+			entries, err = b.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, entries, "K1ABC", "N1XYZ")
+
+			// importing again adds nothing
+			added, err = b.Import(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(added) != 0 {
+				t.Errorf("second import added %d messages, want 0", len(added))
+			}
+		})
+	}
+}
+
+func TestExportQuotesFrom(t *testing.T) {
+	a, err := Open(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addNotices(t, a, "K1ABC")
+
+	fname := filepath.Join(t.TempDir(), "export.mbox")
+	err = a.Export(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mboxrd adds a > to every From line in a message, quoted or not
+	if !bytes.Contains(data, []byte("\n>From the bureau\n>>From the sorter\n")) {
+		t.Errorf("From lines not quoted:\n%s", data)
+	}
+	if n := bytes.Count(data, []byte("\nFrom ")) + 1; !bytes.HasPrefix(data, []byte("From ")) || n != 1 {
+		t.Errorf("%d unquoted From lines, want 1", n)
+	}
+}
+
+func TestImportWithoutMessageID(t *testing.T) {
+	mbox := filepath.Join(t.TempDir(), "old.mbox")
+	var b bytes.Buffer
+	for _, c := range []string{"K1ABC", "N1XYZ"} {
+		data := fmt.Sprintf("From: w1bureau@example.org\r\nTo: %s@example.com\r\nSubject: QSL cards\r\nDate: Fri, 01 Mar 2024 12:00:00 +0000\r\n\r\nYour cards are here.\r\n", strings.ToLower(c))
+		err := email.WriteMbox(&b, "w1bureau@example.org", time.Now(), []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(mbox, b.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, archiveMbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mbox %v", archiveMbox), func(t *testing.T) {
+			a, err := Open(t.TempDir(), archiveMbox)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			added, err := a.Import(mbox)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(added) != 2 {
+				t.Fatalf("first import added %d messages, want 2", len(added))
+			}
+
+			added, err = a.Import(mbox)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(added) != 0 {
+				t.Errorf("second import added %d messages, want 0", len(added))
+			}
+		})
+	}
+}
+
+func TestReadMaildirFlags(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addNotices(t, a, "K1ABC")
+
+	// a message written by a mail program that uses the usual : before the flags
+	data, err := notice("N1XYZ").MIME(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "cur", "1709380800.1.host:2,S"), data, 0600)
+	if err != nil {
+		t.Skipf("file system doesn't allow : in names: %v", err)
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".goboro!2,S") {
+			continue
+		}
+		if !strings.Contains(f.Name(), ":") {
+			t.Errorf("archived as %s, want flags after !", f.Name())
+		}
+	}
+
+	entries, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, entries, "K1ABC", "N1XYZ")
+}
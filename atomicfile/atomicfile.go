@@ -0,0 +1,39 @@
+package atomicfile
+
+import (
+	"log"
+	"os"
+)
+
+// WriteFile writes data to a temp file next to fname, flushes it to disk and renames it over fname,
+// so a crash leaves either the old or the new content, never part of it
+func WriteFile(fname string, data []byte, perm os.FileMode) error {
+	tmp := fname + ".tmp"
+	// #nosec G304
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, fname)
+	if err != nil {
+		log.Printf("%+v", err)
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
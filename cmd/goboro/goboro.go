@@ -32,11 +32,15 @@ func main() {
 
 	// process command line
 	var configFile string
+	var dryRun string
+	var setSecret string
 	flg := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	flg.StringVar(&configFile, "config", "", "Configuration file")
+	flg.StringVar(&dryRun, "dryrun", "", "Folder to write .eml files to instead of sending email")
+	flg.StringVar(&setSecret, "setsecret", "", "Name of a secret to save in the encrypted secrets file")
 	err = flg.Parse(os.Args[1:])
 	if err != nil {
-		err := fmt.Errorf("%s\n\nUsage of %s\n  -config string\n    Configuration file", err.Error(), os.Args[0])
+		err := fmt.Errorf("%s\n\nUsage of %s\n  -config string\n    Configuration file\n  -dryrun string\n    Folder to write .eml files to instead of sending email\n  -setsecret string\n    Name of a secret to save in the encrypted secrets file", err.Error(), os.Args[0])
 		log.Fatalf("%+v", err)
 	}
 
@@ -50,7 +54,19 @@ func main() {
 		cfn = basefn + ".yaml"
 	}
 
-	err = config.Read(cfn)
+	// secrets file passphrase is asked for when a secret in it is first needed
+	config.PassphrasePrompt = ui.PromptPassphrase
+
+	// save a secret and quit, the configuration may not be complete without it
+	if len(setSecret) > 0 {
+		err = ui.SetSecret(cfn, setSecret)
+		if err != nil {
+			log.Fatalf("%+v", err)
+		}
+		return
+	}
+
+	err = config.Read(cfn, dryRun)
 	if err != nil {
 		log.Fatalf("%+v", err)
 	}
@@ -4,7 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/lxn/walk"
 	"gopkg.in/yaml.v3"
@@ -20,6 +25,30 @@ var (
 	QRZ                      qrz
 	Office365AppRegistration office365AppRegistration
 	Email                    email
+	SMTP                     smtp
+	File                     file
+	Schedule                 schedule
+	Tracking                 tracking
+	OptOut                   optOut
+	Archive                  archive
+)
+
+const (
+	// email backends
+	BackendGraph = "graph"
+	BackendSMTP  = "smtp"
+	BackendFile  = "file"
+
+	// Office 365 authentication
+	AuthApplication = "application"
+	AuthDelegated   = "delegated"
+
+	// template formats
+	FormatText = "text"
+	FormatHTML = "html"
+
+	// template Signature to leave the signature off
+	NoSignature = "none"
 )
 
 type mainwinrectangle struct {
@@ -51,7 +80,7 @@ type ui struct {
 type qrz struct {
 	Endpoint string // the QRZ Versioned URL
 	Username string // a valid QRZ user name
-	Password string // the correct password for the username
+	Password Secret // the correct password for the username
 	Agent    string // a string that contains the product name and version of the client program
 }
 
@@ -66,7 +95,7 @@ func (q *qrz) Validate() error {
 		err := fmt.Errorf(msgMissingField, "QRZ Username")
 		return err
 	}
-	if q.Password == "" {
+	if q.Password.IsZero() {
 		err := fmt.Errorf(msgMissingField, "QRZ Password")
 		return err
 	}
@@ -79,61 +108,528 @@ func (q *qrz) Validate() error {
 }
 
 type office365AppRegistration struct {
-	TenantID string
+	Auth     string `yaml:",omitempty"` // application (default) with a client secret, or delegated to sign in as the user
+	TenantID string // "common" or "consumers" for personal outlook.com accounts with delegated auth
 	ClientID string
-	Secret   string
+	Secret   Secret `yaml:",omitempty"`
+
+	// certificate credentials instead of Secret, a PEM or PFX file with the certificate and private key
+	Certificate         string `yaml:",omitempty"`
+	CertificatePassword Secret `yaml:",omitempty"`
+
+	// national clouds and local stand-ins, the global cloud when empty
+	AuthorityHost string `yaml:",omitempty"` // https://login.microsoftonline.us for GCC High
+	GraphURL      string `yaml:",omitempty"` // https://graph.microsoft.us for GCC High
+	GraphVersion  string `yaml:",omitempty"` // v1.0 (default) or beta
 }
 
 // Validate tests the required office365AppRegistration fields
 // doesn't log errors because you don't have to use qrz
 func (o *office365AppRegistration) Validate() error {
-	if o.TenantID == "" {
-		err := fmt.Errorf(msgMissingField, "Office365AppRegistration TenantID")
+	switch o.Auth {
+	case "", AuthApplication, AuthDelegated:
+	default:
+		err := fmt.Errorf("invalid Office365AppRegistration Auth %q, expected application or delegated", o.Auth)
 		return err
 	}
 	if o.ClientID == "" {
 		err := fmt.Errorf(msgMissingField, "Office365AppRegistration ClientID")
 		return err
 	}
-	if o.Secret == "" {
-		err := fmt.Errorf(msgMissingField, "Office365AppRegistration Secret")
+	err := validateEndpoint("Office365AppRegistration AuthorityHost", o.AuthorityHost, false)
+	if err != nil {
+		return err
+	}
+	err = validateEndpoint("Office365AppRegistration GraphURL", o.GraphURL, true)
+	if err != nil {
+		return err
+	}
+	switch o.GraphVersion {
+	case "", "v1.0", "beta":
+	default:
+		err := fmt.Errorf("invalid Office365AppRegistration GraphVersion %q, expected v1.0 or beta", o.GraphVersion)
+		return err
+	}
+	if o.IsDelegated() {
+		// signed in user, TenantID defaults to common
+		return nil
+	}
+	if o.TenantID == "" {
+		err := fmt.Errorf(msgMissingField, "Office365AppRegistration TenantID")
+		return err
+	}
+	if o.Secret.IsZero() && o.Certificate == "" {
+		err := fmt.Errorf(msgMissingField, "Office365AppRegistration Secret or Certificate")
+		return err
+	}
+	if !o.Secret.IsZero() && o.Certificate != "" {
+		err := errors.New("only one of Office365AppRegistration Secret or Certificate is needed")
 		return err
 	}
 
 	return nil
 }
 
+// validateEndpoint checks an endpoint is a URL with no path, sign-in requires https
+func validateEndpoint(name, endpoint string, allowHTTP bool) error {
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		err := fmt.Errorf("invalid %s %q, expected a URL like https://host", name, endpoint)
+		return err
+	}
+	if u.Scheme != "https" && !(allowHTTP && u.Scheme == "http") {
+		err := fmt.Errorf("invalid %s %q, it must be https", name, endpoint)
+		return err
+	}
+
+	return nil
+}
+
+// IsDelegated tests if mail is sent as the signed-in user instead of with application permissions
+func (o *office365AppRegistration) IsDelegated() bool {
+	return o.Auth == AuthDelegated
+}
+
+// Tenant is the tenant to sign in to, defaulting to common for delegated auth
+func (o *office365AppRegistration) Tenant() string {
+	if o.TenantID == "" && o.IsDelegated() {
+		return "common"
+	}
+	return o.TenantID
+}
+
 type email struct {
-	UserID          string // from user, UPN or ObjectID
-	SubjectTemplate string // QSL Bureau cards for {{ callsign }}
-	BodyTemplate    string // QSL Bureau cards for {{ callsign }}
+	Backend         string            // graph (default), smtp or file
+	UserID          string            // from user, UPN or ObjectID for graph, sender address for smtp
+	From            string            `yaml:",omitempty"` // shared mailbox address to send as, or on behalf of
+	OnBehalf        bool              `yaml:",omitempty"` // send on behalf of From instead of as From
+	CC              []string          `yaml:",omitempty"` // always copied, like the bureau manager
+	BCC             []string          `yaml:",omitempty"`
+	ReplyTo         []string          `yaml:",omitempty"` // shared bureau address for replies
+	Draft           bool              `yaml:",omitempty"` // save to Drafts for review instead of sending, by default
+	DryRun          string            `yaml:"-"`          // folder to write messages to instead of sending, from the command line
+	SubjectTemplate string            // QSL Bureau cards for {{ callsign }}
+	BodyTemplate    string            // QSL Bureau cards for {{ callsign }}
+	BodyFormat      string            `yaml:",omitempty"` // text (default) or html
+	Templates       []messageTemplate `yaml:",omitempty"` // additional named templates
+	Identities      []identity        `yaml:",omitempty"` // who is sending, by sending address
+	Signatures      []signature       `yaml:",omitempty"` // named signature blocks
+
+	// sending limits, 0 for no limit, keep under the provider's so the account isn't suspended
+	MaxPerMinute      int `yaml:",omitempty"`
+	MaxPerDay         int `yaml:",omitempty"`
+	MinSpacingSeconds int `yaml:",omitempty"` // least time between messages
+
+	Categories      []string `yaml:",omitempty"` // Outlook categories put on sent messages, like "QSL Bureau"
+	SaveToSentItems *bool    `yaml:",omitempty"` // keep a copy in Sent Items, defaults to true
 }
 
 // Validate tests the required email fields
 // doesn't log errors because you don't have to use qrz
 func (e *email) Validate() error {
+	switch e.Backend {
+	case "", BackendGraph, BackendSMTP, BackendFile:
+	default:
+		err := fmt.Errorf("unknown Email Backend %q", e.Backend)
+		return err
+	}
 	if e.UserID == "" {
 		err := fmt.Errorf(msgMissingField, "Email UserID")
 		return err
 	}
-	if e.SubjectTemplate == "" {
-		err := fmt.Errorf(msgMissingField, "Email SubjectTemplate")
+	if e.OnBehalf && e.From == "" {
+		err := fmt.Errorf(msgMissingField, "Email From")
+		return err
+	}
+	addresses := []string{e.From}
+	addresses = append(addresses, e.CC...)
+	addresses = append(addresses, e.BCC...)
+	addresses = append(addresses, e.ReplyTo...)
+	for _, a := range addresses {
+		if a == "" {
+			continue
+		}
+		_, err := mail.ParseAddress(a)
+		if err != nil {
+			err = fmt.Errorf("invalid Email address %q: %w", a, err)
+			return err
+		}
+	}
+	if e.MaxPerMinute < 0 || e.MaxPerDay < 0 || e.MinSpacingSeconds < 0 {
+		err := errors.New("negative Email MaxPerMinute, MaxPerDay or MinSpacingSeconds")
+		return err
+	}
+
+	// default template is optional when there are named ones
+	if len(e.Templates) == 0 || e.SubjectTemplate != "" || e.BodyTemplate != "" {
+		if e.SubjectTemplate == "" {
+			err := fmt.Errorf(msgMissingField, "Email SubjectTemplate")
+			return err
+		}
+		if e.BodyTemplate == "" {
+			err := fmt.Errorf(msgMissingField, "Email BodyTemplate")
+			return err
+		}
+	}
+	for _, t := range e.AllTemplates() {
+		err := t.Validate()
+		if err != nil {
+			return err
+		}
+		if t.Signature != "" && t.Signature != NoSignature && e.FindSignature(t.Signature) == nil {
+			err := fmt.Errorf("unknown Email Template Signature %q for %s", t.Signature, t.Name)
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, sig := range e.Signatures {
+		err := sig.Validate()
+		if err != nil {
+			return err
+		}
+		if names[sig.Name] {
+			err := fmt.Errorf("duplicate Email Signature %q", sig.Name)
+			return err
+		}
+		names[sig.Name] = true
+	}
+	for _, id := range e.Identities {
+		if id.Address == "" {
+			err := fmt.Errorf(msgMissingField, "Email Identity Address")
+			return err
+		}
+		if id.Signature != "" && e.FindSignature(id.Signature) == nil {
+			err := fmt.Errorf("unknown Email Identity Signature %q for %s", id.Signature, id.Address)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Identity returns the identity for the address mail is sent from, From or else UserID, nil if there isn't one
+func (e *email) Identity() *identity {
+	address := e.From
+	if address == "" {
+		address = e.UserID
+	}
+	for i := range e.Identities {
+		if strings.EqualFold(e.Identities[i].Address, address) {
+			return &e.Identities[i]
+		}
+	}
+	return nil
+}
+
+// FindSignature returns the signature called name, nil if there isn't one
+func (e *email) FindSignature(name string) *signature {
+	for i := range e.Signatures {
+		if e.Signatures[i].Name == name {
+			return &e.Signatures[i]
+		}
+	}
+	return nil
+}
+
+type identity struct {
+	Address   string // sending address, Email From or UserID
+	Name      string // sorter name, {{ .sorter }} in templates and signatures
+	Callsign  string // sorter callsign, {{ .sortercall }}
+	Bureau    string // bureau name, {{ .bureau }}
+	Signature string `yaml:",omitempty"` // signature appended to messages from this address
+}
+
+type signature struct {
+	Name string
+	Text string // for text templates, and HTML ones when there's no HTML
+	HTML string `yaml:",omitempty"` // for HTML templates
+}
+
+// Validate tests the required signature fields
+func (s *signature) Validate() error {
+	if s.Name == "" {
+		err := fmt.Errorf(msgMissingField, "Email Signature Name")
+		return err
+	}
+	if s.Name == NoSignature {
+		err := fmt.Errorf("invalid Email Signature Name %q, it's reserved for no signature", NoSignature)
 		return err
 	}
-	if e.BodyTemplate == "" {
-		err := fmt.Errorf(msgMissingField, "Email BodyTemplate")
+	if s.Text == "" {
+		err := fmt.Errorf(msgMissingField, "Email Signature Text for "+s.Name)
 		return err
 	}
 
 	return nil
 }
 
+// AllTemplates returns the default template made from SubjectTemplate and BodyTemplate, if there is one,
+// followed by the named Templates
+func (e *email) AllTemplates() []messageTemplate {
+	var templates []messageTemplate
+	if e.BodyTemplate != "" {
+		templates = append(templates, messageTemplate{
+			Name:    "Default",
+			Subject: e.SubjectTemplate,
+			Body:    e.BodyTemplate,
+			Format:  e.BodyFormat,
+		})
+	}
+	return append(templates, e.Templates...)
+}
+
+type messageTemplate struct {
+	Name        string
+	Subject     string // always text
+	Body        string
+	Format      string   `yaml:",omitempty"` // text (default) or html
+	Attachments []string `yaml:",omitempty"` // files to attach, relative paths are from the configuration file folder
+	Signature   string   `yaml:",omitempty"` // signature to append instead of the identity's, none for no signature
+
+	// for messages that need to stand out, like final notices
+	Importance      string            `yaml:",omitempty"` // low, normal (default) or high
+	ReadReceipt     bool              `yaml:",omitempty"` // ask for a read receipt
+	DeliveryReceipt bool              `yaml:",omitempty"` // ask for a delivery receipt
+	Headers         map[string]string `yaml:",omitempty"` // custom X- headers, like X-Bureau-Notice: final
+}
+
+// Validate tests the required messageTemplate fields
+func (t *messageTemplate) Validate() error {
+	if t.Name == "" {
+		err := fmt.Errorf(msgMissingField, "Email Template Name")
+		return err
+	}
+	if t.Subject == "" {
+		err := fmt.Errorf(msgMissingField, "Email Template Subject for "+t.Name)
+		return err
+	}
+	if t.Body == "" {
+		err := fmt.Errorf(msgMissingField, "Email Template Body for "+t.Name)
+		return err
+	}
+	switch t.Format {
+	case "", FormatText, FormatHTML:
+	default:
+		err := fmt.Errorf("unknown Email Template Format %q for %s", t.Format, t.Name)
+		return err
+	}
+	switch t.Importance {
+	case "", "low", "normal", "high":
+	default:
+		err := fmt.Errorf("unknown Email Template Importance %q for %s, expected low, normal or high", t.Importance, t.Name)
+		return err
+	}
+	for name, value := range t.Headers {
+		err := validateHeader(name, value)
+		if err != nil {
+			err = fmt.Errorf("invalid Email Template Headers for %s: %w", t.Name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateHeader checks a custom header is an X- header that can be sent, goboro's own are reserved
+func validateHeader(name, value string) error {
+	if len(name) < 3 || !strings.EqualFold(name[:2], "X-") {
+		return fmt.Errorf("header %q must start with X-", name)
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || c == ':' {
+			return fmt.Errorf("header name %q has characters that aren't allowed", name)
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(name), "x-goboro-") {
+		return fmt.Errorf("header %q is reserved for goboro", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header %q value can't have line breaks", name)
+	}
+
+	return nil
+}
+
+// IsHTML tests if the template body is HTML
+func (t *messageTemplate) IsHTML() bool {
+	return t.Format == FormatHTML
+}
+
+// SavesToSentItems tests if a copy of sent messages is kept in Sent Items
+func (e *email) SavesToSentItems() bool {
+	return e.SaveToSentItems == nil || *e.SaveToSentItems
+}
+
+// MinSpacing is the least time between messages
+func (e *email) MinSpacing() time.Duration {
+	return time.Duration(e.MinSpacingSeconds) * time.Second
+}
+
+// UsesGraph tests if email is sent through Microsoft Graph
+func (e *email) UsesGraph() bool {
+	return e.DryRun == "" && (e.Backend == "" || e.Backend == BackendGraph)
+}
+
+// UsesFile tests if email is written to files instead of being sent
+func (e *email) UsesFile() bool {
+	return e.DryRun != "" || e.Backend == BackendFile
+}
+
+type file struct {
+	Dir  string // folder messages are written to, relative paths are from the configuration file folder
+	Mbox bool   // append to goboro.mbox instead of writing .eml files
+}
+
+// Validate tests the required file fields
+func (f *file) Validate() error {
+	if f.Dir == "" {
+		err := fmt.Errorf(msgMissingField, "File Dir")
+		return err
+	}
+
+	return nil
+}
+
+type smtp struct {
+	Host     string
+	Port     int
+	Security string // starttls, tls or none
+	Auth     string // plain or login
+	Username string
+	Password Secret
+}
+
+// Validate tests the required smtp fields
+func (s *smtp) Validate() error {
+	if s.Host == "" {
+		err := fmt.Errorf(msgMissingField, "SMTP Host")
+		return err
+	}
+	if s.Port == 0 {
+		err := fmt.Errorf(msgMissingField, "SMTP Port")
+		return err
+	}
+	switch s.Security {
+	case "starttls", "tls", "none":
+	default:
+		err := fmt.Errorf("invalid SMTP Security %q, expected starttls, tls or none", s.Security)
+		return err
+	}
+	switch s.Auth {
+	case "", "plain", "login":
+	default:
+		err := fmt.Errorf("invalid SMTP Auth %q, expected plain or login", s.Auth)
+		return err
+	}
+
+	return nil
+}
+
+type schedule struct {
+	Enabled     bool   // hold messages until the recipient's local daytime window
+	WindowStart string // 09:00, recipient local time
+	WindowEnd   string // 20:00, recipient local time, same as WindowStart is open all day
+}
+
+// Validate tests the schedule fields
+func (s *schedule) Validate() error {
+	if !s.Enabled {
+		return nil
+	}
+	if s.WindowStart == "" {
+		err := fmt.Errorf(msgMissingField, "Schedule WindowStart")
+		return err
+	}
+	if s.WindowEnd == "" {
+		err := fmt.Errorf(msgMissingField, "Schedule WindowEnd")
+		return err
+	}
+	for _, v := range []string{s.WindowStart, s.WindowEnd} {
+		_, err := time.Parse("15:04", v)
+		if err != nil {
+			err = fmt.Errorf("invalid Schedule window time %q, expected HH:MM", v)
+			return err
+		}
+	}
+
+	return nil
+}
+
+type tracking struct {
+	Enabled          bool     // poll the sending mailbox for replies and bounces to the messages sent
+	PollMinutes      int      // how often to poll, defaults to 15
+	AlternateDomains []string `yaml:",omitempty"` // callsign@domain addresses offered when a message bounces, defaults to arrl.net
+}
+
+// Validate tests the tracking fields
+func (t *tracking) Validate() error {
+	if t.PollMinutes < 0 {
+		err := fmt.Errorf("invalid Tracking PollMinutes %d, it can't be negative", t.PollMinutes)
+		return err
+	}
+
+	return nil
+}
+
+// Interval is how often to poll for replies
+func (t *tracking) Interval() time.Duration {
+	if t.PollMinutes == 0 {
+		return 15 * time.Minute
+	}
+	return time.Duration(t.PollMinutes) * time.Minute
+}
+
+// Alternates are the domains of the alternate addresses to offer when a message bounces
+func (t *tracking) Alternates() []string {
+	if len(t.AlternateDomains) == 0 {
+		return []string{"arrl.net"}
+	}
+	return t.AlternateDomains
+}
+
+type archive struct {
+	Enabled bool   // keep a local copy of every message sent
+	Dir     string `yaml:",omitempty"` // folder for the archive, relative paths are from the configuration file folder, defaults next to it
+	Mbox    bool   // keep goboro.mbox in Dir instead of making Dir a Maildir
+}
+
+// Folder is where the archive is kept
+func (a *archive) Folder() string {
+	if a.Dir == "" {
+		return DataFile("archive")
+	}
+	return ResolvePath(a.Dir)
+}
+
+type optOut struct {
+	AutoAdd       bool     // add stations whose reply asks not to be emailed to the opt-out list
+	ReplyKeywords []string `yaml:",omitempty"` // words in a reply that ask not to be emailed, defaults to "unsubscribe" and "no cards"
+}
+
+// Keywords are the words in a reply that ask not to be emailed
+func (o *optOut) Keywords() []string {
+	if len(o.ReplyKeywords) == 0 {
+		return []string{"unsubscribe", "no cards"}
+	}
+	return o.ReplyKeywords
+}
+
 // Configuration is the application configuration that is serialized/deserialized to file
 type Configuration struct {
 	UI                       ui
 	QRZ                      qrz
 	Office365AppRegistration office365AppRegistration
 	Email                    email
+	SMTP                     smtp     `yaml:",omitempty"`
+	File                     file     `yaml:",omitempty"`
+	Schedule                 schedule `yaml:",omitempty"`
+	Tracking                 tracking `yaml:",omitempty"`
+	OptOut                   optOut   `yaml:",omitempty"`
+	Archive                  archive  `yaml:",omitempty"`
 }
 
 // Validate tests the required Configuration fields
@@ -143,12 +639,31 @@ func (c *Configuration) Validate() error {
 		log.Printf("%+v", err)
 		return err
 	}
-	err = c.Office365AppRegistration.Validate()
+	err = c.Email.Validate()
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
 	}
-	err = c.Email.Validate()
+	switch {
+	case c.Email.DryRun != "":
+		// messages are written to the folder from the command line, no backend settings are needed
+	case c.Email.UsesGraph():
+		err = c.Office365AppRegistration.Validate()
+	case c.Email.Backend == BackendSMTP:
+		err = c.SMTP.Validate()
+	case c.Email.Backend == BackendFile:
+		err = c.File.Validate()
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	err = c.Schedule.Validate()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	err = c.Tracking.Validate()
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
@@ -157,8 +672,9 @@ func (c *Configuration) Validate() error {
 	return nil
 }
 
-// Read loads application configuration from file fname
-func Read(fname string) error {
+// Read loads application configuration from file fname, messages are written to folder dryRun
+// instead of being sent if it isn't empty
+func Read(fname, dryRun string) error {
 	// save for write later
 	configFile = fname
 
@@ -175,6 +691,7 @@ func Read(fname string) error {
 		log.Printf("%+v", err)
 		return err
 	}
+	c.Email.DryRun = dryRun
 
 	// make sure valid before unwrapping
 	err = c.Validate()
@@ -183,10 +700,23 @@ func Read(fname string) error {
 		return err
 	}
 
+	// the references stay as they are, to be written back
+	err = c.resolveSecrets(fname)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
 	UI = c.UI
 	QRZ = c.QRZ
 	Office365AppRegistration = c.Office365AppRegistration
 	Email = c.Email
+	SMTP = c.SMTP
+	File = c.File
+	Schedule = c.Schedule
+	Tracking = c.Tracking
+	OptOut = c.OptOut
+	Archive = c.Archive
 
 	return nil
 }
@@ -203,6 +733,12 @@ func Write() error {
 		QRZ:                      QRZ,
 		Office365AppRegistration: Office365AppRegistration,
 		Email:                    Email,
+		SMTP:                     SMTP,
+		File:                     File,
+		Schedule:                 Schedule,
+		Tracking:                 Tracking,
+		OptOut:                   OptOut,
+		Archive:                  Archive,
 	}
 
 	// make sure valid before proceeding
@@ -228,3 +764,18 @@ func Write() error {
 
 	return nil
 }
+
+// DataFile returns the name of a file that stores application data alongside the configuration file,
+// goboro.yaml with suffix outbox.json becomes goboro.outbox.json
+func DataFile(suffix string) string {
+	base := strings.TrimSuffix(configFile, filepath.Ext(configFile))
+	return base + "." + suffix
+}
+
+// ResolvePath makes relative paths in the configuration relative to the folder the configuration file is in
+func ResolvePath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(configFile), p)
+}
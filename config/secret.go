@@ -0,0 +1,251 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bbathe/goboro/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// secret reference kinds
+const (
+	secretEnv  = "env"  // ${env:NAME}, an environment variable
+	secretFile = "file" // ${file:NAME}, from the encrypted secrets file
+	secretCmd  = "cmd"  // ${cmd:command line}, what the command prints
+)
+
+// commands that print a secret have this long
+const secretCmdTimeout = 30 * time.Second
+
+var (
+	reSecretRef     = regexp.MustCompile(`^\$\{(env|file|cmd):(.+)\}$`)
+	errNoPassphrase = errors.New("no way to ask for the secrets file passphrase")
+
+	// PassphrasePrompt asks the user for the passphrase of the secrets file,
+	// confirm is true when the file is being created
+	PassphrasePrompt func(confirm bool) (string, error)
+)
+
+// Secret is a configuration value that can be kept somewhere other than the configuration file:
+// ${env:NAME} for an environment variable, ${file:NAME} for a value in the passphrase-encrypted
+// secrets file next to the configuration file, or ${cmd:command line} for the output of a command,
+// like a password manager's. Anything else is the value itself.
+// Only the reference is ever written back to the configuration file.
+type Secret struct {
+	ref   string // as written in the configuration file
+	value string // resolved
+}
+
+// Value is the resolved secret
+func (s Secret) Value() string {
+	return s.value
+}
+
+// IsZero tests if the secret isn't set, so it's left out of the configuration file
+func (s Secret) IsZero() bool {
+	return s.ref == ""
+}
+
+// UnmarshalYAML keeps the value as written, it's resolved once the whole configuration is read
+func (s *Secret) UnmarshalYAML(node *yaml.Node) error {
+	var ref string
+	err := node.Decode(&ref)
+	if err != nil {
+		return err
+	}
+
+	s.ref = ref
+	s.value = ""
+	if !reSecretRef.MatchString(ref) {
+		s.value = ref
+	}
+
+	return nil
+}
+
+// MarshalYAML writes the reference, never the value it resolved to
+func (s Secret) MarshalYAML() (any, error) {
+	return s.ref, nil
+}
+
+// secretResolver resolves the references in a configuration, the secrets file is decrypted at most once
+type secretResolver struct {
+	fname  string
+	loaded map[string]string
+}
+
+// resolve sets the value of s from its reference, name is the configuration field for errors
+func (r *secretResolver) resolve(name string, s *Secret) error {
+	m := reSecretRef.FindStringSubmatch(s.ref)
+	if m == nil {
+		return nil
+	}
+	kind, key := m[1], strings.TrimSpace(m[2])
+
+	var err error
+	switch kind {
+	case secretEnv:
+		v, ok := os.LookupEnv(key)
+		switch {
+		case !ok:
+			err = fmt.Errorf("environment variable %s for %s is not set", key, name)
+		case v == "":
+			err = fmt.Errorf("environment variable %s for %s is empty", key, name)
+		}
+		s.value = v
+	case secretFile:
+		s.value, err = r.fromFile(key)
+		if err != nil {
+			err = fmt.Errorf("secrets file value for %s: %w", name, err)
+		}
+	case secretCmd:
+		s.value, err = fromCommand(key)
+		if err != nil {
+			err = fmt.Errorf("command for %s: %w", name, err)
+		}
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// fromFile returns secret key from the secrets file, asking for the passphrase the first time
+func (r *secretResolver) fromFile(key string) (string, error) {
+	if r.loaded == nil {
+		if PassphrasePrompt == nil {
+			return "", errNoPassphrase
+		}
+		passphrase, err := PassphrasePrompt(false)
+		if err != nil {
+			log.Printf("%+v", err)
+			return "", err
+		}
+
+		r.loaded, err = secrets.Load(r.fname, passphrase)
+		if err != nil {
+			log.Printf("%+v", err)
+			return "", err
+		}
+	}
+
+	v, ok := r.loaded[key]
+	if !ok {
+		return "", fmt.Errorf("no secret %s in %s", key, r.fname)
+	}
+
+	return v, nil
+}
+
+// fromCommand runs the command line and returns what it prints, without the trailing line break
+func fromCommand(commandLine string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretCmdTimeout)
+	defer cancel()
+
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, "cmd.exe", "/C", commandLine)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		log.Printf("%+v", err)
+		return "", err
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// secretsFile is the secrets file for configuration file fname
+func secretsFile(fname string) string {
+	return strings.TrimSuffix(fname, filepath.Ext(fname)) + ".secrets"
+}
+
+// resolveSecrets resolves the secret references in c that are needed
+func (c *Configuration) resolveSecrets(fname string) error {
+	r := &secretResolver{
+		fname: secretsFile(fname),
+	}
+
+	type namedSecret struct {
+		name   string
+		secret *Secret
+	}
+	needed := []namedSecret{
+		{"QRZ Password", &c.QRZ.Password},
+	}
+
+	// only the secrets of the backend in use, a dry run needs none
+	switch {
+	case c.Email.DryRun != "":
+	case c.Email.UsesGraph():
+		needed = append(needed,
+			namedSecret{"Office365AppRegistration Secret", &c.Office365AppRegistration.Secret},
+			namedSecret{"Office365AppRegistration CertificatePassword", &c.Office365AppRegistration.CertificatePassword},
+		)
+	case c.Email.Backend == BackendSMTP:
+		needed = append(needed, namedSecret{"SMTP Password", &c.SMTP.Password})
+	}
+
+	for _, s := range needed {
+		err := r.resolve(s.name, s.secret)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetSecret adds or replaces secret name in the secrets file for configuration file fname,
+// creating the file if needed, it's referenced in the configuration as ${file:name}
+func SetSecret(fname, name, value string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "{}") {
+		err := fmt.Errorf("invalid secret name %q", name)
+		log.Printf("%+v", err)
+		return err
+	}
+	if PassphrasePrompt == nil {
+		return errNoPassphrase
+	}
+
+	sf := secretsFile(fname)
+	exists := secrets.Exists(sf)
+
+	passphrase, err := PassphrasePrompt(!exists)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	values := make(map[string]string)
+	if exists {
+		values, err = secrets.Load(sf, passphrase)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+	values[name] = value
+
+	return secrets.Save(sf, passphrase, values)
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bbathe/goboro/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSecretYAML(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		wantValue string // before resolving
+		wantRef   string
+	}{
+		{"plain", "hunter22", "hunter22", "hunter22"},
+		{"env", "${env:GOBORO_QRZ}", "", "${env:GOBORO_QRZ}"},
+		{"file", "${file:qrz}", "", "${file:qrz}"},
+		{"cmd", "${cmd:pass show qrz}", "", "${cmd:pass show qrz}"},
+		{"not a reference", "${qrz}", "${qrz}", "${qrz}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q qrz
+			err := yaml.Unmarshal([]byte("username: k1abc\npassword: "+tt.yaml+"\n"), &q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := q.Password.Value(); got != tt.wantValue {
+				t.Errorf("Value() = %q, want %q", got, tt.wantValue)
+			}
+
+			// even once resolved, only the reference is written back
+			if q.Password.value == "" {
+				q.Password.value = "resolved"
+			}
+			b, err := yaml.Marshal(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m map[string]string
+			err = yaml.Unmarshal(b, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m["password"] != tt.wantRef {
+				t.Errorf("written as %q, want %q", m["password"], tt.wantRef)
+			}
+			if tt.wantRef != tt.wantValue && strings.Contains(string(b), "resolved") {
+				t.Errorf("resolved value written:\n%s", b)
+			}
+		})
+	}
+}
+
+func TestSecretOmitted(t *testing.T) {
+	b, err := yaml.Marshal(office365AppRegistration{ClientID: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("unset secret written:\n%s", b)
+	}
+}
+
+// usePassphrase makes PassphrasePrompt answer passphrase until the test ends
+func usePassphrase(t *testing.T, passphrase string) {
+	t.Helper()
+
+	prompt := PassphrasePrompt
+	PassphrasePrompt = func(bool) (string, error) {
+		return passphrase, nil
+	}
+	t.Cleanup(func() { PassphrasePrompt = prompt })
+}
+
+func TestSecretResolve(t *testing.T) {
+	t.Setenv("GOBORO_QRZ", "from env")
+	t.Setenv("GOBORO_EMPTY", "")
+
+	fname := filepath.Join(t.TempDir(), "goboro.secrets")
+	err := secrets.Save(fname, "correct horse", map[string]string{"qrz": "from file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ref        string
+		passphrase string
+		want       string
+		wantErr    bool
+	}{
+		{"plain", "hunter22", "", "hunter22", false},
+		{"env", "${env:GOBORO_QRZ}", "", "from env", false},
+		{"env not set", "${env:GOBORO_UNSET}", "", "", true},
+		{"env empty", "${env:GOBORO_EMPTY}", "", "", true},
+		{"file", "${file:qrz}", "correct horse", "from file", false},
+		{"file wrong passphrase", "${file:qrz}", "wrong horse", "", true},
+		{"file no such secret", "${file:smtp}", "correct horse", "", true},
+		{"cmd", "${cmd:echo from cmd}", "", "from cmd", false},
+		{"cmd fails", "${cmd:exit 1}", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePassphrase(t, tt.passphrase)
+
+			var s Secret
+			err := yaml.Unmarshal([]byte(tt.ref), &s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := &secretResolver{fname: fname}
+			err = r.resolve("QRZ Password", &s)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolved to %q, want an error", s.Value())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Value() != tt.want {
+				t.Errorf("Value() = %q, want %q", s.Value(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretResolveNoPrompt(t *testing.T) {
+	prompt := PassphrasePrompt
+	PassphrasePrompt = nil
+	t.Cleanup(func() { PassphrasePrompt = prompt })
+
+	var s Secret
+	err := yaml.Unmarshal([]byte("${file:qrz}"), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &secretResolver{fname: filepath.Join(t.TempDir(), "goboro.secrets")}
+	err = r.resolve("QRZ Password", &s)
+	if !errors.Is(err, errNoPassphrase) {
+		t.Errorf("error %v, want %v", err, errNoPassphrase)
+	}
+}
+
+func TestResolveSecretsDryRun(t *testing.T) {
+	var c Configuration
+	err := yaml.Unmarshal([]byte("qrz:\n  password: hunter22\noffice365appregistration:\n  secret: ${env:GOBORO_UNSET}\n"), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.resolveSecrets(filepath.Join(t.TempDir(), "goboro.yaml"))
+	if err == nil {
+		t.Error("Graph secret resolved, want an error")
+	}
+
+	c.Email.DryRun = t.TempDir()
+	err = c.resolveSecrets(filepath.Join(t.TempDir(), "goboro.yaml"))
+	if err != nil {
+		t.Errorf("dry run resolved the Graph secret: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// characters allowed in a local part without quoting
+const atext = "[\\w!#$%&'*+/=?^`{|}~\\x{80}-\\x{10FFFF}-]+"
+
+var (
+	errNoAddress = errors.New("no email address")
+
+	// addresses written out to dodge harvesters, k1abc at arrl dot net or k1abc [at] arrl [dot] net
+	reObfuscatedAt  = regexp.MustCompile(`(?i)\s*(?:\[at\]|\(at\)|\{at\}|<at>|\sat\s)\s*`)
+	reObfuscatedDot = regexp.MustCompile(`(?i)\s*(?:\[dot\]|\(dot\)|\{dot\}|<dot>|\sdot\s)\s*`)
+
+	// a display name and an address in angle brackets, only the address is repaired
+	reNamedAddress = regexp.MustCompile(`^(.*?)<([^<>]*)>\s*$`)
+
+	// local parts that don't need quoting, RFC 5322 dot-atom, with UTF-8 allowed as in RFC 6532
+	reDotAtom = regexp.MustCompile(`^` + atext + `(?:\.` + atext + `)*$`)
+
+	// commonly mistyped domains and what was meant, only domains that don't exist,
+	// a registered domain may well be where the station really gets mail
+	domainTypos = map[string]string{
+		"gmial.com":   "gmail.com",
+		"gmal.com":    "gmail.com",
+		"gamil.com":   "gmail.com",
+		"gnail.com":   "gmail.com",
+		"gmaill.com":  "gmail.com",
+		"gmail.con":   "gmail.com",
+		"gmail.cm":    "gmail.com",
+		"yaho.com":    "yahoo.com",
+		"yahooo.com":  "yahoo.com",
+		"yhoo.com":    "yahoo.com",
+		"yahoo.con":   "yahoo.com",
+		"hotmal.com":  "hotmail.com",
+		"hotmial.com": "hotmail.com",
+		"hotmail.con": "hotmail.com",
+		"outlok.com":  "outlook.com",
+		"outlook.con": "outlook.com",
+		"aol.con":     "aol.com",
+		"comcat.net":  "comcast.net",
+		"iclod.com":   "icloud.com",
+		"icloud.con":  "icloud.com",
+		"arrl.nte":    "arrl.net",
+		"arrl.ent":    "arrl.net",
+	}
+
+	// mistyped top level domains
+	tldTypos = map[string]string{
+		"con": "com",
+		"cmo": "com",
+		"ocm": "com",
+		"nte": "net",
+		"ent": "net",
+		"ogr": "org",
+	}
+)
+
+// Address is a validated and normalized recipient address
+type Address struct {
+	Address    string // normalized address, domain lower case and in ASCII form
+	Suggestion string // probable intended address when the domain looks mistyped
+}
+
+// String returns the normalized address
+func (a Address) String() string {
+	return a.Address
+}
+
+// Deobfuscate repairs addresses written out to avoid harvesting, like "k1abc at arrl dot net",
+// returns the repaired string and true if anything was changed. Addresses that are valid as they are,
+// like "Dot Smith" <dot@example.com>, are left alone, and so are display names.
+func Deobfuscate(s string) (string, bool) {
+	fields := splitAddressList(s)
+
+	changed := false
+	for i, field := range fields {
+		if _, err := mail.ParseAddress(field); err == nil {
+			continue
+		}
+
+		r := deobfuscate(field)
+		if m := reNamedAddress.FindStringSubmatch(field); m != nil {
+			r = m[1] + "<" + deobfuscate(m[2]) + ">"
+		}
+		if r != field {
+			fields[i] = r
+			changed = true
+		}
+	}
+	if !changed {
+		return strings.TrimSpace(s), false
+	}
+
+	return strings.Join(fields, ", "), true
+}
+
+// deobfuscate replaces the written out @ and . in s
+func deobfuscate(s string) string {
+	r := reObfuscatedAt.ReplaceAllString(" "+s+" ", "@")
+	r = reObfuscatedDot.ReplaceAllString(r, ".")
+	return strings.TrimSpace(r)
+}
+
+// ParseAddresses validates and normalizes the addresses in s, which may hold several separated by commas or semicolons
+func ParseAddresses(s string) ([]Address, error) {
+	fields := splitAddressList(s)
+	if len(fields) == 0 {
+		return nil, errNoAddress
+	}
+
+	for _, field := range fields {
+		if _, changed := Deobfuscate(field); changed {
+			err := fmt.Errorf("%q looks obfuscated, it needs repairing before sending", field)
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	// RFC 5322 syntax
+	list, err := mail.ParseAddressList(strings.Join(fields, ", "))
+	if err != nil {
+		// find the one at fault for the message
+		for _, field := range fields {
+			if _, ferr := mail.ParseAddress(field); ferr != nil {
+				err = fmt.Errorf("%q is not a valid email address: %w", field, ferr)
+				break
+			}
+		}
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	addresses := make([]Address, 0, len(list))
+	for _, ma := range list {
+		a, err := normalizeAddress(ma.Address)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+
+	return addresses, nil
+}
+
+// addressScanner tracks whether a position in an address list is inside a quoted display name,
+// comment or angle brackets
+type addressScanner struct {
+	quoted  bool
+	escaped bool
+	comment int
+	angle   int
+}
+
+// separator advances the scanner past r and reports whether r separates two addresses
+func (sc *addressScanner) separator(r rune) bool {
+	switch {
+	case sc.escaped:
+		sc.escaped = false
+	case r == '\\' && (sc.quoted || sc.comment > 0):
+		sc.escaped = true
+	case r == '"' && sc.comment == 0:
+		sc.quoted = !sc.quoted
+	case sc.quoted:
+	case r == '(':
+		sc.comment++
+	case r == ')' && sc.comment > 0:
+		sc.comment--
+	case sc.comment > 0:
+	case r == '<':
+		sc.angle++
+	case r == '>' && sc.angle > 0:
+		sc.angle--
+	default:
+		return (r == ',' || r == ';') && sc.angle == 0
+	}
+
+	return false
+}
+
+// splitAddressList splits s at the commas and semicolons between addresses, ignoring those in
+// quoted display names, comments and angle brackets, and drops empty entries
+func splitAddressList(s string) []string {
+	var fields []string
+	var sc addressScanner
+	start := 0
+
+	for i, r := range s {
+		if sc.separator(r) {
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	fields = append(fields, s[start:])
+
+	nonEmpty := fields[:0]
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f != "" {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+
+	return nonEmpty
+}
+
+// normalizeAddress checks the domain of addr-spec addr and converts it to lower case ASCII form
+func normalizeAddress(addr string) (Address, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 1 {
+		err := fmt.Errorf("%q is not a valid email address", addr)
+		return Address{}, err
+	}
+	// the local part is kept as it is, but quoted again if it has to be, like "joe smith"
+	local, domain := quoteLocal(addr[:at]), addr[at+1:]
+
+	// internationalized domains are converted to their ASCII form, this also checks label syntax
+	ascii, err := idna.Lookup.ToASCII(strings.ToLower(domain))
+	if err != nil {
+		err = fmt.Errorf("%q has an invalid domain: %w", addr, err)
+		return Address{}, err
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 || len(labels[len(labels)-1]) < 2 {
+		err = fmt.Errorf("%q has an incomplete domain", addr)
+		return Address{}, err
+	}
+
+	a := Address{
+		Address: local + "@" + ascii,
+	}
+	if fix := suggestDomain(ascii); fix != "" {
+		a.Suggestion = local + "@" + fix
+	}
+
+	return a, nil
+}
+
+// quoteLocal returns local part local as it's written in an address, quoted if it isn't a dot-atom
+func quoteLocal(local string) string {
+	if reDotAtom.MatchString(local) {
+		return local
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(local) + `"`
+}
+
+// suggestDomain returns the likely intended domain if domain is a common typo, otherwise empty string
+func suggestDomain(domain string) string {
+	if fix, ok := domainTypos[domain]; ok {
+		return fix
+	}
+
+	i := strings.LastIndex(domain, ".")
+	if fix, ok := tldTypos[domain[i+1:]]; ok {
+		return domain[:i+1] + fix
+	}
+
+	return ""
+}
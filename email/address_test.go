@@ -0,0 +1,82 @@
+package email_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bbathe/goboro/email"
+)
+
+func TestParseAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []email.Address
+		wantErr bool
+	}{
+		{"single", "k1abc@arrl.net", []email.Address{{Address: "k1abc@arrl.net"}}, false},
+		{"domain lower case", "K1ABC@ARRL.NET", []email.Address{{Address: "K1ABC@arrl.net"}}, false},
+		{"display name", "Joe Smith <k1abc@arrl.net>", []email.Address{{Address: "k1abc@arrl.net"}}, false},
+		{"commas", "k1abc@arrl.net, w1aw@arrl.org", []email.Address{{Address: "k1abc@arrl.net"}, {Address: "w1aw@arrl.org"}}, false},
+		{"semicolons", "k1abc@arrl.net; w1aw@arrl.org;", []email.Address{{Address: "k1abc@arrl.net"}, {Address: "w1aw@arrl.org"}}, false},
+		{"comma in quoted name", `"Smith, Joe" <k1abc@arrl.net>, w1aw@arrl.org`, []email.Address{{Address: "k1abc@arrl.net"}, {Address: "w1aw@arrl.org"}}, false},
+		{"escaped quote in name", `"Joe \"K1ABC\", Smith" <k1abc@arrl.net>`, []email.Address{{Address: "k1abc@arrl.net"}}, false},
+		{"comma in comment", "k1abc@arrl.net (Joe, home)", []email.Address{{Address: "k1abc@arrl.net"}}, false},
+		{"internationalized domain", "k1abc@bücher.de", []email.Address{{Address: "k1abc@xn--bcher-kva.de"}}, false},
+		{"domain typo", "k1abc@gmial.com", []email.Address{{Address: "k1abc@gmial.com", Suggestion: "k1abc@gmail.com"}}, false},
+		{"tld typo", "k1abc@example.cmo", []email.Address{{Address: "k1abc@example.cmo", Suggestion: "k1abc@example.com"}}, false},
+		{"real domain", "k1abc@verizon.com", []email.Address{{Address: "k1abc@verizon.com"}}, false},
+		{"at and dot in display names", `"Dot Smith" <dot@example.com>, Pat At Home <pat@home.net>`, []email.Address{{Address: "dot@example.com"}, {Address: "pat@home.net"}}, false},
+		{"quoted local part", `"joe smith"@example.com`, []email.Address{{Address: `"joe smith"@example.com`}}, false},
+		{"escaped quoted local part", `"joe \"k1abc\""@example.com`, []email.Address{{Address: `"joe \"k1abc\""@example.com`}}, false},
+		{"needlessly quoted local part", `"k1abc"@arrl.net`, []email.Address{{Address: "k1abc@arrl.net"}}, false},
+		{"empty", " , ; ", nil, true},
+		{"obfuscated", "k1abc at arrl dot net", nil, true},
+		{"no at", "k1abc.arrl.net", nil, true},
+		{"one bad", "k1abc@arrl.net, w1aw", nil, true},
+		{"incomplete domain", "k1abc@arrl", nil, true},
+		{"short tld", "k1abc@arrl.n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := email.ParseAddresses(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeobfuscate(t *testing.T) {
+	tests := []struct {
+		s           string
+		want        string
+		wantChanged bool
+	}{
+		{"k1abc@arrl.net", "k1abc@arrl.net", false},
+		{" k1abc@arrl.net ", "k1abc@arrl.net", false},
+		{"k1abc at arrl dot net", "k1abc@arrl.net", true},
+		{"k1abc AT arrl DOT net", "k1abc@arrl.net", true},
+		{"k1abc [at] arrl [dot] net", "k1abc@arrl.net", true},
+		{"k1abc(at)arrl(dot)net", "k1abc@arrl.net", true},
+		{"k1abc {at} mail {dot} arrl {dot} net", "k1abc@mail.arrl.net", true},
+		{"k1abc <at> arrl <dot> net", "k1abc@arrl.net", true},
+		{"pat@boat.net", "pat@boat.net", false},
+		{"dotty.cat@example.com", "dotty.cat@example.com", false},
+		{`"Dot Smith" <dot@example.com>`, `"Dot Smith" <dot@example.com>`, false},
+		{"Pat At Home <pat@home.net>", "Pat At Home <pat@home.net>", false},
+		{"Pat At Home <k1abc at arrl dot net>", "Pat At Home <k1abc@arrl.net>", true},
+		{"Dot Smith <dot@example.com>; k1abc at arrl dot net", "Dot Smith <dot@example.com>, k1abc@arrl.net", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, changed := email.Deobfuscate(tt.s)
+			if got != tt.want || changed != tt.wantChanged {
+				t.Errorf("Deobfuscate() = %q, %v, want %q, %v", got, changed, tt.want, tt.wantChanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// largest single attachment, Graph upload sessions allow up to 150 MB but most mail systems won't accept that
+	MaxAttachmentSize = 25 * 1024 * 1024
+
+	// attachments larger than this, or that push the request over it, go through a Graph upload session
+	inlineAttachmentLimit = 3 * 1024 * 1024
+)
+
+// file types Outlook and most mail systems block
+var blockedExtensions = map[string]bool{
+	".bat": true, ".cmd": true, ".com": true, ".cpl": true, ".dll": true, ".exe": true,
+	".hta": true, ".js": true, ".jse": true, ".lnk": true, ".msi": true, ".ps1": true,
+	".reg": true, ".scr": true, ".vb": true, ".vbe": true, ".vbs": true, ".wsf": true,
+}
+
+// Attachment is a file sent with a message
+type Attachment struct {
+	Name        string // file name shown to the recipient
+	ContentType string
+	Data        []byte
+	Path        string // file it was loaded from, to load it again once Data has been dropped
+}
+
+// LoadAttachment reads file fname and works out its content type
+func LoadAttachment(fname string) (Attachment, error) {
+	// #nosec G304
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		log.Printf("%+v", err)
+		return Attachment{}, err
+	}
+
+	name := filepath.Base(fname)
+	contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	a := Attachment{
+		Name:        name,
+		ContentType: contentType,
+		Data:        data,
+		Path:        fname,
+	}
+
+	err = a.Validate()
+	if err != nil {
+		log.Printf("%+v", err)
+		return Attachment{}, err
+	}
+
+	return a, nil
+}
+
+// Validate checks the attachment size and that the content is what its name and content type say it is
+func (a *Attachment) Validate() error {
+	if a.Name == "" {
+		return errors.New("attachment has no name")
+	}
+	if len(a.Data) == 0 {
+		return fmt.Errorf("attachment %s is empty", a.Name)
+	}
+	if len(a.Data) > MaxAttachmentSize {
+		return fmt.Errorf("attachment %s is %d bytes, the limit is %d", a.Name, len(a.Data), MaxAttachmentSize)
+	}
+
+	if blockedExtensions[strings.ToLower(filepath.Ext(a.Name))] {
+		return fmt.Errorf("attachment %s is a blocked file type", a.Name)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		return fmt.Errorf("attachment %s has invalid content type %q: %w", a.Name, a.ContentType, err)
+	}
+
+	// sniffing only recognizes some types, office documents look like zips, only compare when it's specific
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(a.Data))
+	switch {
+	case sniffed == "application/octet-stream", sniffed == "application/zip", strings.HasPrefix(sniffed, "text/"):
+	case sniffed == mediaType:
+	case strings.HasPrefix(sniffed, "image/"), sniffed == "application/pdf",
+		strings.HasPrefix(mediaType, "image/"), mediaType == "application/pdf":
+		return fmt.Errorf("attachment %s content is %s, not %s", a.Name, sniffed, mediaType)
+	}
+
+	return nil
+}
+
+// ReloadAttachments reads again the attachments of msg whose data has been dropped
+func (msg *Message) ReloadAttachments() error {
+	attachments := make([]Attachment, len(msg.Attachments))
+	for i, a := range msg.Attachments {
+		if len(a.Data) > 0 || a.Path == "" {
+			attachments[i] = a
+			continue
+		}
+
+		var err error
+		attachments[i], err = LoadAttachment(a.Path)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+	msg.Attachments = attachments
+
+	return nil
+}
+
+// validateAttachments checks all the attachments of msg
+func (msg *Message) validateAttachments() error {
+	for i := range msg.Attachments {
+		err := msg.Attachments[i].Validate()
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,293 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// most requests Graph accepts in one $batch
+	MaxBatchSize = 20
+
+	// wait before retrying throttled messages when Graph doesn't say how long
+	defaultBatchRetryAfter = 10 * time.Second
+
+	// Exchange Online accepts 30 messages a minute from a mailbox, batches are paced to stay under that
+	batchMessageInterval = 2 * time.Second
+	batchLimit           = "Exchange Online limit of 30 messages a minute"
+)
+
+// BatchSender is implemented by the email backends that can send many messages in a few requests
+type BatchSender interface {
+	// SendBatch sends msgs, returning the outcome of each, nil for the ones sent
+	SendBatch(msgs []*Message) []error
+}
+
+// SendAllowed sends the msgs check allows through sender, by its batch sending if it has it, and
+// returns the outcome of each, the error from check for the ones it refused
+func SendAllowed(sender Sender, msgs []*Message, check func(i int, msg *Message) error) []error {
+	errs := make([]error, len(msgs))
+
+	var allowed []*Message
+	var indexes []int
+	for i, msg := range msgs {
+		err := check(i, msg)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		allowed = append(allowed, msg)
+		indexes = append(indexes, i)
+	}
+	if len(allowed) == 0 {
+		return errs
+	}
+
+	if bs, ok := sender.(BatchSender); ok {
+		for i, err := range bs.SendBatch(allowed) {
+			errs[indexes[i]] = err
+		}
+		return errs
+	}
+
+	for i, msg := range allowed {
+		errs[indexes[i]] = sender.Send(msg)
+	}
+
+	return errs
+}
+
+type batchRequestItem struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"` // relative to the API version
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type batchRequest struct {
+	Requests []batchRequestItem `json:"requests"`
+}
+
+type batchResponseItem struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+type batchResponse struct {
+	Responses []batchResponseItem `json:"responses"`
+}
+
+// SendBatch sends msgs with sendMail requests in one Graph $batch request, of up to MaxBatchSize.
+// Batches are paced to stay under the mailbox send limit, messages that would go over it get a
+// RateLimitError and throttled ones a GraphError with RetryAfter, for the caller to send again later.
+// Messages with attachments too large to go inline are sent one at a time, paced the same way.
+func (client *GraphClient) SendBatch(msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+
+	var batchable, large []int
+	requests := make(map[int]batchRequestItem)
+	for i, msg := range msgs {
+		err := msg.validateAttachments()
+		if err != nil {
+			log.Printf("%+v", err)
+			errs[i] = err
+			continue
+		}
+
+		err = msg.ValidateDeliverAt(time.Now())
+		if err != nil {
+			log.Printf("%+v", err)
+			errs[i] = err
+			continue
+		}
+
+		_, err = msg.AssignMessageID()
+		if err != nil {
+			log.Printf("%+v", err)
+			errs[i] = err
+			continue
+		}
+
+		gmsg, uploads := newMessage(msg)
+		if len(uploads) > 0 {
+			large = append(large, i)
+			continue
+		}
+
+		body, err := json.Marshal(newSendMail(msg, gmsg))
+		if err != nil {
+			log.Printf("%+v", err)
+			errs[i] = err
+			continue
+		}
+
+		requests[i] = batchRequestItem{
+			ID:      strconv.Itoa(i),
+			Method:  "POST",
+			URL:     strings.TrimPrefix(client.userURL(msg.From), client.baseURL) + "/sendMail",
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    body,
+		}
+		batchable = append(batchable, i)
+	}
+
+	if len(batchable) > 0 {
+		// one batch at a time, paced by the messages sent, not the requests made
+		n := min(len(batchable), MaxBatchSize)
+		next, ok := client.reserveBatch(n, time.Now())
+		if !ok {
+			n = 0
+		}
+		if n > 0 {
+			wait := client.sendChunk(batchable[:n], requests, errs)
+			if wait > 0 {
+				// throttled, so nothing else goes until Graph says
+				next = client.holdBatches(time.Now().Add(wait))
+			}
+		}
+
+		// the rest wait for the next batch
+		for _, i := range batchable[n:] {
+			errs[i] = &RateLimitError{Limit: batchLimit, NextAllowed: next}
+		}
+	}
+
+	// the ones that need upload sessions go on their own, paced like a batch of one
+	for _, i := range large {
+		errs[i] = client.sendPaced(msgs[i])
+	}
+
+	return errs
+}
+
+// sendPaced sends msg on its own if the batch pacing allows it, otherwise returns a RateLimitError
+func (client *GraphClient) sendPaced(msg *Message) error {
+	next, ok := client.reserveBatch(1, time.Now())
+	if !ok {
+		return &RateLimitError{Limit: batchLimit, NextAllowed: next}
+	}
+
+	err := client.Send(msg)
+	var ge *GraphError
+	if errors.As(err, &ge) && ge.IsThrottled() {
+		// nothing else goes until Graph says
+		client.holdBatches(time.Now().Add(max(ge.RetryAfter, defaultBatchRetryAfter)))
+	}
+
+	return err
+}
+
+// reserveBatch takes the batch slot for n messages at now and returns when the next batch can be sent,
+// false if it isn't time for another batch yet
+func (client *GraphClient) reserveBatch(n int, now time.Time) (time.Time, bool) {
+	client.bm.Lock()
+	defer client.bm.Unlock()
+
+	if client.nextBatch.After(now) {
+		return client.nextBatch, false
+	}
+	client.nextBatch = now.Add(time.Duration(n) * batchMessageInterval)
+
+	return client.nextBatch, true
+}
+
+// holdBatches stops the next batch going before until, returns when it can go
+func (client *GraphClient) holdBatches(until time.Time) time.Time {
+	client.bm.Lock()
+	defer client.bm.Unlock()
+
+	if until.After(client.nextBatch) {
+		client.nextBatch = until
+	}
+
+	return client.nextBatch
+}
+
+// sendChunk sends the requests for the messages at indexes in one batch and records the outcome of each in errs,
+// throttled messages get a GraphError with RetryAfter set, returns the longest of those
+func (client *GraphClient) sendChunk(indexes []int, requests map[int]batchRequestItem, errs []error) time.Duration {
+	var br batchRequest
+	for _, i := range indexes {
+		br.Requests = append(br.Requests, requests[i])
+	}
+
+	responses, err := client.postBatch(br)
+	if err != nil {
+		log.Printf("%+v", err)
+		for _, i := range indexes {
+			errs[i] = err
+		}
+
+		var ge *GraphError
+		if errors.As(err, &ge) && ge.IsThrottled() {
+			return max(ge.RetryAfter, defaultBatchRetryAfter)
+		}
+		return 0
+	}
+
+	wait := time.Duration(0)
+	for _, i := range indexes {
+		r, ok := responses[requests[i].ID]
+		if !ok {
+			errs[i] = &GraphError{StatusCode: http.StatusInternalServerError, Message: "no response for the message in the batch"}
+			continue
+		}
+		if r.Status >= 200 && r.Status <= 299 {
+			errs[i] = nil
+			continue
+		}
+
+		header := make(http.Header)
+		for k, v := range r.Headers {
+			header.Set(k, v)
+		}
+		ge := graphErrorFrom(r.Status, header, r.Body)
+		ge.Delegated = client.delegated
+		if ge.IsThrottled() {
+			if ge.RetryAfter == 0 {
+				ge.RetryAfter = defaultBatchRetryAfter
+			}
+			wait = max(wait, ge.RetryAfter)
+		}
+		errs[i] = ge
+	}
+
+	return wait
+}
+
+// postBatch makes the $batch request and returns the responses by request ID
+func (client *GraphClient) postBatch(br batchRequest) (map[string]batchResponseItem, error) {
+	b, err := json.Marshal(br)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	data, err := client.makeRequest("POST", client.baseURL+"/$batch", b)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	var r batchResponse
+	err = json.Unmarshal(data, &r)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	responses := make(map[string]batchResponseItem, len(r.Responses))
+	for _, item := range r.Responses {
+		responses[item.ID] = item
+	}
+
+	return responses, nil
+}
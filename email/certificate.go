@@ -0,0 +1,104 @@
+package email
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// warn about certificates expiring this soon
+const certificateExpiryWarning = 30 * 24 * time.Hour
+
+// LoadCertificate reads the certificate chain and private key for an app registration from a
+// PEM file, or a PFX (PKCS #12) file if the name ends in .pfx or .p12, and checks the certificate is valid now
+func LoadCertificate(fname, password string) ([]*x509.Certificate, crypto.PrivateKey, error) {
+	// #nosec G304
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, nil, err
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.PrivateKey
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".pfx", ".p12":
+		// Windows and OpenSSL 3 exports include the chain and use AES and PBKDF2
+		var cert *x509.Certificate
+		var chain []*x509.Certificate
+		key, cert, chain, err = pkcs12.DecodeChain(data, password)
+		if err != nil {
+			err = fmt.Errorf("reading certificate %s: %w", fname, err)
+			log.Printf("%+v", err)
+			return nil, nil, err
+		}
+		certs = append([]*x509.Certificate{cert}, chain...)
+	default:
+		certs, key, err = confidential.CertFromPEM(data, password)
+		if err != nil {
+			err = fmt.Errorf("reading certificate %s: %w", fname, err)
+			log.Printf("%+v", err)
+			return nil, nil, err
+		}
+	}
+	if len(certs) == 0 || key == nil {
+		err = fmt.Errorf("certificate %s must have a certificate and its private key", fname)
+		log.Printf("%+v", err)
+		return nil, nil, err
+	}
+
+	err = checkValidity(certs[0], time.Now())
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, nil, err
+	}
+
+	return certs, key, nil
+}
+
+// checkValidity returns an error if cert isn't valid at now
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	switch {
+	case now.Before(cert.NotBefore):
+		return fmt.Errorf("certificate %q is not valid until %s", cert.Subject.CommonName, cert.NotBefore.Local().Format(time.RFC1123))
+	case now.After(cert.NotAfter):
+		return fmt.Errorf("certificate %q expired %s, upload a new one to the app registration", cert.Subject.CommonName, cert.NotAfter.Local().Format(time.RFC1123))
+	case cert.NotAfter.Sub(now) < certificateExpiryWarning:
+		log.Printf("certificate %q expires %s", cert.Subject.CommonName, cert.NotAfter.Local().Format(time.RFC1123))
+	}
+
+	return nil
+}
+
+// Office365CertClient creates a new Microsoft Office365 client that authenticates with a certificate
+// instead of a client secret, certFile is a PEM or PFX file with the certificate and its private key
+func Office365CertClient(endpoints Endpoints, tenantID, clientID, certFile, password string) (*GraphClient, error) {
+	if certFile == "" {
+		err := errors.New("no certificate file")
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	certs, key, err := LoadCertificate(certFile, password)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	cred, err := confidential.NewCredFromCert(certs, key)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return newConfidentialGraphClient(endpoints, tenantID, clientID, cred)
+}
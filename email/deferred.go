@@ -0,0 +1,154 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PidTagDeferredSendTime, Exchange keeps the message in the Outbox folder until then
+const deferredSendTimeProperty = "SystemTime 0x3FEF"
+
+var errNoDeferredDelivery = &NoDeferredDeliveryError{}
+
+// NoDeferredDeliveryError is returned by the email backends that can't have the server deliver a message later
+type NoDeferredDeliveryError struct{}
+
+func (e *NoDeferredDeliveryError) Error() string {
+	return "the email backend can't defer delivery, only Graph can"
+}
+
+// Permanent is true, the backend won't learn to
+func (e *NoDeferredDeliveryError) Permanent() bool {
+	return true
+}
+
+// DeliverAtError is returned when the time a message was to be delivered has passed
+type DeliverAtError struct {
+	DeliverAt time.Time
+}
+
+func (e *DeliverAtError) Error() string {
+	return fmt.Sprintf("delivery time %s has passed", e.DeliverAt.Local().Format("Mon Jan 2 15:04"))
+}
+
+// Permanent is true, the time won't come again
+func (e *DeliverAtError) Permanent() bool {
+	return true
+}
+
+// ValidateDeliverAt returns a DeliverAtError if msg is to be delivered later but the time isn't after now
+func (msg *Message) ValidateDeliverAt(now time.Time) error {
+	if msg.DeliverAt.IsZero() || msg.DeliverAt.After(now) {
+		return nil
+	}
+	return &DeliverAtError{DeliverAt: msg.DeliverAt}
+}
+
+type singleValueExtendedPropertyType struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// ScheduledMessage is a message sent for deferred delivery that hasn't been delivered yet
+type ScheduledMessage struct {
+	ID        string // Graph message ID
+	MessageID string // Internet Message-ID
+	Subject   string
+	To        []string
+	DeliverAt time.Time
+}
+
+// Scheduler is implemented by the email backends that can have the server deliver a message later,
+// messages with DeliverAt set can only be sent through them
+type Scheduler interface {
+	// ScheduledMessages returns the messages waiting for delivery in the mailbox of userID, soonest first
+	ScheduledMessages(userID string) ([]ScheduledMessage, error)
+
+	// CancelScheduled deletes message id before it's delivered
+	CancelScheduled(userID, id string) error
+}
+
+type listScheduledResponse struct {
+	Value []struct {
+		ID                            string                            `json:"id"`
+		InternetMessageID             string                            `json:"internetMessageId"`
+		Subject                       string                            `json:"subject"`
+		ToRecipients                  []recipientType                   `json:"toRecipients"`
+		SingleValueExtendedProperties []singleValueExtendedPropertyType `json:"singleValueExtendedProperties"`
+	} `json:"value"`
+	NextLink string `json:"@odata.nextLink"`
+}
+
+// ScheduledMessages returns the messages with a deferred send time in the Outbox folder of userID, soonest first
+func (client *GraphClient) ScheduledMessages(userID string) ([]ScheduledMessage, error) {
+	q := url.Values{
+		"$select": []string{"id,internetMessageId,subject,toRecipients"},
+		"$expand": []string{fmt.Sprintf("singleValueExtendedProperties($filter=id eq %s)", odataString(deferredSendTimeProperty))},
+		"$top":    []string{"50"},
+	}
+	next := client.userURL(userID) + "/mailFolders/outbox/messages?" + q.Encode()
+
+	var messages []ScheduledMessage
+	for next != "" {
+		b, err := client.makeRequest("GET", next, nil)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		var r listScheduledResponse
+		err = json.Unmarshal(b, &r)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		for _, v := range r.Value {
+			m := ScheduledMessage{
+				ID:        v.ID,
+				MessageID: v.InternetMessageID,
+				Subject:   v.Subject,
+			}
+			for _, to := range v.ToRecipients {
+				m.To = append(m.To, to.EmailAddress.Address)
+			}
+			for _, p := range v.SingleValueExtendedProperties {
+				if strings.EqualFold(p.ID, deferredSendTimeProperty) {
+					m.DeliverAt, err = time.Parse(time.RFC3339, p.Value)
+					if err != nil {
+						log.Printf("%+v", err)
+					}
+				}
+			}
+			// only the ones goboro, or the user, deferred
+			if m.DeliverAt.IsZero() {
+				continue
+			}
+			messages = append(messages, m)
+		}
+
+		next = r.NextLink
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].DeliverAt.Before(messages[j].DeliverAt)
+	})
+
+	return messages, nil
+}
+
+// CancelScheduled deletes message id from the mailbox of userID, once delivered it's too late
+func (client *GraphClient) CancelScheduled(userID, id string) error {
+	_, err := client.makeRequest("DELETE", client.userURL(userID)+"/messages/"+url.PathEscape(id), nil)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bbathe/goboro/atomicfile"
+
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/cache"
+	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/public"
+)
+
+// how long to wait for the user to finish signing in with the device code
+const deviceCodeTimeout = 15 * time.Minute
+
+// ErrSignInRequired is returned by delegated clients when the user has to sign in again, see GraphClient.SignIn
+var ErrSignInRequired = errors.New("the Microsoft sign-in has expired, sign in again")
+
+// DeviceCodePrompt shows the user the device code sign-in instructions, message is the full
+// instructions from the authority, the code stays valid if it blocks until the user dismisses it
+type DeviceCodePrompt func(message, verificationURL, userCode string)
+
+// fileCache is a persistent MSAL token cache, the refresh token in it keeps the user signed in across restarts
+type fileCache struct {
+	fname string
+
+	// mutex for the file
+	m sync.Mutex
+}
+
+// Replace loads the cache from file
+func (fc *fileCache) Replace(ctx context.Context, c cache.Unmarshaler, hints cache.ReplaceHints) error {
+	fc.m.Lock()
+	defer fc.m.Unlock()
+
+	// #nosec G304
+	b, err := os.ReadFile(fc.fname)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return c.Unmarshal(b)
+}
+
+// Export writes the cache to file, readable only by the user
+func (fc *fileCache) Export(ctx context.Context, c cache.Marshaler, hints cache.ExportHints) error {
+	fc.m.Lock()
+	defer fc.m.Unlock()
+
+	b, err := c.Marshal()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = atomicfile.WriteFile(fc.fname, b, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// Office365DelegatedClient creates a Microsoft Graph client that sends as the signed-in user,
+// this works with personal outlook.com accounts and doesn't need a client secret or application permissions.
+// The user signs in with a device code the first time, see SignedIn, tokens are kept in file cacheFile after that.
+// tenantID is "common" for any account, "consumers" for personal accounts only, or the organization's tenant.
+func Office365DelegatedClient(endpoints Endpoints, tenantID, clientID, cacheFile string, prompt DeviceCodePrompt) (*GraphClient, error) {
+	endpoints = endpoints.withDefaults()
+
+	authority, err := endpoints.authority(tenantID)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	options := []public.Option{
+		public.WithAuthority(authority),
+		public.WithCache(&fileCache{fname: cacheFile}),
+		public.WithInstanceDiscovery(endpoints.instanceDiscovery()),
+	}
+	if endpoints.HTTPClient != nil {
+		options = append(options, public.WithHTTPClient(endpoints.HTTPClient))
+	}
+
+	publicClient, err := public.New(clientID, options...)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	scopes := endpoints.delegatedScopes()
+	client := &GraphClient{
+		httpClient: endpoints.httpClient(),
+		baseURL:    endpoints.baseURL(),
+		acquireToken: func(refresh bool) (string, time.Time, error) {
+			result, err := acquireSilentToken(publicClient, scopes, refresh)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return result.AccessToken, result.ExpiresOn, nil
+		},
+		signIn: func() (string, time.Time, error) {
+			result, err := deviceCodeSignIn(publicClient, scopes, prompt)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return result.AccessToken, result.ExpiresOn, nil
+		},
+		hasAccount: func() bool {
+			accounts, err := publicClient.Accounts(context.TODO())
+			if err != nil {
+				log.Printf("%+v", err)
+				return false
+			}
+			return len(accounts) > 0
+		},
+		delegated: true,
+	}
+
+	return client, nil
+}
+
+// SignedIn reports whether the user has signed in before, so the cached account is used without signing in,
+// app-only clients are always signed in. The first time the caller should ask the user to SignIn,
+// that blocks until they're done so it's not done here.
+func (client *GraphClient) SignedIn() bool {
+	if client.hasAccount == nil {
+		return true
+	}
+	return client.hasAccount()
+}
+
+// SignIn signs the user in with a device code, the first time or after ErrSignInRequired. It blocks until the user
+// has signed in or the code expires, other calls carry on and fail with ErrSignInRequired meanwhile.
+func (client *GraphClient) SignIn() error {
+	if client.signIn == nil {
+		return errors.New("only delegated clients sign in")
+	}
+
+	accessToken, expiresOn, err := client.signIn()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	client.accessToken = accessToken
+	client.expiresOn = expiresOn
+	client.signInRequired = false
+
+	return nil
+}
+
+// OnSignInRequired sets the function called, from whichever goroutine made the call, when the user
+// has to sign in again, so they can be asked to. It isn't called again until SignIn succeeds.
+func (client *GraphClient) OnSignInRequired(f func()) {
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	client.onSignInRequired = f
+}
+
+// acquireSilentToken gets a token for the signed-in account from the cache, using the refresh token if needed,
+// returns ErrSignInRequired when there is no account or it has to sign in again
+func acquireSilentToken(publicClient public.Client, scopes []string, refresh bool) (public.AuthResult, error) {
+	ctx := context.TODO()
+
+	accounts, err := publicClient.Accounts(ctx)
+	if err != nil {
+		log.Printf("%+v", err)
+		return public.AuthResult{}, err
+	}
+	if len(accounts) == 0 {
+		return public.AuthResult{}, ErrSignInRequired
+	}
+
+	opts := []public.AcquireSilentOption{public.WithSilentAccount(accounts[0])}
+	if refresh {
+		// any claims make MSAL skip the cached access token and use the refresh token
+		opts = append(opts, public.WithClaims("{}"))
+	}
+
+	result, err := publicClient.AcquireTokenSilent(ctx, scopes, opts...)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrSignInRequired, err)
+		log.Printf("%+v", err)
+		return public.AuthResult{}, err
+	}
+
+	return result, nil
+}
+
+// deviceCodeSignIn signs the user in with a device code shown by prompt, waiting up to deviceCodeTimeout
+func deviceCodeSignIn(publicClient public.Client, scopes []string, prompt DeviceCodePrompt) (public.AuthResult, error) {
+	ctx := context.TODO()
+
+	dc, err := publicClient.AcquireTokenByDeviceCode(ctx, scopes)
+	if err != nil {
+		log.Printf("%+v", err)
+		return public.AuthResult{}, err
+	}
+	prompt(dc.Result.Message, dc.Result.VerificationURL, dc.Result.UserCode)
+
+	ctx, cancel := context.WithTimeout(ctx, deviceCodeTimeout)
+	defer cancel()
+
+	result, err := dc.AuthenticationResult(ctx)
+	if err != nil {
+		log.Printf("%+v", err)
+		return public.AuthResult{}, err
+	}
+
+	return result, nil
+}
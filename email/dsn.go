@@ -0,0 +1,191 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+var errNotDSN = errors.New("message is not a delivery status notification")
+
+// RecipientStatus is the outcome of delivery to one recipient in a delivery status notification
+type RecipientStatus struct {
+	Address    string // the final recipient
+	Action     string // failed, delayed, delivered, relayed or expanded
+	Status     string // enhanced status code, like 5.1.1
+	Diagnostic string // what the remote server said
+}
+
+// Failed is true when delivery to the recipient has been given up on
+func (rs *RecipientStatus) Failed() bool {
+	return strings.EqualFold(rs.Action, "failed")
+}
+
+// DeliveryReport is a delivery status notification (RFC 3464), usually a bounce
+type DeliveryReport struct {
+	ID                string // Graph message ID of the report
+	Received          time.Time
+	OriginalMessageID string // Message-ID of the message the report is about, when included
+	OriginalSubject   string
+	Recipients        []RecipientStatus
+}
+
+// Failures returns the recipients delivery failed for
+func (dr *DeliveryReport) Failures() []RecipientStatus {
+	var failed []RecipientStatus
+	for _, rs := range dr.Recipients {
+		if rs.Failed() {
+			failed = append(failed, rs)
+		}
+	}
+	return failed
+}
+
+// ParseDSN parses the raw MIME of a delivery status notification
+func ParseDSN(raw []byte) (*DeliveryReport, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	dr := &DeliveryReport{}
+	if d, err := m.Header.Date(); err == nil {
+		dr.Received = d
+	}
+
+	found, err := dr.walk(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if !found {
+		return nil, errNotDSN
+	}
+
+	return dr, nil
+}
+
+// walk looks through a MIME entity for the delivery status and the original message headers,
+// returns true if the delivery status was found
+func (dr *DeliveryReport) walk(contentType, encoding string, body io.Reader) (bool, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// not worth failing the whole report over
+		return false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		found := false
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("%+v", err)
+				return found, err
+			}
+
+			f, err := dr.walk(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+			if err != nil {
+				log.Printf("%+v", err)
+				return found, err
+			}
+			found = found || f
+		}
+		return found, nil
+
+	case mediaType == "message/delivery-status", mediaType == "message/global-delivery-status":
+		err = dr.parseStatus(decodeBody(encoding, body))
+		if err != nil {
+			log.Printf("%+v", err)
+			return false, err
+		}
+		return true, nil
+
+	case mediaType == "message/rfc822", mediaType == "text/rfc822-headers", mediaType == "message/global-headers":
+		// only the headers are needed, and some servers only return those
+		tr := textproto.NewReader(bufio.NewReader(decodeBody(encoding, body)))
+		h, _ := tr.ReadMIMEHeader()
+		dr.OriginalMessageID = strings.Trim(h.Get("Message-Id"), "<> ")
+		dr.OriginalSubject, _ = new(mime.WordDecoder).DecodeHeader(h.Get("Subject"))
+		return false, nil
+	}
+
+	return false, nil
+}
+
+// parseStatus reads the per-message fields and then a group of fields for each recipient
+func (dr *DeliveryReport) parseStatus(r io.Reader) error {
+	tr := textproto.NewReader(bufio.NewReader(r))
+
+	// per-message fields, nothing needed from them
+	_, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	for err == nil {
+		var h textproto.MIMEHeader
+		h, err = tr.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			log.Printf("%+v", err)
+			return err
+		}
+
+		address := typedAddress(h.Get("Final-Recipient"))
+		if address == "" {
+			address = typedAddress(h.Get("Original-Recipient"))
+		}
+		if address == "" {
+			continue
+		}
+
+		dr.Recipients = append(dr.Recipients, RecipientStatus{
+			Address:    address,
+			Action:     strings.ToLower(strings.TrimSpace(h.Get("Action"))),
+			Status:     strings.TrimSpace(h.Get("Status")),
+			Diagnostic: typedValue(h.Get("Diagnostic-Code")),
+		})
+	}
+
+	return nil
+}
+
+// typedValue strips the type from a DSN field like "smtp; 550 5.1.1 user unknown"
+func typedValue(s string) string {
+	if _, v, ok := strings.Cut(s, ";"); ok {
+		return strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(s)
+}
+
+// typedAddress returns the address from a DSN field like "rfc822; k1abc@example.com"
+func typedAddress(s string) string {
+	return strings.ToLower(strings.Trim(typedValue(s), "<> "))
+}
+
+// decodeBody undoes the content transfer encoding of a MIME part
+func decodeBody(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
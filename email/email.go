@@ -0,0 +1,139 @@
+package email
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// message importance
+const (
+	ImportanceLow    = "low"
+	ImportanceNormal = "normal"
+	ImportanceHigh   = "high"
+)
+
+// Message is an outgoing email
+type Message struct {
+	From     string   // sending mailbox, Graph user ID or UPN, SMTP sender address
+	SendAs   string   // optional address of a shared mailbox the message is from
+	OnBehalf bool     // message is sent on behalf of the SendAs mailbox, From is shown as the sender
+	To       []string // recipient addresses
+	Cc       []string
+	Bcc      []string
+	ReplyTo  []string
+	Subject  string
+	Body     string
+	HTML     bool // Body is HTML rather than plain text
+
+	Attachments []Attachment
+
+	// tracking, so a sent message can be linked back to our records
+	MessageID     string   // Internet Message-ID, see AssignMessageID
+	Callsign      string   // sent in the X-Goboro-Callsign header
+	NoticeID      string   // sent in the X-Goboro-Notice-ID header
+	Categories    []string // Outlook categories, like "QSL Bureau"
+	SkipSentItems bool     // don't keep a copy in Sent Items, only for Graph sendMail
+
+	// for messages that need to stand out
+	Importance      string            // low, normal or high, empty for normal
+	ReadReceipt     bool              // ask the recipient's mail program to say when it's read
+	DeliveryReceipt bool              // ask for a notification when it's delivered
+	Headers         map[string]string // custom X- headers, like for Outlook rules
+
+	// delivered by the server at this time rather than right away, only backends that are a Scheduler
+	DeliverAt time.Time
+}
+
+// header is a message header, in the order they are written
+type header struct {
+	name  string
+	value string
+}
+
+// AssignMessageID gives msg an Internet Message-ID if it doesn't have one and returns it,
+// it's the identifier to find the sent message and replies to it by. Send calls it too.
+func (msg *Message) AssignMessageID() (string, error) {
+	if msg.MessageID != "" {
+		return msg.MessageID, nil
+	}
+
+	id, err := messageID(msg.From)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+	msg.MessageID = id
+
+	return id, nil
+}
+
+// trackingHeaders are the custom headers that identify the message
+func (msg *Message) trackingHeaders() []header {
+	var headers []header
+	if msg.Callsign != "" {
+		headers = append(headers, header{"X-Goboro-Callsign", msg.Callsign})
+	}
+	if msg.NoticeID != "" {
+		headers = append(headers, header{"X-Goboro-Notice-ID", msg.NoticeID})
+	}
+	return headers
+}
+
+// headers are the custom headers sent with the message, the tracking ones first, then Headers by name
+func (msg *Message) headers() []header {
+	headers := msg.trackingHeaders()
+
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers = append(headers, header{name, msg.Headers[name]})
+	}
+
+	return headers
+}
+
+// replyAddress is where read receipts go, the address the message is from
+func (msg *Message) replyAddress() string {
+	if msg.SendAs != "" {
+		return msg.SendAs
+	}
+	return msg.From
+}
+
+// Sender is implemented by each of the email backends
+type Sender interface {
+	// Send delivers msg to its recipients
+	Send(msg *Message) error
+}
+
+// Draft is a message saved in the Drafts folder instead of being sent
+type Draft struct {
+	ID             string `json:"id"`             // Graph message ID
+	ConversationID string `json:"conversationId"` // replies will be in the same conversation
+	WebLink        string `json:"webLink"`        // opens the draft in Outlook on the web
+}
+
+// ErrNoDrafts is returned when saving a draft through an email backend that can't save them
+var ErrNoDrafts = errors.New("the email backend can't save drafts")
+
+// Drafter is implemented by the email backends that can save messages as drafts
+type Drafter interface {
+	// SaveDraft creates msg in the Drafts folder of the msg.From mailbox
+	SaveDraft(msg *Message) (*Draft, error)
+
+	// SendDraft sends a draft previously saved in the Drafts folder of userID
+	SendDraft(userID, id string) error
+}
+
+// recipients returns all the addresses the message is delivered to
+func (msg *Message) recipients() []string {
+	var r []string
+	r = append(r, msg.To...)
+	r = append(r, msg.Cc...)
+	return append(r, msg.Bcc...)
+}
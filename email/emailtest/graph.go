@@ -0,0 +1,698 @@
+package emailtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+)
+
+// GraphMessage is a message sent through GraphServer
+type GraphMessage struct {
+	ID          string
+	UserID      string // mailbox it was sent from, "me" for delegated sign-in
+	Subject     string
+	ContentType string // text or html
+	Body        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Attachments []string  // attachment names, inline ones then uploaded ones
+	DeliverAt   time.Time // deferred delivery time, zero to deliver right away
+
+	MessageID       string            // internetMessageId
+	Headers         map[string]string // internetMessageHeaders
+	Categories      []string
+	SaveToSentItems bool
+	Importance      string
+	ReadReceipt     bool
+	DeliveryReceipt bool
+
+	Raw json.RawMessage
+}
+
+type graphRecipient struct {
+	EmailAddress struct {
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+type graphMessage struct {
+	Subject string `json:"subject"`
+	Body    struct {
+		ContentType string `json:"contentType"`
+		Content     string `json:"content"`
+	} `json:"body"`
+	ToRecipients  []graphRecipient `json:"toRecipients"`
+	CcRecipients  []graphRecipient `json:"ccRecipients"`
+	BccRecipients []graphRecipient `json:"bccRecipients"`
+	Attachments   []struct {
+		Name string `json:"name"`
+	} `json:"attachments"`
+	InternetMessageID      string `json:"internetMessageId"`
+	InternetMessageHeaders []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"internetMessageHeaders"`
+	Categories                    []string                `json:"categories"`
+	Importance                    string                  `json:"importance"`
+	IsReadReceiptRequested        bool                    `json:"isReadReceiptRequested"`
+	IsDeliveryReceiptRequested    bool                    `json:"isDeliveryReceiptRequested"`
+	SingleValueExtendedProperties []graphExtendedProperty `json:"singleValueExtendedProperties"`
+}
+
+type graphSendMail struct {
+	Message         graphMessage `json:"message"`
+	SaveToSentItems *bool        `json:"saveToSentItems"`
+}
+
+type graphUploadSession struct {
+	AttachmentItem struct {
+		AttachmentType string `json:"attachmentType"`
+		Name           string `json:"name"`
+		Size           int    `json:"size"`
+	} `json:"AttachmentItem"`
+}
+
+type graphExtendedProperty struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// PidTagDeferredSendTime
+const deferredSendTime = "SystemTime 0x3FEF"
+
+// graphFailure is the error returned by the next sendMail
+type graphFailure struct {
+	status     int
+	code       string
+	retryAfter int
+}
+
+// upload is an attachment upload session, the attachment is added to the draft once all of it is received
+type upload struct {
+	draftID  string
+	name     string
+	size     int
+	received int
+}
+
+// GraphServer is a minimal stand-in for the Microsoft identity platform token endpoint and Graph sendMail and $batch,
+// it issues a token to any client and keeps every message sent with one of its tokens. Messages with a deferred
+// send time in the future are listed in the Outbox folder and can be deleted. Drafts can be created, given
+// attachments through upload sessions and sent.
+type GraphServer struct {
+	URL string // https://127.0.0.1:port, both the authority host and the Graph URL
+
+	server         *httptest.Server
+	mux            *http.ServeMux
+	tokens         map[string]bool
+	tokensIssued   int
+	messages       []GraphMessage
+	drafts         map[string]GraphMessage
+	uploads        map[string]*upload
+	failures       []graphFailure
+	uploadFailures []graphFailure
+
+	// mutex for everything above but URL, server and mux
+	m sync.Mutex
+}
+
+// NewGraphServer starts a new GraphServer on a random loopback port
+func NewGraphServer() *GraphServer {
+	s := &GraphServer{
+		tokens:  make(map[string]bool),
+		drafts:  make(map[string]GraphMessage),
+		uploads: make(map[string]*upload),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{tenant}/v2.0/.well-known/openid-configuration", s.openIDConfiguration)
+	mux.HandleFunc("POST /{tenant}/oauth2/v2.0/token", s.token)
+	mux.HandleFunc("POST /{version}/users/{user}/sendMail", s.sendMail)
+	mux.HandleFunc("POST /{version}/me/sendMail", s.sendMail)
+	mux.HandleFunc("POST /{version}/$batch", s.batch)
+	mux.HandleFunc("GET /{version}/users/{user}/mailFolders/outbox/messages", s.outbox)
+	mux.HandleFunc("GET /{version}/me/mailFolders/outbox/messages", s.outbox)
+	mux.HandleFunc("DELETE /{version}/users/{user}/messages/{id}", s.deleteMessage)
+	mux.HandleFunc("DELETE /{version}/me/messages/{id}", s.deleteMessage)
+	mux.HandleFunc("POST /{version}/users/{user}/messages", s.createDraft)
+	mux.HandleFunc("POST /{version}/me/messages", s.createDraft)
+	mux.HandleFunc("POST /{version}/users/{user}/messages/{id}/attachments/createUploadSession", s.createUploadSession)
+	mux.HandleFunc("POST /{version}/me/messages/{id}/attachments/createUploadSession", s.createUploadSession)
+	mux.HandleFunc("PUT /upload/{session}", s.uploadChunk)
+	mux.HandleFunc("POST /{version}/users/{user}/messages/{id}/send", s.sendDraft)
+	mux.HandleFunc("POST /{version}/me/messages/{id}/send", s.sendDraft)
+	s.mux = mux
+
+	// sign-in has to be https
+	s.server = httptest.NewTLSServer(mux)
+	s.URL = s.server.URL
+
+	return s
+}
+
+// Close stops the server
+func (s *GraphServer) Close() {
+	s.server.Close()
+}
+
+// Endpoints returns the endpoints to give the Graph client so it signs in and sends through the server
+func (s *GraphServer) Endpoints() email.Endpoints {
+	return email.Endpoints{
+		AuthorityHost: s.URL,
+		GraphURL:      s.URL,
+		GraphVersion:  email.DefaultGraphVersion,
+		HTTPClient:    s.server.Client(),
+	}
+}
+
+// Messages returns the messages sent so far
+func (s *GraphServer) Messages() []GraphMessage {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return append([]GraphMessage(nil), s.messages...)
+}
+
+// Fail makes the next sendMail return a Graph error with status and code, retryAfter is
+// the Retry-After seconds, for throttling
+func (s *GraphServer) Fail(status int, code string, retryAfter int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.failures = append(s.failures, graphFailure{status: status, code: code, retryAfter: retryAfter})
+}
+
+// FailUpload makes the next createUploadSession return a Graph error with status and code
+func (s *GraphServer) FailUpload(status int, code string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.uploadFailures = append(s.uploadFailures, graphFailure{status: status, code: code})
+}
+
+// Drafts returns the drafts that haven't been sent or deleted
+func (s *GraphServer) Drafts() []GraphMessage {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	drafts := make([]GraphMessage, 0, len(s.drafts))
+	for _, d := range s.drafts {
+		drafts = append(drafts, d)
+	}
+	return drafts
+}
+
+// ExpireTokens makes every token issued so far invalid, like they had expired
+func (s *GraphServer) ExpireTokens() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	clear(s.tokens)
+}
+
+// TokensIssued returns how many access tokens have been issued
+func (s *GraphServer) TokensIssued() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.tokensIssued
+}
+
+// openIDConfiguration is the tenant discovery document MSAL reads the token endpoint from
+func (s *GraphServer) openIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	writeJSON(w, http.StatusOK, map[string]string{
+		"authorization_endpoint": fmt.Sprintf("%s/%s/oauth2/v2.0/authorize", s.URL, tenant),
+		"token_endpoint":         fmt.Sprintf("%s/%s/oauth2/v2.0/token", s.URL, tenant),
+		"issuer":                 fmt.Sprintf("%s/%s/v2.0", s.URL, tenant),
+	})
+}
+
+// token issues an access token to any client
+func (s *GraphServer) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("client_id") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error":             "invalid_request",
+			"error_description": "client_id is required",
+		})
+		return
+	}
+
+	token := newID(16)
+
+	s.m.Lock()
+	s.tokens[token] = true
+	s.tokensIssued++
+	s.m.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"token_type":     "Bearer",
+		"expires_in":     3600,
+		"ext_expires_in": 3600,
+		"access_token":   token,
+	})
+}
+
+// authorized tests if the request has a token the server issued
+func (s *GraphServer) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return ok && s.tokens[token]
+}
+
+// userID is the mailbox in the request path, "me" for delegated sign-in
+func userID(r *http.Request) string {
+	if u := r.PathValue("user"); u != "" {
+		return u
+	}
+	return "me"
+}
+
+// sendMail accepts a message from a client with a token the server issued
+func (s *GraphServer) sendMail(w http.ResponseWriter, r *http.Request) {
+	ok := s.authorized(r)
+
+	s.m.Lock()
+	var failure *graphFailure
+	if ok && len(s.failures) > 0 {
+		failure = &s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	s.m.Unlock()
+
+	if !ok {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty or invalid.")
+		return
+	}
+	if failure != nil {
+		if failure.retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(failure.retryAfter))
+		}
+		writeGraphError(w, failure.status, failure.code, "Failure requested by the test.")
+		return
+	}
+
+	var raw json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&raw)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+	var sm graphSendMail
+	err = json.Unmarshal(raw, &sm)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+
+	msg, err := newGraphMessage(userID(r), sm.Message, raw)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidProperty", err.Error())
+		return
+	}
+	if len(msg.To) == 0 {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRecipients", "At least one recipient is not valid.")
+		return
+	}
+	// saved unless it says not to
+	msg.SaveToSentItems = sm.SaveToSentItems == nil || *sm.SaveToSentItems
+
+	s.m.Lock()
+	s.messages = append(s.messages, msg)
+	s.m.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// newGraphMessage converts a message in a request to what the server keeps
+func newGraphMessage(user string, gm graphMessage, raw json.RawMessage) (GraphMessage, error) {
+	msg := GraphMessage{
+		ID:              newID(8),
+		UserID:          user,
+		Subject:         gm.Subject,
+		ContentType:     strings.ToLower(gm.Body.ContentType),
+		Body:            gm.Body.Content,
+		To:              addresses(gm.ToRecipients),
+		Cc:              addresses(gm.CcRecipients),
+		Bcc:             addresses(gm.BccRecipients),
+		MessageID:       gm.InternetMessageID,
+		Categories:      gm.Categories,
+		Importance:      gm.Importance,
+		ReadReceipt:     gm.IsReadReceiptRequested,
+		DeliveryReceipt: gm.IsDeliveryReceiptRequested,
+		Raw:             raw,
+	}
+	for _, a := range gm.Attachments {
+		msg.Attachments = append(msg.Attachments, a.Name)
+	}
+	if len(gm.InternetMessageHeaders) > 0 {
+		msg.Headers = make(map[string]string)
+		for _, h := range gm.InternetMessageHeaders {
+			msg.Headers[h.Name] = h.Value
+		}
+	}
+	for _, p := range gm.SingleValueExtendedProperties {
+		if strings.EqualFold(p.ID, deferredSendTime) {
+			var err error
+			msg.DeliverAt, err = time.Parse(time.RFC3339, p.Value)
+			if err != nil {
+				return GraphMessage{}, err
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+// createDraft saves a message in the Drafts folder
+func (s *GraphServer) createDraft(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty or invalid.")
+		return
+	}
+
+	var raw json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&raw)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+	var gm graphMessage
+	err = json.Unmarshal(raw, &gm)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+
+	msg, err := newGraphMessage(userID(r), gm, raw)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidProperty", err.Error())
+		return
+	}
+	// messages sent from drafts are always saved
+	msg.SaveToSentItems = true
+
+	s.m.Lock()
+	s.drafts[msg.ID] = msg
+	s.m.Unlock()
+
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"id":             msg.ID,
+		"conversationId": newID(8),
+		"webLink":        s.URL + "/owa/?ItemID=" + msg.ID,
+	})
+}
+
+// createUploadSession starts the upload of an attachment to a draft
+func (s *GraphServer) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty or invalid.")
+		return
+	}
+
+	var us graphUploadSession
+	err := json.NewDecoder(r.Body).Decode(&us)
+	if err != nil || us.AttachmentItem.AttachmentType != "file" || us.AttachmentItem.Size <= 0 {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", "A file attachment with a size is required.")
+		return
+	}
+
+	id := r.PathValue("id")
+	session := newID(8)
+
+	s.m.Lock()
+	var failure *graphFailure
+	if len(s.uploadFailures) > 0 {
+		failure = &s.uploadFailures[0]
+		s.uploadFailures = s.uploadFailures[1:]
+	}
+	draft, ok := s.drafts[id]
+	if ok && draft.UserID == userID(r) && failure == nil {
+		s.uploads[session] = &upload{draftID: id, name: us.AttachmentItem.Name, size: us.AttachmentItem.Size}
+	}
+	s.m.Unlock()
+
+	if failure != nil {
+		writeGraphError(w, failure.status, failure.code, "Failure requested by the test.")
+		return
+	}
+	if !ok {
+		writeGraphError(w, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"uploadUrl": s.URL + "/upload/" + session,
+	})
+}
+
+// uploadChunk receives the next part of an attachment, the upload URL is pre-authorized so access tokens are refused
+func (s *GraphServer) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "" {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Upload URLs don't take an access token.")
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", err.Error())
+		return
+	}
+	var start, end, size int
+	_, err = fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "ErrorInvalidRequest", "Content-Range is required.")
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	u, ok := s.uploads[r.PathValue("session")]
+	if !ok {
+		writeGraphError(w, http.StatusNotFound, "ErrorItemNotFound", "The upload session was not found.")
+		return
+	}
+	if start != u.received || end-start+1 != len(data) || size != u.size || end >= size {
+		writeGraphError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range doesn't follow what has been uploaded.")
+		return
+	}
+	u.received += len(data)
+
+	if u.received < u.size {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"nextExpectedRanges": []string{fmt.Sprintf("%d-", u.received)},
+		})
+		return
+	}
+
+	// complete, the attachment is on the draft
+	draft := s.drafts[u.draftID]
+	draft.Attachments = append(draft.Attachments, u.name)
+	s.drafts[u.draftID] = draft
+	delete(s.uploads, r.PathValue("session"))
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// sendDraft sends a draft, uploads still going are lost
+func (s *GraphServer) sendDraft(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty or invalid.")
+		return
+	}
+
+	id := r.PathValue("id")
+
+	s.m.Lock()
+	draft, ok := s.drafts[id]
+	if ok && draft.UserID == userID(r) {
+		delete(s.drafts, id)
+		s.messages = append(s.messages, draft)
+	}
+	s.m.Unlock()
+
+	if !ok {
+		writeGraphError(w, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// outbox lists the messages of the user waiting for their deferred send time
+func (s *GraphServer) outbox(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty or invalid.")
+		return
+	}
+
+	now := time.Now()
+	user := userID(r)
+
+	s.m.Lock()
+	value := []map[string]any{}
+	for _, m := range s.messages {
+		if m.UserID != user || !m.DeliverAt.After(now) {
+			continue
+		}
+		var to []map[string]any
+		for _, a := range m.To {
+			to = append(to, map[string]any{"emailAddress": map[string]string{"address": a}})
+		}
+		value = append(value, map[string]any{
+			"id":                m.ID,
+			"internetMessageId": m.MessageID,
+			"subject":           m.Subject,
+			"toRecipients":      to,
+			"singleValueExtendedProperties": []graphExtendedProperty{
+				{ID: deferredSendTime, Value: m.DeliverAt.UTC().Format(time.RFC3339)},
+			},
+		})
+	}
+	s.m.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{"value": value})
+}
+
+// deleteMessage removes a draft, or a message not yet delivered
+func (s *GraphServer) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeGraphError(w, http.StatusUnauthorized, "InvalidAuthenticationToken", "Access token is empty or invalid.")
+		return
+	}
+
+	now := time.Now()
+	user := userID(r)
+	id := r.PathValue("id")
+
+	s.m.Lock()
+	found := false
+	if d, ok := s.drafts[id]; ok && d.UserID == user {
+		delete(s.drafts, id)
+		found = true
+	}
+	for i, m := range s.messages {
+		if m.UserID == user && m.ID == id && m.DeliverAt.After(now) {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			found = true
+			break
+		}
+	}
+	s.m.Unlock()
+
+	if !found {
+		writeGraphError(w, http.StatusNotFound, "ErrorItemNotFound", "The specified object was not found in the store.")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type graphBatch struct {
+	Requests []struct {
+		ID      string            `json:"id"`
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    json.RawMessage   `json:"body"`
+	} `json:"requests"`
+}
+
+type graphBatchResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// batch runs each request in a JSON batch as if it had been made on its own
+func (s *GraphServer) batch(w http.ResponseWriter, r *http.Request) {
+	var b graphBatch
+	err := json.NewDecoder(r.Body).Decode(&b)
+	if err != nil {
+		writeGraphError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	if len(b.Requests) > 20 {
+		writeGraphError(w, http.StatusBadRequest, "BadRequest", "Number of batch requests exceeds the limit of 20.")
+		return
+	}
+
+	var responses []graphBatchResponse
+	for _, br := range b.Requests {
+		req := httptest.NewRequest(br.Method, "/"+r.PathValue("version")+br.URL, bytes.NewReader(br.Body))
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
+		for k, v := range br.Headers {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, req)
+
+		response := graphBatchResponse{
+			ID:      br.ID,
+			Status:  rec.Code,
+			Headers: make(map[string]string),
+		}
+		for k := range rec.Header() {
+			response.Headers[k] = rec.Header().Get(k)
+		}
+		if rec.Body.Len() > 0 {
+			response.Body = rec.Body.Bytes()
+		}
+		responses = append(responses, response)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"responses": responses})
+}
+
+// newID returns n random bytes in hex
+func newID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func addresses(recipients []graphRecipient) []string {
+	var a []string
+	for _, r := range recipients {
+		a = append(a, r.EmailAddress.Address)
+	}
+	return a
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeGraphError writes an error in the format Graph uses
+func writeGraphError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+			"innerError": map[string]string{
+				"request-id": newID(16),
+				"date":       time.Now().UTC().Format("2006-01-02T15:04:05"),
+			},
+		},
+	})
+}
@@ -0,0 +1,331 @@
+// Package emailtest provides local stand-ins for the email services, so the email backends
+// can be exercised without sending anything to a real mailbox
+package emailtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"log"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTPMessage is a message received by SMTPServer
+type SMTPMessage struct {
+	Username string   // authenticated user, if any
+	From     string   // envelope sender
+	To       []string // envelope recipients
+	Notify   []string // DSN NOTIFY parameter for each recipient, empty if not given
+	Data     []byte   // message content
+	TLS      bool     // the session was encrypted, by STARTTLS or implicit TLS
+}
+
+// SMTPServer is a minimal SMTP server listening on the loopback interface that accepts
+// any credentials and keeps every message it receives. It has a self-signed certificate
+// for STARTTLS and implicit TLS, like httptest.Server.
+type SMTPServer struct {
+	Addr string // host:port the server is listening on
+
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	certificate *x509.Certificate
+	messages    []SMTPMessage
+
+	// mutex for messages
+	m sync.Mutex
+}
+
+// NewSMTPServer starts a new SMTPServer on a random loopback port, the connection is
+// plain and can be upgraded with STARTTLS
+func NewSMTPServer() (*SMTPServer, error) {
+	return newSMTPServer(false)
+}
+
+// NewTLSSMTPServer starts a new SMTPServer on a random loopback port that only accepts
+// implicit TLS connections, like port 465
+func NewTLSSMTPServer() (*SMTPServer, error) {
+	return newSMTPServer(true)
+}
+
+func newSMTPServer(implicitTLS bool) (*SMTPServer, error) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if implicitTLS {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	s := &SMTPServer{
+		Addr:        l.Addr().String(),
+		listener:    l,
+		tlsConfig:   tlsConfig,
+		certificate: cert.Leaf,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s, nil
+}
+
+// Certificate returns the certificate the server uses for TLS, for clients to trust
+func (s *SMTPServer) Certificate() *x509.Certificate {
+	return s.certificate
+}
+
+// RootCAs returns a pool with the server certificate in it
+func (s *SMTPServer) RootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.certificate)
+	return pool
+}
+
+// Close stops the server
+func (s *SMTPServer) Close() error {
+	return s.listener.Close()
+}
+
+// Messages returns the messages received so far
+func (s *SMTPServer) Messages() []SMTPMessage {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return append([]SMTPMessage(nil), s.messages...)
+}
+
+// serve handles one SMTP session
+func (s *SMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	_, secure := conn.(*tls.Conn)
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...any) bool {
+		return tp.PrintfLine(format, args...) == nil
+	}
+
+	var msg SMTPMessage
+	if !reply("220 localhost goboro emailtest ESMTP") {
+		return
+	}
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250-localhost")
+			reply("250-8BITMIME")
+			reply("250-DSN")
+			if !secure {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN LOGIN")
+
+		case "STARTTLS":
+			if secure {
+				reply("503 already using TLS")
+				continue
+			}
+			reply("220 ready to start TLS")
+
+			tc := tls.Server(conn, s.tlsConfig)
+			if tc.Handshake() != nil {
+				return
+			}
+			// the session starts over, RFC 3207
+			conn = tc
+			secure = true
+			tp = textproto.NewConn(tc)
+			msg = SMTPMessage{}
+
+		case "AUTH":
+			msg.Username = s.auth(tp, arg)
+			if msg.Username == "" {
+				reply("535 authentication failed")
+				continue
+			}
+			reply("235 authenticated")
+
+		case "MAIL":
+			msg.From = envelopeAddress(arg)
+			msg.To = nil
+			msg.Notify = nil
+			reply("250 OK")
+
+		case "RCPT":
+			msg.To = append(msg.To, envelopeAddress(arg))
+			msg.Notify = append(msg.Notify, envelopeParameter(arg, "NOTIFY"))
+			reply("250 OK")
+
+		case "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = data
+			msg.TLS = secure
+
+			s.m.Lock()
+			s.messages = append(s.messages, msg)
+			s.m.Unlock()
+
+			reply("250 OK queued")
+
+		case "RSET", "NOOP":
+			reply("250 OK")
+
+		case "QUIT":
+			reply("221 bye")
+			return
+
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// auth runs the PLAIN or LOGIN exchange and returns the username
+func (s *SMTPServer) auth(tp *textproto.Conn, arg string) string {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+
+	readResponse := func(prompt string) string {
+		if tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt))) != nil {
+			return ""
+		}
+		line, err := tp.ReadLine()
+		if err != nil {
+			return ""
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		var response string
+		if initial != "" {
+			b, err := base64.StdEncoding.DecodeString(initial)
+			if err != nil {
+				return ""
+			}
+			response = string(b)
+		} else {
+			response = readResponse("")
+		}
+
+		// authzid NUL authcid NUL passwd
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 {
+			return ""
+		}
+		return parts[1]
+
+	case "LOGIN":
+		username := readResponse("Username:")
+		readResponse("Password:")
+		return username
+	}
+
+	return ""
+}
+
+// envelopeParameter returns the value of parameter name in MAIL FROM or RCPT TO, like NOTIFY=SUCCESS
+func envelopeParameter(arg, name string) string {
+	for _, p := range strings.Fields(arg) {
+		if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// envelopeAddress extracts the address from MAIL FROM:<a@b> and RCPT TO:<a@b>
+func envelopeAddress(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+	return strings.Trim(addr, "<>")
+}
+
+// selfSignedCertificate creates a certificate for the loopback addresses, valid for a day
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Printf("%+v", err)
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Printf("%+v", err)
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"goboro emailtest"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		log.Printf("%+v", err)
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Printf("%+v", err)
+		return tls.Certificate{}, err
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Microsoft global cloud
+	DefaultAuthorityHost = "https://login.microsoftonline.com"
+	DefaultGraphURL      = "https://graph.microsoft.com"
+	DefaultGraphVersion  = "v1.0"
+)
+
+// Endpoints are where the Microsoft identity platform and Graph are, the zero value is the global cloud.
+// National clouds have their own, like https://login.microsoftonline.us and https://graph.microsoft.us for GCC High.
+type Endpoints struct {
+	AuthorityHost string
+	GraphURL      string
+	GraphVersion  string // v1.0 or beta
+
+	// used for both sign-in and Graph when set, so local stand-ins with their own certificates can be trusted
+	HTTPClient *http.Client
+}
+
+// withDefaults fills in the global cloud for anything not set
+func (e Endpoints) withDefaults() Endpoints {
+	if e.AuthorityHost == "" {
+		e.AuthorityHost = DefaultAuthorityHost
+	}
+	if e.GraphURL == "" {
+		e.GraphURL = DefaultGraphURL
+	}
+	if e.GraphVersion == "" {
+		e.GraphVersion = DefaultGraphVersion
+	}
+	e.AuthorityHost = strings.TrimSuffix(e.AuthorityHost, "/")
+	e.GraphURL = strings.TrimSuffix(e.GraphURL, "/")
+
+	return e
+}
+
+// authority is the sign-in authority for tenantID
+func (e Endpoints) authority(tenantID string) (string, error) {
+	authority, err := url.JoinPath(e.AuthorityHost, tenantID)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+
+	return authority, nil
+}
+
+// instanceDiscovery is true when MSAL can look up the authority, it only knows the Microsoft clouds
+func (e Endpoints) instanceDiscovery() bool {
+	return e.AuthorityHost == DefaultAuthorityHost
+}
+
+// baseURL is the root of the Graph API calls
+func (e Endpoints) baseURL() string {
+	return e.GraphURL + "/" + e.GraphVersion
+}
+
+// applicationScopes are the scopes for the application permissions granted to the app registration
+func (e Endpoints) applicationScopes() []string {
+	return []string{e.GraphURL + "/.default"}
+}
+
+// delegatedScopes are the permissions the signed-in user consents to, drafts and reply tracking need ReadWrite
+func (e Endpoints) delegatedScopes() []string {
+	return []string{e.GraphURL + "/Mail.Send", e.GraphURL + "/Mail.ReadWrite"}
+}
+
+// httpClient is the client for Graph calls
+func (e Endpoints) httpClient() *http.Client {
+	if e.HTTPClient != nil {
+		return e.HTTPClient
+	}
+	return &http.Client{
+		Timeout: 15 * time.Second,
+	}
+}
@@ -0,0 +1,131 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// mboxrd quoting, lines starting with any number of > followed by From have another > added
+var reMboxFrom = regexp.MustCompile(`(?m)^(>*From )`)
+
+// FileSender writes messages to files instead of sending them, so they can be checked offline
+type FileSender struct {
+	dir  string
+	mbox bool
+
+	// mutex for appending to the mbox
+	m sync.Mutex
+}
+
+// NewFileSender creates a sender that writes each message as an .eml file in dir, or appends them all
+// to goboro.mbox in dir if mbox is true
+func NewFileSender(dir string, mbox bool) (*FileSender, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	fs := &FileSender{
+		dir:  dir,
+		mbox: mbox,
+	}
+
+	return fs, nil
+}
+
+// Send writes msg to file, including the Bcc header so all recipients can be checked
+func (fs *FileSender) Send(msg *Message) error {
+	if !msg.DeliverAt.IsZero() {
+		log.Printf("%+v", errNoDeferredDelivery)
+		return errNoDeferredDelivery
+	}
+
+	err := msg.validateAttachments()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	now := time.Now()
+	data, err := msg.buildMIME(now, true)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	if fs.mbox {
+		fs.m.Lock()
+		defer fs.m.Unlock()
+
+		err = AppendMbox(filepath.Join(fs.dir, "goboro.mbox"), msg.From, now, data)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+
+		return nil
+	}
+
+	b := make([]byte, 4)
+	_, err = rand.Read(b)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	fname := filepath.Join(fs.dir, fmt.Sprintf("%s-%s.eml", now.Format("20060102-150405"), hex.EncodeToString(b)))
+	err = os.WriteFile(fname, data, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// AppendMbox appends message data to mbox file fname in mboxrd format, from and date are for the From line
+func AppendMbox(fname, from string, date time.Time, data []byte) error {
+	// #nosec G304
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	defer f.Close()
+
+	err = WriteMbox(f, from, date, data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// WriteMbox writes message data to w as an mbox entry in mboxrd format, from and date are for the From line
+func WriteMbox(w io.Writer, from string, date time.Time, data []byte) error {
+	// mbox files use local line endings, messages end with a blank line
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = reMboxFrom.ReplaceAll(data, []byte(">$1"))
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+
+	_, err := fmt.Fprintf(w, "From %s %s\n%s\n", from, date.UTC().Format(time.ANSIC), data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraphError is an error response from Microsoft Graph
+type GraphError struct {
+	StatusCode int
+	Code       string // Graph error code, like ErrorInvalidRecipients
+	Message    string // Graph error message
+	RequestID  string // quote this when asking Microsoft for help
+	Date       string
+	RetryAfter time.Duration // how long Graph asked us to wait, for throttling
+	Delegated  bool          // the request was made signed in as the user, not with the app registration credentials
+}
+
+type graphErrorResponse struct {
+	Error struct {
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+		InnerError struct {
+			RequestID string `json:"request-id"`
+			Date      string `json:"date"`
+		} `json:"innerError"`
+	} `json:"error"`
+}
+
+// newGraphError creates a GraphError from a failed response and its body
+func newGraphError(response *http.Response, body []byte) *GraphError {
+	return graphErrorFrom(response.StatusCode, response.Header, body)
+}
+
+// graphErrorFrom creates a GraphError from the status, headers and body of a failed response,
+// which may be one of the responses in a batch
+func graphErrorFrom(statusCode int, header http.Header, body []byte) *GraphError {
+	ge := &GraphError{
+		StatusCode: statusCode,
+	}
+
+	var r graphErrorResponse
+	if json.Unmarshal(body, &r) == nil {
+		ge.Code = r.Error.Code
+		ge.Message = r.Error.Message
+		ge.RequestID = r.Error.InnerError.RequestID
+		ge.Date = r.Error.InnerError.Date
+	}
+	if ge.RequestID == "" {
+		ge.RequestID = header.Get("request-id")
+	}
+
+	// Retry-After is in seconds
+	if s, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		ge.RetryAfter = time.Duration(s) * time.Second
+	}
+
+	return ge
+}
+
+// IsAuth tests if the request was refused because of the credentials or permissions
+func (ge *GraphError) IsAuth() bool {
+	switch ge.Code {
+	case "InvalidAuthenticationToken", "AuthenticationError", "ErrorAccessDenied", "Authorization_RequestDenied",
+		"AccessDenied", "ErrorSendAsDenied", "ErrorImpersonateUserDenied":
+		return true
+	}
+	return ge.StatusCode == http.StatusUnauthorized || ge.StatusCode == http.StatusForbidden
+}
+
+// IsThrottled tests if Graph asked us to slow down
+func (ge *GraphError) IsThrottled() bool {
+	switch ge.Code {
+	case "ApplicationThrottled", "ErrorTooManyObjectsOpened", "MailboxConcurrency", "ErrorServerBusy", "TooManyRequests":
+		return true
+	}
+	return ge.StatusCode == http.StatusTooManyRequests
+}
+
+// IsMailboxNotFound tests if the sending user or mailbox doesn't exist or can't be used
+func (ge *GraphError) IsMailboxNotFound() bool {
+	switch ge.Code {
+	case "ErrorInvalidUser", "ErrorNonExistentMailbox", "MailboxNotEnabledForRESTAPI", "MailboxNotSupportedForRESTAPI",
+		"ResourceNotFound", "Request_ResourceNotFound":
+		return true
+	}
+	return false
+}
+
+// IsInvalidRecipient tests if a recipient address was rejected
+func (ge *GraphError) IsInvalidRecipient() bool {
+	switch ge.Code {
+	case "ErrorInvalidRecipients", "ErrorRecipientNotFound", "ErrorInvalidSmtpAddress", "ErrorMessageHasNoRecipients":
+		return true
+	}
+	return false
+}
+
+// Temporary tests if the same request might work if it's tried again later
+func (ge *GraphError) Temporary() bool {
+	return ge.IsThrottled() || ge.StatusCode >= 500
+}
+
+// explanation describes the error in terms the user can act on
+func (ge *GraphError) explanation() string {
+	switch {
+	case ge.IsThrottled():
+		s := "Microsoft 365 is limiting how fast we can send, try again later"
+		if ge.RetryAfter > 0 {
+			s = fmt.Sprintf("Microsoft 365 is limiting how fast we can send, try again in %s", ge.RetryAfter)
+		}
+		return s
+	case ge.IsMailboxNotFound():
+		return "The sending mailbox wasn't found, check Email UserID and From in the configuration"
+	case ge.IsInvalidRecipient():
+		return "A recipient address was rejected, check the To, Cc and Bcc addresses"
+	case ge.IsAuth() && ge.Delegated:
+		return "Microsoft 365 refused the request, sign in again and check the signed-in account can send from the mailbox"
+	case ge.IsAuth():
+		return "Microsoft 365 refused the request, check the app registration credentials and its Mail.Send permission"
+	case ge.StatusCode >= 500:
+		return "Microsoft 365 had a problem, try again later"
+	}
+	return "Microsoft 365 rejected the request"
+}
+
+// Error returns the explanation followed by the Graph details
+func (ge *GraphError) Error() string {
+	details := []string{fmt.Sprintf("status %d", ge.StatusCode)}
+	if ge.Code != "" {
+		details = append(details, ge.Code)
+	}
+	if ge.Message != "" {
+		details = append(details, ge.Message)
+	}
+	if ge.RequestID != "" {
+		details = append(details, "request-id "+ge.RequestID)
+	}
+	if ge.Date != "" {
+		details = append(details, ge.Date)
+	}
+
+	return fmt.Sprintf("%s\n\n(%s)", ge.explanation(), strings.Join(details, ", "))
+}
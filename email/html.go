@@ -0,0 +1,108 @@
+package email
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	reSpaces     = regexp.MustCompile(`[ \t\r\n]+`)
+	reBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// textRenderer accumulates the plain text rendering of an HTML document
+type textRenderer struct {
+	b    strings.Builder
+	href string // link target of the open anchor
+	skip int    // depth of elements whose content isn't rendered
+}
+
+// htmlToText creates a plain text rendering of an HTML body for the text/plain alternative
+func htmlToText(s string) string {
+	var r textRenderer
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			// end of document
+			return r.String()
+
+		case html.TextToken:
+			if r.skip == 0 {
+				r.b.WriteString(reSpaces.ReplaceAllString(string(z.Text()), " "))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			r.element(z, tt)
+		}
+	}
+}
+
+// element renders the line breaks, bullets and link targets for the tag token tt
+func (r *textRenderer) element(z *html.Tokenizer, tt html.TokenType) {
+	name, hasAttr := z.TagName()
+	start := tt != html.EndTagToken
+
+	switch string(name) {
+	case "script", "style", "head", "title":
+		if tt == html.StartTagToken {
+			r.skip++
+		} else if tt == html.EndTagToken && r.skip > 0 {
+			r.skip--
+		}
+	case "br":
+		r.b.WriteString("\n")
+	case "p", "div", "table", "ul", "ol", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote":
+		r.b.WriteString("\n\n")
+	case "tr":
+		if start {
+			r.b.WriteString("\n")
+		}
+	case "td", "th":
+		if !start {
+			r.b.WriteString("\t")
+		}
+	case "li":
+		if start {
+			r.b.WriteString("\n* ")
+		}
+	case "hr":
+		r.b.WriteString("\n----------\n")
+	case "a":
+		if start {
+			r.href = anchorHref(z, hasAttr)
+		} else if r.href != "" && !strings.HasPrefix(r.href, "#") {
+			r.b.WriteString(" (" + strings.TrimPrefix(r.href, "mailto:") + ")")
+			r.href = ""
+		}
+	}
+}
+
+// anchorHref returns the href attribute of the current anchor tag
+func anchorHref(z *html.Tokenizer, hasAttr bool) string {
+	var href string
+	for hasAttr {
+		var key, val []byte
+		key, val, hasAttr = z.TagAttr()
+		if string(key) == "href" {
+			href = string(val)
+		}
+	}
+
+	return href
+}
+
+// String returns the rendered text with blank lines collapsed and lines trimmed
+func (r *textRenderer) String() string {
+	text := reBlankLines.ReplaceAllString(r.b.String(), "\n\n")
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")) + "\n"
+}
@@ -0,0 +1,35 @@
+package email
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"plain", "73 de K1ABC", "73 de K1ABC\n"},
+		{"entities", "<p>QSO &amp; QSL&nbsp;card &lt;via bureau&gt; &quot;tnx&quot; &#169;</p>", "QSO & QSL card <via bureau> \"tnx\" ©\n"},
+		{"whitespace", "<p>  Thanks\n\tfor   the\r\n QSO  </p>", "Thanks for the QSO\n"},
+		{"paragraphs", "<p>one</p><p>two</p>", "one\n\ntwo\n"},
+		{"blank lines", "<div><p>one</p></div><br><br><div><p>two</p></div>", "one\n\ntwo\n"},
+		{"line break", "Joe<br>K1ABC<br/>Boston", "Joe\nK1ABC\nBoston\n"},
+		{"link", `See <a href="https://www.qrz.com/db/K1ABC">my page</a>.`, "See my page (https://www.qrz.com/db/K1ABC).\n"},
+		{"mailto", `Write <a href="mailto:k1abc@arrl.net">me</a>`, "Write me (k1abc@arrl.net)\n"},
+		{"fragment link", `<a href="#top">top</a>`, "top\n"},
+		{"anchor without href", `<a name="top">top</a>`, "top\n"},
+		{"list", "<p>Bands</p><ul><li>20m</li><li>40m</li></ul>", "Bands\n\n* 20m\n* 40m\n"},
+		{"ordered list", "<ol><li>QSO</li><li>QSL</li></ol>", "* QSO\n* QSL\n"},
+		{"table", "<table><tr><td>Band</td><td>20m</td></tr><tr><td>Mode</td><td>SSB</td></tr></table>", "Band\t20m\nMode\tSSB\n"},
+		{"rule", "above<hr>below", "above\n----------\nbelow\n"},
+		{"skipped", "<html><head><title>QSL</title><style>p {color: red}</style></head><body><script>x()</script><p>tnx</p></body></html>", "tnx\n"},
+		{"empty", "", "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToText(tt.html); got != tt.want {
+				t.Errorf("htmlToText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
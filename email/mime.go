@@ -0,0 +1,279 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// messageID creates a unique RFC 5322 Message-ID using the domain of the sender
+func messageID(from string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+
+	domain := "goboro.localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain), nil
+}
+
+// formatAddresses creates an address list header value
+func formatAddresses(addresses []string) string {
+	s := make([]string, len(addresses))
+	for i, a := range addresses {
+		// local parts can already be quoted, see ParseAddresses
+		if ma, err := mail.ParseAddress(a); err == nil {
+			s[i] = (&mail.Address{Address: ma.Address}).String()
+			continue
+		}
+		s[i] = (&mail.Address{Address: a}).String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// writeHeader writes a single header line, values are assumed to be already encoded
+func writeHeader(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	b.WriteString(": ")
+	b.WriteString(value)
+	b.WriteString("\r\n")
+}
+
+// crlf normalizes line endings to CRLF as required on the wire
+func crlf(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// MIME returns msg as an RFC 5322 message dated date, including Bcc, for keeping a copy of what was sent
+func (msg *Message) MIME(date time.Time) ([]byte, error) {
+	return msg.buildMIME(date, true)
+}
+
+// buildMIME creates the RFC 5322 representation of msg, Bcc recipients are only included if withBcc is true
+func (msg *Message) buildMIME(now time.Time, withBcc bool) ([]byte, error) {
+	id, err := msg.AssignMessageID()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	// body
+	var body part
+	if msg.HTML {
+		body, err = alternativePart(msg.Body)
+	} else {
+		body, err = textPart("text/plain", msg.Body)
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	// attachments follow the body
+	if len(msg.Attachments) > 0 {
+		parts := []part{body}
+		for _, a := range msg.Attachments {
+			parts = append(parts, attachmentPart(a))
+		}
+
+		body, err = multipartPart("mixed", parts...)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	var b bytes.Buffer
+
+	// headers
+	if msg.SendAs != "" {
+		writeHeader(&b, "From", formatAddresses([]string{msg.SendAs}))
+		if msg.OnBehalf {
+			writeHeader(&b, "Sender", formatAddresses([]string{msg.From}))
+		}
+	} else {
+		writeHeader(&b, "From", formatAddresses([]string{msg.From}))
+	}
+	writeHeader(&b, "To", formatAddresses(msg.To))
+	if len(msg.Cc) > 0 {
+		writeHeader(&b, "Cc", formatAddresses(msg.Cc))
+	}
+	if withBcc && len(msg.Bcc) > 0 {
+		writeHeader(&b, "Bcc", formatAddresses(msg.Bcc))
+	}
+	if len(msg.ReplyTo) > 0 {
+		writeHeader(&b, "Reply-To", formatAddresses(msg.ReplyTo))
+	}
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	writeHeader(&b, "Date", now.Format(time.RFC1123Z))
+	writeHeader(&b, "Message-ID", id)
+	for _, h := range msg.headers() {
+		writeHeader(&b, h.name, mime.QEncoding.Encode("utf-8", h.value))
+	}
+	if len(msg.Categories) > 0 {
+		// Outlook shows Keywords as categories
+		writeHeader(&b, "Keywords", mime.QEncoding.Encode("utf-8", strings.Join(msg.Categories, ", ")))
+	}
+	// Outlook reads Importance, most others X-Priority
+	switch msg.Importance {
+	case ImportanceHigh:
+		writeHeader(&b, "Importance", "high")
+		writeHeader(&b, "X-Priority", "1 (Highest)")
+	case ImportanceLow:
+		writeHeader(&b, "Importance", "low")
+		writeHeader(&b, "X-Priority", "5 (Lowest)")
+	}
+	if msg.ReadReceipt {
+		// RFC 8098, delivery receipts are asked for in the SMTP envelope
+		writeHeader(&b, "Disposition-Notification-To", formatAddresses([]string{msg.replyAddress()}))
+	}
+	writeHeader(&b, "MIME-Version", "1.0")
+
+	body.writeTo(&b)
+
+	return b.Bytes(), nil
+}
+
+// part is a MIME entity, its content headers and encoded body
+type part struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// writeTo writes the part headers, a blank line and the body
+func (p part) writeTo(b *bytes.Buffer) {
+	keys := make([]string, 0, len(p.header))
+	for k := range p.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range p.header[k] {
+			writeHeader(b, k, v)
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(p.body)
+}
+
+// textPart creates a quoted-printable encoded text part
+func textPart(contentType, content string) (part, error) {
+	var b bytes.Buffer
+	qp := quotedprintable.NewWriter(&b)
+	_, err := qp.Write([]byte(crlf(content)))
+	if err != nil {
+		log.Printf("%+v", err)
+		return part{}, err
+	}
+	err = qp.Close()
+	if err != nil {
+		log.Printf("%+v", err)
+		return part{}, err
+	}
+
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: b.Bytes(),
+	}, nil
+}
+
+// multipartPart creates a multipart entity of subtype, mixed or alternative, containing parts
+func multipartPart(subtype string, parts ...part) (part, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+
+	for _, p := range parts {
+		pw, err := mw.CreatePart(p.header)
+		if err != nil {
+			log.Printf("%+v", err)
+			return part{}, err
+		}
+		_, err = pw.Write(p.body)
+		if err != nil {
+			log.Printf("%+v", err)
+			return part{}, err
+		}
+	}
+
+	err := mw.Close()
+	if err != nil {
+		log.Printf("%+v", err)
+		return part{}, err
+	}
+
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()})},
+		},
+		body: b.Bytes(),
+	}, nil
+}
+
+// alternativePart creates a multipart/alternative entity with a generated plain text part followed by the HTML part
+func alternativePart(htmlContent string) (part, error) {
+	text, err := textPart("text/plain", htmlToText(htmlContent))
+	if err != nil {
+		log.Printf("%+v", err)
+		return part{}, err
+	}
+	html, err := textPart("text/html", htmlContent)
+	if err != nil {
+		log.Printf("%+v", err)
+		return part{}, err
+	}
+
+	return multipartPart("alternative", text, html)
+}
+
+// attachmentPart creates a base64 encoded attachment part
+func attachmentPart(a Attachment) part {
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+
+	// lines are limited to 76 characters
+	var b bytes.Buffer
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+
+	// the content type can already have parameters, like text/plain; charset=utf-8
+	mediaType, params, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+	params["name"] = a.Name
+
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(mediaType, params)},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		body: b.Bytes(),
+	}
+}
@@ -0,0 +1,90 @@
+package email_test
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+)
+
+func TestMIMETextAttachment(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "log.txt")
+	err := os.WriteFile(fname, []byte("QSO log\r\nK1ABC 20m SSB\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := email.LoadAttachment(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &email.Message{
+		From:        "w1bureau@example.org",
+		To:          []string{"k1abc@example.com"},
+		Subject:     "QSL cards waiting",
+		Body:        "Your cards are here.",
+		Attachments: []email.Attachment{a},
+	}
+	data, err := msg.MIME(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := readMultipart(t, m.Header.Get("Content-Type"), m.Body, "multipart/mixed")
+	if len(parts) != 2 {
+		t.Fatalf("multipart/mixed has %d parts, want 2", len(parts))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parts[1].header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("attachment Content-Type %q: %v", parts[1].header.Get("Content-Type"), err)
+	}
+	if mediaType != "text/plain" {
+		t.Errorf("attachment is %s, want text/plain", mediaType)
+	}
+	if params["charset"] != "utf-8" {
+		t.Errorf("attachment charset %q, want utf-8", params["charset"])
+	}
+	if params["name"] != "log.txt" {
+		t.Errorf("attachment name %q, want log.txt", params["name"])
+	}
+}
+
+func TestMIMEQuotedLocalPart(t *testing.T) {
+	addresses, err := email.ParseAddresses(`"joe smith"@example.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &email.Message{
+		From:    "w1bureau@example.org",
+		To:      []string{addresses[0].Address},
+		Subject: "QSL cards waiting",
+		Body:    "Your cards are here.",
+	}
+	data, err := msg.MIME(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := m.Header.AddressList("To")
+	if err != nil {
+		t.Fatalf("To header %q: %v", m.Header.Get("To"), err)
+	}
+	if len(to) != 1 || to[0].Address != "joe smith@example.com" {
+		t.Errorf("To %v, want joe smith@example.com", to)
+	}
+}
@@ -4,20 +4,52 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 )
 
-// Client is our type
-type Client struct {
-	httpClient  *http.Client
-	AccessToken *string
+// refresh access tokens this long before they expire
+const tokenRefreshMargin = 5 * time.Minute
+
+// GraphClient sends email through the Microsoft Graph API
+type GraphClient struct {
+	httpClient *http.Client
+	baseURL    string // Graph API root, like https://graph.microsoft.com/v1.0
+
+	// gets an access token from the authority, bypassing any cached token if refresh is true
+	acquireToken func(refresh bool) (string, time.Time, error)
+
+	// signs the user in interactively, nil for app-only clients, see SignIn
+	signIn func() (string, time.Time, error)
+
+	// reports whether the user has signed in before, nil for app-only clients, see SignedIn
+	hasAccount func() bool
+
+	// signed in as the user, mail is sent from /me instead of /users/{id}
+	delegated bool
+
+	accessToken      string
+	expiresOn        time.Time
+	signInRequired   bool   // ErrSignInRequired has been returned since the last sign-in
+	onSignInRequired func() // see OnSignInRequired
+
+	// mutex for accessToken, expiresOn and the sign-in fields
+	m sync.Mutex
+
+	// when the next $batch can be sent, see SendBatch
+	nextBatch time.Time
+
+	// mutex for nextBatch
+	bm sync.Mutex
 }
 
 type bodyType struct {
@@ -34,148 +66,524 @@ type recipientType struct {
 	EmailAddress emailAddressType `json:"emailAddress"`
 }
 
+type fileAttachmentType struct {
+	ODataType    string `json:"@odata.type"`
+	Name         string `json:"name"`
+	ContentType  string `json:"contentType"`
+	ContentBytes []byte `json:"contentBytes"`
+}
+
 type messageType struct {
-	Subject      string          `json:"subject"`
-	Body         bodyType        `json:"body"`
-	ToRecipients []recipientType `json:"toRecipients"`
+	Subject       string               `json:"subject"`
+	Body          bodyType             `json:"body"`
+	From          *recipientType       `json:"from,omitempty"`
+	Sender        *recipientType       `json:"sender,omitempty"`
+	ToRecipients  []recipientType      `json:"toRecipients"`
+	CcRecipients  []recipientType      `json:"ccRecipients,omitempty"`
+	BccRecipients []recipientType      `json:"bccRecipients,omitempty"`
+	ReplyTo       []recipientType      `json:"replyTo,omitempty"`
+	Attachments   []fileAttachmentType `json:"attachments,omitempty"`
+
+	InternetMessageID      string                      `json:"internetMessageId,omitempty"`
+	InternetMessageHeaders []internetMessageHeaderType `json:"internetMessageHeaders,omitempty"`
+	Categories             []string                    `json:"categories,omitempty"`
+
+	Importance                 string `json:"importance,omitempty"`
+	IsReadReceiptRequested     bool   `json:"isReadReceiptRequested,omitempty"`
+	IsDeliveryReceiptRequested bool   `json:"isDeliveryReceiptRequested,omitempty"`
+
+	SingleValueExtendedProperties []singleValueExtendedPropertyType `json:"singleValueExtendedProperties,omitempty"`
+}
+
+type internetMessageHeaderType struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type attachmentItem struct {
+	AttachmentType string `json:"attachmentType"`
+	Name           string `json:"name"`
+	Size           int    `json:"size"`
+	ContentType    string `json:"contentType"`
+}
+
+type uploadSessionRequest struct {
+	AttachmentItem attachmentItem `json:"AttachmentItem"`
+}
+
+type uploadSession struct {
+	UploadURL string `json:"uploadUrl"`
 }
 
 type message struct {
-	Message messageType `json:"message"`
+	Message         messageType `json:"message"`
+	SaveToSentItems *bool       `json:"saveToSentItems,omitempty"` // true when left out
+}
+
+// newSendMail creates the sendMail request for msg converted to gmsg
+func newSendMail(msg *Message, gmsg messageType) message {
+	m := message{Message: gmsg}
+	if msg.SkipSentItems {
+		save := false
+		m.SaveToSentItems = &save
+	}
+	return m
 }
 
 // Office365Client creates a new Microsoft Office365 client
-func Office365Client(tenantID, clientID, clientSecret string) (*Client, error) {
-	accessToken, err := initializeClient(tenantID, clientID, clientSecret)
+func Office365Client(endpoints Endpoints, tenantID, clientID, clientSecret string) (*GraphClient, error) {
+	cred, err := confidential.NewCredFromSecret(clientSecret)
 	if err != nil {
 		log.Printf("%+v", err)
 		return nil, err
 	}
 
-	client := &Client{
-		httpClient: &http.Client{
-			Timeout: 15 * time.Second,
+	return newConfidentialGraphClient(endpoints, tenantID, clientID, cred)
+}
+
+// newConfidentialGraphClient creates a client with application permissions that authenticates with cred
+func newConfidentialGraphClient(endpoints Endpoints, tenantID, clientID string, cred confidential.Credential) (*GraphClient, error) {
+	endpoints = endpoints.withDefaults()
+
+	confidentialClient, err := initializeClient(endpoints, tenantID, clientID, cred)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	scopes := endpoints.applicationScopes()
+	client := &GraphClient{
+		httpClient: endpoints.httpClient(),
+		baseURL:    endpoints.baseURL(),
+		acquireToken: func(refresh bool) (string, time.Time, error) {
+			// always goes to the authority, the MSAL cache would hand back the token that is expiring or was rejected
+			result, err := confidentialClient.AcquireTokenByCredential(context.TODO(), scopes)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return result.AccessToken, result.ExpiresOn, nil
 		},
-		AccessToken: accessToken,
 	}
 
+	// the token is acquired when the first message goes out, so starting doesn't need the network
 	return client, nil
 }
 
-func initializeClient(tenantID, clientID, clientSecret string) (*string, error) {
+func initializeClient(endpoints Endpoints, tenantID, clientID string, cred confidential.Credential) (confidential.Client, error) {
+	tenantUrl, err := endpoints.authority(tenantID)
+	if err != nil {
+		log.Printf("%+v", err)
+		return confidential.Client{}, err
+	}
+
+	options := []confidential.Option{confidential.WithInstanceDiscovery(endpoints.instanceDiscovery())}
+	if endpoints.HTTPClient != nil {
+		options = append(options, confidential.WithHTTPClient(endpoints.HTTPClient))
+	}
+
 	// create confidential client
-	cred, err := confidential.NewCredFromSecret(clientSecret)
+	confidentialClient, err := confidential.New(tenantUrl, clientID, cred, options...)
 	if err != nil {
 		log.Printf("%+v", err)
-		return nil, err
+		return confidential.Client{}, err
 	}
 
-	tenantUrl, err := url.JoinPath("https://login.microsoftonline.com", tenantID)
+	return confidentialClient, nil
+}
+
+// token returns a current access token, acquiring a new one if the one we have is close to expiring
+// or if refresh is true because the API rejected it
+func (client *GraphClient) token(refresh bool) (string, error) {
+	client.m.Lock()
+	defer client.m.Unlock()
+
+	if !refresh && client.accessToken != "" && time.Until(client.expiresOn) > tokenRefreshMargin {
+		return client.accessToken, nil
+	}
+
+	accessToken, expiresOn, err := client.acquireToken(refresh)
 	if err != nil {
+		if errors.Is(err, ErrSignInRequired) && !client.signInRequired {
+			client.signInRequired = true
+			if client.onSignInRequired != nil {
+				go client.onSignInRequired()
+			}
+		}
 		log.Printf("%+v", err)
-		return nil, err
+		return "", err
 	}
 
-	confidentialClient, err := confidential.New(tenantUrl, clientID, cred)
+	client.accessToken = accessToken
+	client.expiresOn = expiresOn
+
+	return client.accessToken, nil
+}
+
+// userURL is the Graph URL of the mailbox of user userID, or of the signed-in user
+func (client *GraphClient) userURL(userID string) string {
+	if client.delegated {
+		return client.baseURL + "/me"
+	}
+	return client.baseURL + "/users/" + url.PathEscape(userID)
+}
+
+// makeRequest is a helper function to wrap making REST calls to Microsoft Graph API
+// if the access token is rejected, a new one is acquired and the request is retried once
+func (client *GraphClient) makeRequest(method, url string, body []byte) ([]byte, error) {
+	response, err := client.doRequest(method, url, body, false)
 	if err != nil {
 		log.Printf("%+v", err)
 		return nil, err
 	}
+	if response.StatusCode == http.StatusUnauthorized {
+		response.Body.Close()
+		log.Println("refreshing access token")
 
-	// acquire access token
-	scopes := []string{"https://graph.microsoft.com/.default"}
-	result, err := confidentialClient.AcquireTokenSilent(context.TODO(), scopes)
-	if err != nil {
-		// cache miss, authenticate
-		result, err = confidentialClient.AcquireTokenByCredential(context.TODO(), scopes)
+		response, err = client.doRequest(method, url, body, true)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+	defer response.Body.Close()
+
+	// get body for caller, if there is something
+	var data []byte
+	if response.ContentLength != 0 {
+		data, err = io.ReadAll(response.Body)
 		if err != nil {
 			log.Printf("%+v", err)
 			return nil, err
 		}
 	}
 
-	return &result.AccessToken, nil
+	// error?
+	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
+		ge := newGraphError(response, data)
+		ge.Delegated = client.delegated
+		log.Printf("%s call to %s returned %+v", method, url, *ge)
+		return nil, ge
+	}
+
+	return data, nil
 }
 
-// makeRequest is a helper function to wrap making REST calls to Microsoft Graph API
-func (client *Client) makeRequest(method, url string, body io.Reader) ([]byte, error) {
+// doRequest makes a single authorized request
+func (client *GraphClient) doRequest(method, url string, body []byte, refreshToken bool) (*http.Response, error) {
+	accessToken, err := client.token(refreshToken)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
 	// create request
-	request, err := http.NewRequest(method, url, body)
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, url, r)
 	if err != nil {
 		log.Printf("%+v", err)
 		return nil, err
 	}
 	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 
 	// set content-type only on requests that send some content
 	if body != nil {
 		request.Header.Set("Content-Type", "application/json")
 	}
 
-	// include auth token if available
-	if client.AccessToken != nil {
-		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *client.AccessToken))
+	// make request, get response
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// newRecipients converts addresses to Graph recipients
+func newRecipients(addresses []string) []recipientType {
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	recipients := make([]recipientType, len(addresses))
+	for i, address := range addresses {
+		recipients[i] = recipientType{
+			EmailAddress: emailAddressType{
+				Address: address,
+			},
+		}
 	}
 
-	// make request, get response
-	var response *http.Response
-	response, err = client.httpClient.Do(request)
+	return recipients
+}
+
+// newMessage converts msg to a Graph message, attachments too large to go inline are returned separately
+func newMessage(msg *Message) (messageType, []Attachment) {
+	contentType := "Text"
+	if msg.HTML {
+		contentType = "HTML"
+	}
+
+	gmsg := messageType{
+		Subject: msg.Subject,
+		Body: bodyType{
+			ContentType: contentType,
+			Content:     msg.Body,
+		},
+		ToRecipients:  newRecipients(msg.To),
+		CcRecipients:  newRecipients(msg.Cc),
+		BccRecipients: newRecipients(msg.Bcc),
+		ReplyTo:       newRecipients(msg.ReplyTo),
+
+		InternetMessageID: msg.MessageID,
+		Categories:        msg.Categories,
+
+		Importance:                 msg.Importance,
+		IsReadReceiptRequested:     msg.ReadReceipt,
+		IsDeliveryReceiptRequested: msg.DeliveryReceipt,
+	}
+	for _, h := range msg.headers() {
+		gmsg.InternetMessageHeaders = append(gmsg.InternetMessageHeaders, internetMessageHeaderType{Name: h.name, Value: h.value})
+	}
+	if !msg.DeliverAt.IsZero() {
+		gmsg.SingleValueExtendedProperties = append(gmsg.SingleValueExtendedProperties, singleValueExtendedPropertyType{
+			ID:    deferredSendTimeProperty,
+			Value: msg.DeliverAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	// Exchange decides between send as and send on behalf by the permissions the user has on the mailbox,
+	// sender is only set to make on behalf explicit
+	if msg.SendAs != "" {
+		gmsg.From = &recipientType{EmailAddress: emailAddressType{Address: msg.SendAs}}
+		if msg.OnBehalf && strings.Contains(msg.From, "@") {
+			gmsg.Sender = &recipientType{EmailAddress: emailAddressType{Address: msg.From}}
+		}
+	}
+
+	// small attachments go inline until the request gets too big, the rest need upload sessions
+	var large []Attachment
+	inline := len(msg.Body)
+	for _, a := range msg.Attachments {
+		// base64 grows content by a third
+		size := len(a.Data) * 4 / 3
+		if inline+size > inlineAttachmentLimit {
+			large = append(large, a)
+			continue
+		}
+		inline += size
+
+		gmsg.Attachments = append(gmsg.Attachments, fileAttachmentType{
+			ODataType:    "#microsoft.graph.fileAttachment",
+			Name:         a.Name,
+			ContentType:  a.ContentType,
+			ContentBytes: a.Data,
+		})
+	}
+
+	return gmsg, large
+}
+
+// Send delivers msg as the msg.From user, using sendMail unless there are attachments
+// too large to go inline, then the message is created, the attachments uploaded and the message sent.
+// Those are always saved to Sent Items, SkipSentItems only applies to sendMail.
+// With DeliverAt set Exchange holds the message in the Outbox folder until then.
+func (client *GraphClient) Send(msg *Message) error {
+	err := msg.validateAttachments()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = msg.ValidateDeliverAt(time.Now())
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	_, err = msg.AssignMessageID()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	gmsg, large := newMessage(msg)
+	userURL := client.userURL(msg.From)
+
+	if len(large) == 0 {
+		m, err := json.Marshal(newSendMail(msg, gmsg))
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+
+		_, err = client.makeRequest("POST", userURL+"/sendMail", m)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+
+		return nil
+	}
+
+	draft, err := client.createMessage(userURL, gmsg, large)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = client.SendDraft(msg.From, draft.ID)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// SaveDraft creates msg in the Drafts folder of the msg.From user instead of sending it
+func (client *GraphClient) SaveDraft(msg *Message) (*Draft, error) {
+	err := msg.validateAttachments()
 	if err != nil {
 		log.Printf("%+v", err)
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	// error?
-	if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
-		err = fmt.Errorf("%s call to %s returned status code %d ", method, url, response.StatusCode)
+	err = msg.ValidateDeliverAt(time.Now())
+	if err != nil {
 		log.Printf("%+v", err)
 		return nil, err
 	}
 
-	// get body for caller, if there is something
-	var data []byte
-	if response.ContentLength != 0 {
-		data, err = io.ReadAll(response.Body)
+	// so replies and the archive can be matched to it once it's sent
+	_, err = msg.AssignMessageID()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	gmsg, large := newMessage(msg)
+	userURL := client.userURL(msg.From)
+
+	draft, err := client.createMessage(userURL, gmsg, large)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return draft, nil
+}
+
+// SendDraft sends the existing draft message id from the Drafts folder of user userID
+func (client *GraphClient) SendDraft(userID, id string) error {
+	_, err := client.makeRequest("POST", client.userURL(userID)+"/messages/"+url.PathEscape(id)+"/send", nil)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// createMessage creates gmsg in the drafts folder of the user and uploads the large attachments to it
+func (client *GraphClient) createMessage(userURL string, gmsg messageType, large []Attachment) (*Draft, error) {
+	m, err := json.Marshal(gmsg)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	b, err := client.makeRequest("POST", userURL+"/messages", m)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	var draft Draft
+	err = json.Unmarshal(b, &draft)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	messageURL := userURL + "/messages/" + url.PathEscape(draft.ID)
+	for _, a := range large {
+		err = client.uploadAttachment(messageURL, a)
 		if err != nil {
 			log.Printf("%+v", err)
+
+			// don't leave a copy missing attachments in Drafts for every retry
+			_, derr := client.makeRequest("DELETE", messageURL, nil)
+			if derr != nil {
+				log.Printf("%+v", derr)
+			}
 			return nil, err
 		}
 	}
 
-	return data, nil
+	return &draft, nil
 }
 
-func (client *Client) Send(userID, subject, body, to string) error {
-	msg := message{
-		messageType{
-			Subject: subject,
-			Body: bodyType{
-				ContentType: "Text",
-				Content:     body,
-			},
-			ToRecipients: []recipientType{
-				{
-					EmailAddress: emailAddressType{
-						Address: to,
-					},
-				},
-			},
+// uploadAttachment adds a to the message at messageURL using an upload session
+func (client *GraphClient) uploadAttachment(messageURL string, a Attachment) error {
+	m, err := json.Marshal(uploadSessionRequest{
+		AttachmentItem: attachmentItem{
+			AttachmentType: "file",
+			Name:           a.Name,
+			Size:           len(a.Data),
+			ContentType:    a.ContentType,
 		},
+	})
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
 	}
 
-	m, err := json.Marshal(msg)
+	b, err := client.makeRequest("POST", messageURL+"/attachments/createUploadSession", m)
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
 	}
 
-	b, err := client.makeRequest("POST", fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s/sendMail", userID), bytes.NewReader(m))
+	var session uploadSession
+	err = json.Unmarshal(b, &session)
 	if err != nil {
 		log.Printf("%+v", err)
-		log.Printf("%+v", string(b))
 		return err
 	}
 
+	// chunks have to be a multiple of 320 KiB
+	const chunkSize = 10 * 320 * 1024
+	for start := 0; start < len(a.Data); start += chunkSize {
+		end := min(start+chunkSize, len(a.Data))
+
+		// upload URL is pre-authorized, it must not be sent the access token
+		request, err := http.NewRequest("PUT", session.UploadURL, bytes.NewReader(a.Data[start:end]))
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+		request.Header.Set("Content-Type", "application/octet-stream")
+		request.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(a.Data)))
+
+		response, err := client.httpClient.Do(request)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+		response.Body.Close()
+
+		if !(response.StatusCode >= 200 && response.StatusCode <= 299) {
+			err = fmt.Errorf("upload of %s returned status code %d ", a.Name, response.StatusCode)
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
 	return nil
 }
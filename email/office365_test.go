@@ -0,0 +1,507 @@
+package email_test
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+	"github.com/bbathe/goboro/email/emailtest"
+)
+
+// newGraphClient starts a Graph stand-in that is stopped when the test ends and a client signed in to it
+func newGraphClient(t *testing.T) (*emailtest.GraphServer, *email.GraphClient) {
+	t.Helper()
+
+	s := emailtest.NewGraphServer()
+	t.Cleanup(s.Close)
+
+	client, err := email.Office365Client(s.Endpoints(), "contoso", "goboro-test", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, client
+}
+
+// notice is a message from the bureau mailbox to station to
+func notice(to string) *email.Message {
+	return &email.Message{
+		From:    "w1bureau@example.org",
+		To:      []string{to},
+		Subject: "QSL cards waiting",
+		Body:    "Your cards are here.",
+	}
+}
+
+// graphMessages returns the messages s received, failing the test if there aren't n
+func graphMessages(t *testing.T, s *emailtest.GraphServer, n int) []emailtest.GraphMessage {
+	t.Helper()
+
+	messages := s.Messages()
+	if len(messages) != n {
+		t.Fatalf("server received %d messages, want %d", len(messages), n)
+	}
+	return messages
+}
+
+func TestGraphTokenRefresh(t *testing.T) {
+	s, client := newGraphClient(t)
+	if n := s.TokensIssued(); n != 0 {
+		t.Fatalf("%d tokens issued creating the client, want 0", n)
+	}
+
+	// the token is kept while it's good
+	err := client.Send(notice("k1abc@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.TokensIssued(); n != 1 {
+		t.Errorf("%d tokens issued after sending, want 1", n)
+	}
+
+	// rejected, so a new one is acquired and the request made again
+	s.ExpireTokens()
+	err = client.Send(notice("n1xyz@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.TokensIssued(); n != 2 {
+		t.Errorf("%d tokens issued after the token expired, want 2", n)
+	}
+	graphMessages(t, s, 2)
+}
+
+func TestGraphOffline(t *testing.T) {
+	s := emailtest.NewGraphServer()
+	endpoints := s.Endpoints()
+	s.Close()
+
+	// the client is created without reaching the authority, sending fails until it can
+	client, err := email.Office365Client(endpoints, "contoso", "goboro-test", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Send(notice("k1abc@example.com"))
+	if err == nil {
+		t.Fatal("Send succeeded with the server down")
+	}
+	if errors.Is(err, email.ErrSignInRequired) {
+		t.Errorf("Send error %v is ErrSignInRequired", err)
+	}
+}
+
+func TestGraphDelegatedNotSignedIn(t *testing.T) {
+	s := emailtest.NewGraphServer()
+	t.Cleanup(s.Close)
+
+	// creating the client doesn't sign in, that blocks until the user is done
+	prompt := func(message, verificationURL, userCode string) {
+		t.Error("asked to sign in when the client was created")
+	}
+	client, err := email.Office365DelegatedClient(s.Endpoints(), "consumers", "goboro-test", filepath.Join(t.TempDir(), "tokencache.json"), prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.SignedIn() {
+		t.Error("signed in without a cached account")
+	}
+
+	// messages wait until the user signs in
+	err = client.Send(notice("k1abc@example.com"))
+	if !errors.Is(err, email.ErrSignInRequired) {
+		t.Errorf("Send error %v, want ErrSignInRequired", err)
+	}
+
+	// app-only clients don't sign in
+	_, client = newGraphClient(t)
+	if !client.SignedIn() {
+		t.Error("app-only client not signed in")
+	}
+}
+
+func TestGraphSendMail(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	msg := &email.Message{
+		From:            "w1bureau@example.org",
+		To:              []string{"k1abc@example.com"},
+		Cc:              []string{"n1xyz@example.com"},
+		Bcc:             []string{"w1log@example.org"},
+		Subject:         "Final notice",
+		Body:            "<p>Your cards will be returned.</p>",
+		HTML:            true,
+		Callsign:        "K1ABC",
+		NoticeID:        "42",
+		Categories:      []string{"QSL Bureau"},
+		SkipSentItems:   true,
+		Importance:      email.ImportanceHigh,
+		ReadReceipt:     true,
+		DeliveryReceipt: true,
+		Headers:         map[string]string{"X-Bureau-Rule": "final"},
+	}
+	err := client.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := graphMessages(t, s, 1)[0]
+	if m.UserID != "w1bureau@example.org" {
+		t.Errorf("sent from %q, want w1bureau@example.org", m.UserID)
+	}
+	if m.ContentType != "html" {
+		t.Errorf("content type %q, want html", m.ContentType)
+	}
+	for _, r := range []struct {
+		name      string
+		got, want []string
+	}{
+		{"To", m.To, msg.To},
+		{"Cc", m.Cc, msg.Cc},
+		{"Bcc", m.Bcc, msg.Bcc},
+		{"categories", m.Categories, msg.Categories},
+	} {
+		if !slices.Equal(r.got, r.want) {
+			t.Errorf("%s %v, want %v", r.name, r.got, r.want)
+		}
+	}
+
+	wantHeaders := map[string]string{
+		"X-Goboro-Callsign":  "K1ABC",
+		"X-Goboro-Notice-ID": "42",
+		"X-Bureau-Rule":      "final",
+	}
+	if !maps.Equal(m.Headers, wantHeaders) {
+		t.Errorf("internetMessageHeaders %v, want %v", m.Headers, wantHeaders)
+	}
+	if msg.MessageID == "" || m.MessageID != msg.MessageID {
+		t.Errorf("internetMessageId %q, want %q", m.MessageID, msg.MessageID)
+	}
+	if m.SaveToSentItems {
+		t.Error("saved to Sent Items with SkipSentItems set")
+	}
+	if m.Importance != email.ImportanceHigh || !m.ReadReceipt || !m.DeliveryReceipt {
+		t.Errorf("importance %q, read receipt %v, delivery receipt %v", m.Importance, m.ReadReceipt, m.DeliveryReceipt)
+	}
+
+	// saved by default
+	err = client.Send(notice("k1abc@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = graphMessages(t, s, 2)[1]
+	if !m.SaveToSentItems {
+		t.Error("not saved to Sent Items by default")
+	}
+	if len(m.Categories) != 0 || m.Importance != "" {
+		t.Errorf("categories %v and importance %q not asked for", m.Categories, m.Importance)
+	}
+}
+
+func TestGraphAttachments(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	// over the inline limit, and over one upload chunk
+	scan := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{'0'}, 4*1024*1024)...)
+
+	msg := notice("k1abc@example.com")
+	msg.Attachments = []email.Attachment{
+		{Name: "instructions.txt", ContentType: "text/plain", Data: []byte("Send SASEs to the bureau.")},
+		{Name: "cards.pdf", ContentType: "application/pdf", Data: scan},
+	}
+	err := client.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := graphMessages(t, s, 1)[0]
+	want := []string{"instructions.txt", "cards.pdf"}
+	if !slices.Equal(m.Attachments, want) {
+		t.Errorf("attachments %v, want %v", m.Attachments, want)
+	}
+	if bytes.Contains(m.Raw, []byte("cards.pdf")) {
+		t.Error("large attachment sent inline instead of through an upload session")
+	}
+	if !m.SaveToSentItems {
+		t.Error("message sent from a draft not saved to Sent Items")
+	}
+}
+
+func TestGraphDraft(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	msg := notice("k1abc@example.com")
+	draft, err := client.SaveDraft(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageID == "" {
+		t.Fatal("draft not given a Message-ID")
+	}
+	graphMessages(t, s, 0)
+
+	err = client.SendDraft(msg.From, draft.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := graphMessages(t, s, 1)[0]; m.MessageID != msg.MessageID {
+		t.Errorf("internetMessageId %q, want %q", m.MessageID, msg.MessageID)
+	}
+}
+
+func TestGraphAttachmentUploadFailed(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	msg := notice("k1abc@example.com")
+	msg.Attachments = []email.Attachment{
+		{Name: "cards.pdf", ContentType: "application/pdf", Data: append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{'0'}, 4*1024*1024)...)},
+	}
+	s.FailUpload(http.StatusServiceUnavailable, "ErrorServerBusy")
+	err := client.Send(msg)
+	var ge *email.GraphError
+	if !errors.As(err, &ge) || ge.Code != "ErrorServerBusy" {
+		t.Fatalf("%v, want the upload session error", err)
+	}
+
+	graphMessages(t, s, 0)
+	if drafts := s.Drafts(); len(drafts) != 0 {
+		t.Errorf("%d drafts left behind, want 0", len(drafts))
+	}
+}
+
+func TestGraphAttachmentRefused(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	tests := []struct {
+		name       string
+		attachment email.Attachment
+	}{
+		{"blocked type", email.Attachment{Name: "setup.exe", ContentType: "application/octet-stream", Data: []byte("MZ")}},
+		{"content not the type", email.Attachment{Name: "cards.pdf", ContentType: "application/pdf", Data: []byte("\x89PNG\r\n\x1a\n")}},
+		{"empty", email.Attachment{Name: "cards.pdf", ContentType: "application/pdf"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := notice("k1abc@example.com")
+			msg.Attachments = []email.Attachment{tt.attachment}
+			if client.Send(msg) == nil {
+				t.Error("sent")
+			}
+		})
+	}
+	graphMessages(t, s, 0)
+}
+
+func TestGraphSendBatch(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	msgs := []*email.Message{notice("k1abc@example.com"), notice("n1xyz@example.com"), notice("w1aw@example.com")}
+	for i, err := range client.SendBatch(msgs) {
+		if err != nil {
+			t.Errorf("message %d: %v", i, err)
+		}
+	}
+	messages := graphMessages(t, s, 3)
+	for i, m := range messages {
+		if !slices.Equal(m.To, msgs[i].To) {
+			t.Errorf("message %d to %v, want %v", i, m.To, msgs[i].To)
+		}
+	}
+
+	// paced, the next batch has to wait
+	for i, err := range client.SendBatch([]*email.Message{notice("k2def@example.com")}) {
+		var rle *email.RateLimitError
+		if !errors.As(err, &rle) {
+			t.Fatalf("message %d: %v, want a RateLimitError", i, err)
+		}
+		if !rle.NextAllowed.After(time.Now()) {
+			t.Errorf("message %d can be sent again at %s, already passed", i, rle.NextAllowed)
+		}
+	}
+	graphMessages(t, s, 3)
+}
+
+func TestGraphSendBatchLarge(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	// attachments over the inline limit need an upload session, so can't go in the batch
+	large := func(to string) *email.Message {
+		msg := notice(to)
+		msg.Attachments = []email.Attachment{
+			{Name: "cards.pdf", ContentType: "application/pdf", Data: append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{'0'}, 4*1024*1024)...)},
+		}
+		return msg
+	}
+
+	errs := client.SendBatch([]*email.Message{large("k1abc@example.com"), large("n1xyz@example.com")})
+	if errs[0] != nil {
+		t.Fatalf("first message: %v", errs[0])
+	}
+	var rle *email.RateLimitError
+	if !errors.As(errs[1], &rle) {
+		t.Errorf("second message: %v, want a RateLimitError", errs[1])
+	}
+	m := graphMessages(t, s, 1)[0]
+	if !slices.Equal(m.Attachments, []string{"cards.pdf"}) {
+		t.Errorf("attachments %v, want [cards.pdf]", m.Attachments)
+	}
+
+	// paced together with the batches
+	errs = client.SendBatch([]*email.Message{notice("w1aw@example.com")})
+	if !errors.As(errs[0], &rle) {
+		t.Errorf("batch after a large message: %v, want a RateLimitError", errs[0])
+	}
+	graphMessages(t, s, 1)
+}
+
+func TestGraphSendBatchThrottled(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	s.Fail(http.StatusTooManyRequests, "ApplicationThrottled", 30)
+	errs := client.SendBatch([]*email.Message{notice("k1abc@example.com"), notice("n1xyz@example.com")})
+
+	var ge *email.GraphError
+	if !errors.As(errs[0], &ge) || !ge.IsThrottled() {
+		t.Fatalf("throttled message: %v, want a throttled GraphError", errs[0])
+	}
+	if ge.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter %s, want 30s", ge.RetryAfter)
+	}
+	if errs[1] != nil {
+		t.Errorf("second message: %v", errs[1])
+	}
+	graphMessages(t, s, 1)
+
+	// nothing else goes until Graph said
+	errs = client.SendBatch([]*email.Message{notice("k1abc@example.com")})
+	var rle *email.RateLimitError
+	if !errors.As(errs[0], &rle) {
+		t.Fatalf("after throttling: %v, want a RateLimitError", errs[0])
+	}
+	if until := time.Until(rle.NextAllowed); until < 25*time.Second {
+		t.Errorf("next batch in %s, want about 30s", until)
+	}
+}
+
+func TestGraphError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		code       string
+		retryAfter int
+
+		auth, throttled, mailboxNotFound, invalidRecipient, temporary bool
+	}{
+		{name: "invalid recipient", status: http.StatusBadRequest, code: "ErrorInvalidRecipients", invalidRecipient: true},
+		{name: "mailbox not found", status: http.StatusNotFound, code: "ErrorInvalidUser", mailboxNotFound: true},
+		{name: "send as denied", status: http.StatusForbidden, code: "ErrorSendAsDenied", auth: true},
+		{name: "throttled", status: http.StatusServiceUnavailable, code: "ErrorServerBusy", retryAfter: 3, throttled: true, temporary: true},
+		{name: "server error", status: http.StatusInternalServerError, code: "ErrorInternalServerError", temporary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newGraphClient(t)
+
+			s.Fail(tt.status, tt.code, tt.retryAfter)
+			err := client.Send(notice("k1abc@example.com"))
+
+			var ge *email.GraphError
+			if !errors.As(err, &ge) {
+				t.Fatalf("%v, want a GraphError", err)
+			}
+			if ge.StatusCode != tt.status || ge.Code != tt.code {
+				t.Errorf("status %d code %s, want %d %s", ge.StatusCode, ge.Code, tt.status, tt.code)
+			}
+			if ge.Message == "" || ge.RequestID == "" || ge.Date == "" {
+				t.Errorf("message %q, request-id %q, date %q not all parsed", ge.Message, ge.RequestID, ge.Date)
+			}
+			if ge.RetryAfter != time.Duration(tt.retryAfter)*time.Second {
+				t.Errorf("RetryAfter %s, want %ds", ge.RetryAfter, tt.retryAfter)
+			}
+			if ge.IsAuth() != tt.auth || ge.IsThrottled() != tt.throttled || ge.IsMailboxNotFound() != tt.mailboxNotFound ||
+				ge.IsInvalidRecipient() != tt.invalidRecipient || ge.Temporary() != tt.temporary {
+				t.Errorf("IsAuth %v, IsThrottled %v, IsMailboxNotFound %v, IsInvalidRecipient %v, Temporary %v",
+					ge.IsAuth(), ge.IsThrottled(), ge.IsMailboxNotFound(), ge.IsInvalidRecipient(), ge.Temporary())
+			}
+			graphMessages(t, s, 0)
+		})
+	}
+}
+
+func TestGraphErrorAuthExplanation(t *testing.T) {
+	tests := []struct {
+		name      string
+		delegated bool
+		want      string
+	}{
+		{"app registration", false, "check the app registration credentials"},
+		{"signed in", true, "sign in again"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ge := &email.GraphError{StatusCode: http.StatusUnauthorized, Code: "InvalidAuthenticationToken", Delegated: tt.delegated}
+			if !strings.Contains(ge.Error(), tt.want) {
+				t.Errorf("%q doesn't say to %s", ge.Error(), tt.want)
+			}
+		})
+	}
+
+	// errors from app-only clients say so
+	s, client := newGraphClient(t)
+	s.Fail(http.StatusForbidden, "ErrorAccessDenied", 0)
+	var ge *email.GraphError
+	if err := client.Send(notice("k1abc@example.com")); !errors.As(err, &ge) || ge.Delegated {
+		t.Errorf("%v, want a GraphError from an app-only client", err)
+	}
+}
+
+func TestGraphDeferredDelivery(t *testing.T) {
+	s, client := newGraphClient(t)
+
+	deliverAt := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	msg := notice("k1abc@example.com")
+	msg.DeliverAt = deliverAt
+	err := client.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := graphMessages(t, s, 1)[0]; !m.DeliverAt.Equal(deliverAt) {
+		t.Errorf("deferred send time %s, want %s", m.DeliverAt, deliverAt)
+	}
+
+	scheduled, err := client.ScheduledMessages(msg.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 1 || !scheduled[0].DeliverAt.Equal(deliverAt) || !slices.Equal(scheduled[0].To, msg.To) ||
+		scheduled[0].MessageID != msg.MessageID {
+		t.Fatalf("scheduled %+v, want the message for %s", scheduled, deliverAt)
+	}
+
+	err = client.CancelScheduled(msg.From, scheduled[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduled, err = client.ScheduledMessages(msg.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 0 {
+		t.Errorf("scheduled %+v after cancelling", scheduled)
+	}
+
+	// the time has to be ahead
+	msg = notice("k1abc@example.com")
+	msg.DeliverAt = time.Now().Add(-time.Minute)
+	var dae *email.DeliverAtError
+	if err := client.Send(msg); !errors.As(err, &dae) {
+		t.Errorf("delivery time passed: %v, want a DeliverAtError", err)
+	}
+	graphMessages(t, s, 0)
+}
@@ -0,0 +1,214 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RateLimitError is returned instead of sending when it would go over a sending limit
+type RateLimitError struct {
+	Limit       string    // which limit was reached
+	NextAllowed time.Time // when the next message can be sent
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s reached, next message can be sent at %s", e.Limit, e.NextAllowed.Local().Format("Jan 2 15:04:05"))
+}
+
+// RateLimitedSender sits in front of an email backend and refuses to send more than the limits allow,
+// so the account isn't suspended for going over the provider's limits
+type RateLimitedSender struct {
+	sender    Sender
+	perMinute int           // most messages in any minute, 0 for no limit
+	perDay    int           // most messages in any 24 hours, 0 for no limit
+	spacing   time.Duration // least time between messages
+
+	// send times in the last 24 hours, oldest first
+	sent []time.Time
+
+	// mutex for sent
+	m sync.Mutex
+}
+
+// NewRateLimitedSender wraps sender with the limits, history is when messages were sent recently,
+// so the limits carry over a restart
+func NewRateLimitedSender(sender Sender, perMinute, perDay int, spacing time.Duration, history []time.Time) *RateLimitedSender {
+	rl := &RateLimitedSender{
+		sender:    sender,
+		perMinute: perMinute,
+		perDay:    perDay,
+		spacing:   spacing,
+	}
+
+	for _, t := range history {
+		rl.record(t)
+	}
+
+	return rl
+}
+
+// record adds a send time, keeping sent in order, caller must hold the lock
+func (rl *RateLimitedSender) record(t time.Time) {
+	i := len(rl.sent)
+	for i > 0 && rl.sent[i-1].After(t) {
+		i--
+	}
+	rl.sent = append(rl.sent, time.Time{})
+	copy(rl.sent[i+1:], rl.sent[i:])
+	rl.sent[i] = t
+}
+
+// nextAllowed returns when the next message can be sent and the limit that decides it, caller must hold the lock
+func (rl *RateLimitedSender) nextAllowed(now time.Time) (time.Time, string) {
+	// forget what no longer counts against any limit
+	for len(rl.sent) > 0 && now.Sub(rl.sent[0]) >= 24*time.Hour {
+		rl.sent = rl.sent[1:]
+	}
+
+	next := now
+	limit := ""
+	later := func(t time.Time, l string) {
+		if t.After(next) {
+			next = t
+			limit = l
+		}
+	}
+
+	if n := len(rl.sent); n > 0 && rl.spacing > 0 {
+		later(rl.sent[n-1].Add(rl.spacing), fmt.Sprintf("minimum spacing of %s", rl.spacing))
+	}
+	if rl.perMinute > 0 {
+		// the message perMinute back has to be a minute old
+		if n := len(rl.sent); n >= rl.perMinute {
+			later(rl.sent[n-rl.perMinute].Add(time.Minute), fmt.Sprintf("limit of %d messages a minute", rl.perMinute))
+		}
+	}
+	if rl.perDay > 0 {
+		if n := len(rl.sent); n >= rl.perDay {
+			later(rl.sent[n-rl.perDay].Add(24*time.Hour), fmt.Sprintf("limit of %d messages a day", rl.perDay))
+		}
+	}
+
+	return next, limit
+}
+
+// NextAllowed returns when the next message can be sent, now if it can be sent right away
+func (rl *RateLimitedSender) NextAllowed(now time.Time) time.Time {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	next, _ := rl.nextAllowed(now)
+	return next
+}
+
+// reserve takes the next send slot and returns its time, or returns a RateLimitError if sending now would go over a limit
+func (rl *RateLimitedSender) reserve() (time.Time, error) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	now := time.Now()
+	next, limit := rl.nextAllowed(now)
+	if next.After(now) {
+		return time.Time{}, &RateLimitError{Limit: limit, NextAllowed: next}
+	}
+
+	// counted even if the send fails, providers count attempts too
+	rl.record(now)
+
+	return now, nil
+}
+
+// release gives back the send slot taken at t, for a message the backend held back without trying to send it
+func (rl *RateLimitedSender) release(t time.Time, err error) {
+	var rle *RateLimitError
+	if !errors.As(err, &rle) {
+		return
+	}
+
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	for i := len(rl.sent) - 1; i >= 0; i-- {
+		if rl.sent[i].Equal(t) {
+			rl.sent = slices.Delete(rl.sent, i, i+1)
+			return
+		}
+	}
+}
+
+// Send sends msg through the backend if the limits allow it
+func (rl *RateLimitedSender) Send(msg *Message) error {
+	t, err := rl.reserve()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = rl.sender.Send(msg)
+	rl.release(t, err)
+
+	return err
+}
+
+// SendBatch sends as many of msgs as the limits allow, through the backend's batch sending if it has it,
+// the rest get a RateLimitError. With a minimum spacing the messages are sent one at a time instead,
+// a batch would put them on the wire together.
+func (rl *RateLimitedSender) SendBatch(msgs []*Message) []error {
+	if rl.spacing > 0 {
+		errs := make([]error, len(msgs))
+		for i, msg := range msgs {
+			errs[i] = rl.Send(msg)
+		}
+		return errs
+	}
+
+	reserved := make([]time.Time, len(msgs))
+	errs := SendAllowed(rl.sender, msgs, func(i int, _ *Message) error {
+		var err error
+		reserved[i], err = rl.reserve()
+		return err
+	})
+
+	for i, err := range errs {
+		if !reserved[i].IsZero() {
+			rl.release(reserved[i], err)
+		}
+	}
+
+	return errs
+}
+
+// SaveDraft saves msg in the Drafts folder through the backend, saving doesn't count against the limits
+func (rl *RateLimitedSender) SaveDraft(msg *Message) (*Draft, error) {
+	drafter, ok := rl.sender.(Drafter)
+	if !ok {
+		log.Printf("%+v", ErrNoDrafts)
+		return nil, ErrNoDrafts
+	}
+
+	return drafter.SaveDraft(msg)
+}
+
+// SendDraft sends the draft id from the Drafts folder of userID through the backend if the limits allow it
+func (rl *RateLimitedSender) SendDraft(userID, id string) error {
+	drafter, ok := rl.sender.(Drafter)
+	if !ok {
+		log.Printf("%+v", ErrNoDrafts)
+		return ErrNoDrafts
+	}
+
+	t, err := rl.reserve()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = drafter.SendDraft(userID, id)
+	rl.release(t, err)
+
+	return err
+}
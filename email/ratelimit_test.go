@@ -0,0 +1,216 @@
+package email_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+)
+
+// countingSender is an email backend that counts what it sends, and how many batches,
+// it refuses everything with err
+type countingSender struct {
+	m       sync.Mutex
+	sent    int
+	batches int
+	err     error
+}
+
+func (s *countingSender) Send(msg *email.Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.sent++
+	return nil
+}
+
+// batchingSender is a countingSender that can send batches
+type batchingSender struct {
+	countingSender
+}
+
+func (s *batchingSender) SendBatch(msgs []*email.Message) []error {
+	s.m.Lock()
+	s.batches++
+	s.m.Unlock()
+
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = s.Send(msg)
+	}
+	return errs
+}
+
+// draftingSender is a countingSender that can save drafts, and send them
+type draftingSender struct {
+	countingSender
+	drafts int
+}
+
+func (s *draftingSender) SaveDraft(msg *email.Message) (*email.Draft, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.drafts++
+	return &email.Draft{ID: "draft"}, nil
+}
+
+func (s *draftingSender) SendDraft(userID, id string) error {
+	return s.Send(nil)
+}
+
+// notices returns n messages to send
+func notices(n int) []*email.Message {
+	msgs := make([]*email.Message, n)
+	for i := range msgs {
+		msgs[i] = &email.Message{From: "w1bureau@example.org", To: []string{"k1abc@example.com"}, Subject: "QSL cards waiting"}
+	}
+	return msgs
+}
+
+// rateLimited checks err is a RateLimitError for a message allowed at about next
+func rateLimited(t *testing.T, err error, next time.Time) {
+	t.Helper()
+
+	var rle *email.RateLimitError
+	if !errors.As(err, &rle) {
+		t.Fatalf("error %v, want a RateLimitError", err)
+	}
+	if d := rle.NextAllowed.Sub(next); d < -5*time.Second || d > 5*time.Second {
+		t.Errorf("next allowed at %s, want about %s", rle.NextAllowed, next)
+	}
+}
+
+func TestRateLimitPerMinute(t *testing.T) {
+	s := &countingSender{}
+	rl := email.NewRateLimitedSender(s, 2, 0, 0, nil)
+
+	start := time.Now()
+	for i, msg := range notices(3) {
+		err := rl.Send(msg)
+		if i < 2 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		rateLimited(t, err, start.Add(time.Minute))
+	}
+	if s.sent != 2 {
+		t.Errorf("sent %d messages, want 2", s.sent)
+	}
+}
+
+func TestRateLimitPerDayHistory(t *testing.T) {
+	s := &countingSender{}
+	oldest := time.Now().Add(-2 * time.Hour)
+	rl := email.NewRateLimitedSender(s, 0, 2, 0, []time.Time{time.Now().Add(-time.Hour), oldest, oldest.Add(-24 * time.Hour)})
+
+	err := rl.Send(notices(1)[0])
+	rateLimited(t, err, oldest.Add(24*time.Hour))
+	if next := rl.NextAllowed(time.Now()); !next.Equal(oldest.Add(24 * time.Hour)) {
+		t.Errorf("NextAllowed() = %s, want %s", next, oldest.Add(24*time.Hour))
+	}
+	if s.sent != 0 {
+		t.Errorf("sent %d messages, want 0", s.sent)
+	}
+}
+
+func TestRateLimitReleased(t *testing.T) {
+	// the backend holding a message back doesn't use up a slot
+	s := &countingSender{err: &email.RateLimitError{Limit: "backend", NextAllowed: time.Now().Add(time.Minute)}}
+	rl := email.NewRateLimitedSender(s, 1, 0, 0, nil)
+
+	err := rl.Send(notices(1)[0])
+	var rle *email.RateLimitError
+	if !errors.As(err, &rle) || rle.Limit != "backend" {
+		t.Fatalf("error %v, want the backend's RateLimitError", err)
+	}
+
+	s.err = nil
+	err = rl.Send(notices(1)[0])
+	if err != nil {
+		t.Errorf("slot not released: %v", err)
+	}
+
+	// a failed attempt still counts
+	s.err = errors.New("connection reset")
+	rl = email.NewRateLimitedSender(s, 1, 0, 0, nil)
+	_ = rl.Send(notices(1)[0])
+	s.err = nil
+	rateLimited(t, rl.Send(notices(1)[0]), time.Now().Add(time.Minute))
+}
+
+func TestRateLimitSendBatch(t *testing.T) {
+	s := &batchingSender{}
+	rl := email.NewRateLimitedSender(s, 3, 0, 0, nil)
+
+	start := time.Now()
+	errs := rl.SendBatch(notices(5))
+	for i, err := range errs {
+		if i < 3 {
+			if err != nil {
+				t.Errorf("message %d: %v", i, err)
+			}
+			continue
+		}
+		rateLimited(t, err, start.Add(time.Minute))
+	}
+	if s.sent != 3 || s.batches != 1 {
+		t.Errorf("sent %d messages in %d batches, want 3 in 1", s.sent, s.batches)
+	}
+}
+
+func TestRateLimitSendBatchSpacing(t *testing.T) {
+	s := &batchingSender{}
+	rl := email.NewRateLimitedSender(s, 0, 0, time.Minute, nil)
+
+	// one message per slot, not a batch that puts them on the wire together
+	start := time.Now()
+	errs := rl.SendBatch(notices(3))
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	for _, err := range errs[1:] {
+		rateLimited(t, err, start.Add(time.Minute))
+	}
+	if s.sent != 1 || s.batches != 0 {
+		t.Errorf("sent %d messages in %d batches, want 1 on its own", s.sent, s.batches)
+	}
+}
+
+func TestRateLimitDraft(t *testing.T) {
+	s := &draftingSender{}
+	rl := email.NewRateLimitedSender(s, 1, 0, 0, nil)
+
+	// saving isn't sending
+	for i := 0; i < 2; i++ {
+		_, err := rl.SaveDraft(notices(1)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sending a draft is
+	start := time.Now()
+	err := rl.SendDraft("w1bureau@example.org", "draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rateLimited(t, rl.SendDraft("w1bureau@example.org", "draft"), start.Add(time.Minute))
+	rateLimited(t, rl.Send(notices(1)[0]), start.Add(time.Minute))
+	if s.drafts != 2 || s.sent != 1 {
+		t.Errorf("saved %d drafts and sent %d, want 2 and 1", s.drafts, s.sent)
+	}
+
+	// a backend that can't save drafts
+	_, err = email.NewRateLimitedSender(&countingSender{}, 0, 0, 0, nil).SaveDraft(notices(1)[0])
+	if !errors.Is(err, email.ErrNoDrafts) {
+		t.Errorf("error %v, want ErrNoDrafts", err)
+	}
+}
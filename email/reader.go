@@ -0,0 +1,206 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PidTagMessageClass, the Outlook item class
+const messageClassProperty = "String 0x001A"
+
+// ErrUnreadableReport is returned by DeliveryReport for a message that couldn't be parsed,
+// reading it again won't help
+var ErrUnreadableReport = errors.New("delivery report can't be read")
+
+// ReceivedMessage is a message in the mailbox
+type ReceivedMessage struct {
+	ID            string
+	Subject       string
+	From          string
+	Received      time.Time
+	Preview       string   // first part of the body as text
+	ContentType   string   // from the message headers, tells delivery reports apart
+	AutoSubmitted string   // Auto-Submitted header, set by auto-replies
+	MessageClass  string   // Outlook item class, like IPM.Note
+	References    []string // Message-IDs, without angle brackets, from the In-Reply-To and References headers
+}
+
+// Answers is true if the message is a reply to, or follows on from, the message with Message-ID messageID
+func (m *ReceivedMessage) Answers(messageID string) bool {
+	messageID = strings.Trim(messageID, "<> ")
+	if messageID == "" {
+		return false
+	}
+
+	for _, r := range m.References {
+		if r == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDeliveryReport is true if the message is a delivery status notification, see Reader.DeliveryReport,
+// or Outlook's non-delivery report, which doesn't always keep the multipart/report content type
+func (m *ReceivedMessage) IsDeliveryReport() bool {
+	return isReport(m.ContentType, "delivery-status") || strings.HasPrefix(strings.ToLower(m.MessageClass), "report.ipm.note.ndr")
+}
+
+// IsAutomatic is true if the message was sent by the recipient's mail system rather than the recipient,
+// like read receipts, out of office and other auto-replies
+func (m *ReceivedMessage) IsAutomatic() bool {
+	if isReport(m.ContentType, "disposition-notification") {
+		return true
+	}
+	if v := strings.ToLower(strings.TrimSpace(m.AutoSubmitted)); v != "" && v != "no" {
+		return true
+	}
+
+	// Outlook's out of office and rule replies, and its read and not read notifications
+	class := strings.ToLower(m.MessageClass)
+	return strings.HasPrefix(class, "ipm.note.rules.") || strings.HasPrefix(class, "report.ipm.note.ipnrn") ||
+		strings.HasPrefix(class, "report.ipm.note.ipnnrn")
+}
+
+// Reader is implemented by the email backends that can read the sending mailbox
+type Reader interface {
+	// MessagesReceived returns the messages received since, oldest first
+	MessagesReceived(userID string, since time.Time) ([]ReceivedMessage, error)
+
+	// DeliveryReport reads the delivery status notification with message id, see ReceivedMessage.IsDeliveryReport
+	DeliveryReport(userID, id string) (*DeliveryReport, error)
+}
+
+type listMessagesResponse struct {
+	Value []struct {
+		ID                     string         `json:"id"`
+		Subject                string         `json:"subject"`
+		BodyPreview            string         `json:"bodyPreview"`
+		ReceivedDateTime       time.Time      `json:"receivedDateTime"`
+		From                   *recipientType `json:"from"`
+		IsDraft                bool           `json:"isDraft"`
+		InternetMessageHeaders []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"internetMessageHeaders"`
+		SingleValueExtendedProperties []singleValueExtendedPropertyType `json:"singleValueExtendedProperties"`
+	} `json:"value"`
+	NextLink string `json:"@odata.nextLink"`
+}
+
+// odataString quotes s for use in an OData filter
+func odataString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// MessagesReceived returns the messages in the mailbox of userID received since, oldest first.
+// The headers make it a heavy query, so since should be the last time the mailbox was checked.
+func (client *GraphClient) MessagesReceived(userID string, since time.Time) ([]ReceivedMessage, error) {
+	q := url.Values{
+		"$filter": []string{"receivedDateTime ge " + since.UTC().Format(time.RFC3339)},
+		"$select": []string{"id,subject,bodyPreview,receivedDateTime,from,isDraft,internetMessageHeaders"},
+		"$expand": []string{fmt.Sprintf("singleValueExtendedProperties($filter=id eq %s)", odataString(messageClassProperty))},
+		"$top":    []string{"50"},
+	}
+	next := client.userURL(userID) + "/messages?" + q.Encode()
+
+	var messages []ReceivedMessage
+	for next != "" {
+		b, err := client.makeRequest("GET", next, nil)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		var r listMessagesResponse
+		err = json.Unmarshal(b, &r)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		for _, v := range r.Value {
+			if v.IsDraft {
+				continue
+			}
+
+			m := ReceivedMessage{
+				ID:       v.ID,
+				Subject:  v.Subject,
+				Received: v.ReceivedDateTime,
+				Preview:  v.BodyPreview,
+			}
+			if v.From != nil {
+				m.From = strings.ToLower(v.From.EmailAddress.Address)
+			}
+			for _, h := range v.InternetMessageHeaders {
+				switch {
+				case strings.EqualFold(h.Name, "Content-Type"):
+					m.ContentType = h.Value
+				case strings.EqualFold(h.Name, "Auto-Submitted"):
+					m.AutoSubmitted = h.Value
+				case strings.EqualFold(h.Name, "In-Reply-To"), strings.EqualFold(h.Name, "References"):
+					m.References = append(m.References, messageIDs(h.Value)...)
+				}
+			}
+			for _, p := range v.SingleValueExtendedProperties {
+				if strings.EqualFold(p.ID, messageClassProperty) {
+					m.MessageClass = p.Value
+				}
+			}
+			messages = append(messages, m)
+		}
+
+		next = r.NextLink
+	}
+
+	// Graph won't combine some filters with $orderby
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Received.Before(messages[j].Received)
+	})
+
+	return messages, nil
+}
+
+// messageIDs returns the Message-IDs, without angle brackets, in an In-Reply-To or References header
+func messageIDs(s string) []string {
+	var ids []string
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' || r == '\t' || r == '\r' || r == '\n' }) {
+		if id := strings.Trim(f, "<>"); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// isReport is true for the content type of a multipart/report of reportType, like delivery-status
+func isReport(contentType, reportType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "multipart/report" && strings.HasSuffix(strings.ToLower(params["report-type"]), reportType)
+}
+
+// DeliveryReport downloads and parses the delivery status notification with message id in the mailbox of userID
+func (client *GraphClient) DeliveryReport(userID, id string) (*DeliveryReport, error) {
+	raw, err := client.makeRequest("GET", fmt.Sprintf("%s/messages/%s/$value", client.userURL(userID), url.PathEscape(id)), nil)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	dr, err := ParseDSN(raw)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrUnreadableReport, err)
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	dr.ID = id
+
+	return dr, nil
+}
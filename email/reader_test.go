@@ -0,0 +1,76 @@
+package email_test
+
+import (
+	"testing"
+
+	"github.com/bbathe/goboro/email"
+)
+
+func TestReceivedMessageIsAutomatic(t *testing.T) {
+	tests := []struct {
+		name string
+		m    email.ReceivedMessage
+		want bool
+	}{
+		{"reply", email.ReceivedMessage{ContentType: "text/plain; charset=utf-8", MessageClass: "IPM.Note"}, false},
+		{"auto-submitted no", email.ReceivedMessage{AutoSubmitted: "no"}, false},
+		{"delivery report", email.ReceivedMessage{ContentType: "multipart/report; report-type=delivery-status; boundary=x"}, false},
+		{"read receipt", email.ReceivedMessage{ContentType: `multipart/report; report-type="disposition-notification"; boundary=x`}, true},
+		{"auto-replied", email.ReceivedMessage{AutoSubmitted: "auto-replied"}, true},
+		{"out of office", email.ReceivedMessage{MessageClass: "IPM.Note.Rules.OofTemplate.Microsoft"}, true},
+		{"rule reply", email.ReceivedMessage{MessageClass: "IPM.Note.Rules.ReplyTemplate.Microsoft"}, true},
+		{"Outlook read notification", email.ReceivedMessage{MessageClass: "REPORT.IPM.Note.IPNRN"}, true},
+		{"Outlook not read notification", email.ReceivedMessage{MessageClass: "REPORT.IPM.Note.IPNNRN"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.IsAutomatic(); got != tt.want {
+				t.Errorf("IsAutomatic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceivedMessageIsDeliveryReport(t *testing.T) {
+	tests := []struct {
+		name string
+		m    email.ReceivedMessage
+		want bool
+	}{
+		{"reply", email.ReceivedMessage{ContentType: "text/plain; charset=utf-8", MessageClass: "IPM.Note"}, false},
+		{"delivery status notification", email.ReceivedMessage{ContentType: "multipart/report; report-type=delivery-status; boundary=x"}, true},
+		{"read receipt", email.ReceivedMessage{ContentType: `multipart/report; report-type="disposition-notification"; boundary=x`}, false},
+		{"Outlook non-delivery report", email.ReceivedMessage{MessageClass: "REPORT.IPM.Note.NDR"}, true},
+		{"Outlook read notification", email.ReceivedMessage{MessageClass: "REPORT.IPM.Note.IPNRN"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.IsDeliveryReport(); got != tt.want {
+				t.Errorf("IsDeliveryReport() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceivedMessageAnswers(t *testing.T) {
+	m := email.ReceivedMessage{References: []string{"abc@goboro", "def@example.com"}}
+
+	tests := []struct {
+		name      string
+		messageID string
+		want      bool
+	}{
+		{"bare", "abc@goboro", true},
+		{"angle brackets", "<def@example.com>", true},
+		{"other message", "ghi@goboro", false},
+		{"no Message-ID", "", false},
+		{"empty brackets", "<>", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Answers(tt.messageID); got != tt.want {
+				t.Errorf("Answers(%q) = %v, want %v", tt.messageID, got, tt.want)
+			}
+		})
+	}
+}
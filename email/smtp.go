@@ -0,0 +1,291 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SMTP connection security
+	SecuritySTARTTLS = "starttls" // plain connection upgraded with STARTTLS, usually port 587
+	SecurityTLS      = "tls"      // implicit TLS, usually port 465
+	SecurityNone     = "none"     // no encryption, only for local relays
+
+	// SMTP authentication mechanisms
+	AuthPlain = "plain"
+	AuthLogin = "login"
+)
+
+var errNoStartTLS = errors.New("SMTP server does not support STARTTLS")
+
+// SMTPClient sends email by SMTP submission
+type SMTPClient struct {
+	host     string
+	port     int
+	security string
+	auth     string
+	username string
+	password string
+
+	timeout time.Duration
+	rootCAs *x509.CertPool // nil for the system roots
+}
+
+// NewSMTPClient creates a new SMTP submission client
+func NewSMTPClient(host string, port int, security, auth, username, password string) (*SMTPClient, error) {
+	switch security {
+	case SecuritySTARTTLS, SecurityTLS, SecurityNone:
+	default:
+		err := fmt.Errorf("unknown SMTP security %q", security)
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	switch auth {
+	case AuthPlain, AuthLogin, "":
+	default:
+		err := fmt.Errorf("unknown SMTP auth %q", auth)
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	client := &SMTPClient{
+		host:     host,
+		port:     port,
+		security: security,
+		auth:     auth,
+		username: username,
+		password: password,
+		timeout:  15 * time.Second,
+	}
+
+	return client, nil
+}
+
+// TrustRoots makes the client trust the certificates in pool instead of the system roots,
+// for local relays and stand-ins with their own certificates
+func (client *SMTPClient) TrustRoots(pool *x509.CertPool) {
+	client.rootCAs = pool
+}
+
+// connect dials the server and gets the session ready for a transaction
+func (client *SMTPClient) connect() (*smtp.Client, error) {
+	addr := net.JoinHostPort(client.host, strconv.Itoa(client.port))
+	tlsConfig := &tls.Config{
+		ServerName: client.host,
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    client.rootCAs,
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: client.timeout}
+	if client.security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	// whole session has to finish within the timeout
+	err = conn.SetDeadline(time.Now().Add(client.timeout * 4))
+	if err != nil {
+		conn.Close()
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, client.host)
+	if err != nil {
+		conn.Close()
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	if client.security == SecuritySTARTTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			log.Printf("%+v", errNoStartTLS)
+			return nil, errNoStartTLS
+		}
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			c.Close()
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	if client.username != "" {
+		var a smtp.Auth
+		if client.auth == AuthLogin {
+			a = &loginAuth{
+				username: client.username,
+				password: client.password,
+				host:     client.host,
+			}
+		} else {
+			a = smtp.PlainAuth("", client.username, client.password, client.host)
+		}
+
+		err = c.Auth(a)
+		if err != nil {
+			c.Close()
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Send delivers msg to the SMTP server for relay
+func (client *SMTPClient) Send(msg *Message) error {
+	if !msg.DeliverAt.IsZero() {
+		log.Printf("%+v", errNoDeferredDelivery)
+		return errNoDeferredDelivery
+	}
+
+	err := msg.validateAttachments()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	data, err := msg.buildMIME(time.Now(), false)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	c, err := client.connect()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	defer c.Close()
+
+	err = c.Mail(msg.From)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	// delivery receipts are DSNs, RFC 3461, the server has to support them
+	notify := msg.DeliveryReceipt
+	if notify {
+		if ok, _ := c.Extension("DSN"); !ok {
+			log.Printf("%s doesn't support delivery status notifications, no delivery receipt will be sent", client.host)
+			notify = false
+		}
+	}
+
+	// Bcc recipients only appear in the envelope
+	for _, to := range msg.recipients() {
+		err = rcpt(c, to, notify)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = c.Quit()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// rcpt adds recipient to, asking for a notification when it's delivered as well as when it fails if notify is true
+func rcpt(c *smtp.Client, to string, notify bool) error {
+	if !notify {
+		return c.Rcpt(to)
+	}
+
+	// net/smtp has no way to add RCPT parameters
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	id, err := c.Text.Cmd("RCPT TO:<%s> NOTIFY=SUCCESS,FAILURE", to)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	_, _, err = c.Text.ReadResponse(25)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// loginAuth implements the LOGIN authentication mechanism, net/smtp only has PLAIN and CRAM-MD5
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// same rule as smtp.PlainAuth, don't send credentials in the clear except to localhost
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	prompt := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "password"):
+		return []byte(a.password), nil
+	}
+
+	return nil, fmt.Errorf("unexpected LOGIN prompt %q", fromServer)
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,315 @@
+package email_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+	"github.com/bbathe/goboro/email/emailtest"
+)
+
+// newSMTPServer starts a stand-in that is stopped when the test ends
+func newSMTPServer(t *testing.T, implicitTLS bool) *emailtest.SMTPServer {
+	t.Helper()
+
+	var s *emailtest.SMTPServer
+	var err error
+	if implicitTLS {
+		s, err = emailtest.NewTLSSMTPServer()
+	} else {
+		s, err = emailtest.NewSMTPServer()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// newSMTPClient creates a client for server s that trusts its certificate
+func newSMTPClient(t *testing.T, s *emailtest.SMTPServer, security, auth string) *email.SMTPClient {
+	t.Helper()
+
+	host, p, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := email.NewSMTPClient(host, port, security, auth, "k1abc", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TrustRoots(s.RootCAs())
+
+	return client
+}
+
+// onlyMessage returns the one message s received
+func onlyMessage(t *testing.T, s *emailtest.SMTPServer) emailtest.SMTPMessage {
+	t.Helper()
+
+	messages := s.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(messages))
+	}
+	return messages[0]
+}
+
+func TestSMTPAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		security string
+		auth     string
+		wantTLS  bool
+	}{
+		{"plain", email.SecurityNone, email.AuthPlain, false},
+		{"login", email.SecurityNone, email.AuthLogin, false},
+		{"plain starttls", email.SecuritySTARTTLS, email.AuthPlain, true},
+		{"login starttls", email.SecuritySTARTTLS, email.AuthLogin, true},
+		{"plain tls", email.SecurityTLS, email.AuthPlain, true},
+		{"login tls", email.SecurityTLS, email.AuthLogin, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSMTPServer(t, tt.security == email.SecurityTLS)
+			client := newSMTPClient(t, s, tt.security, tt.auth)
+
+			err := client.Send(&email.Message{
+				From:    "w1bureau@example.org",
+				To:      []string{"k1abc@example.com"},
+				Subject: "QSL cards waiting",
+				Body:    "Your cards are here.",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := onlyMessage(t, s)
+			if m.Username != "k1abc" {
+				t.Errorf("authenticated as %q, want k1abc", m.Username)
+			}
+			if m.TLS != tt.wantTLS {
+				t.Errorf("TLS = %v, want %v", m.TLS, tt.wantTLS)
+			}
+			if m.From != "w1bureau@example.org" {
+				t.Errorf("envelope sender %q, want w1bureau@example.org", m.From)
+			}
+		})
+	}
+}
+
+func TestSMTPBccOnlyInEnvelope(t *testing.T) {
+	s := newSMTPServer(t, false)
+	client := newSMTPClient(t, s, email.SecuritySTARTTLS, email.AuthPlain)
+
+	err := client.Send(&email.Message{
+		From:    "w1bureau@example.org",
+		To:      []string{"k1abc@example.com"},
+		Cc:      []string{"n1xyz@example.com"},
+		Bcc:     []string{"w1log@example.org"},
+		Subject: "QSL cards waiting",
+		Body:    "Your cards are here.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := onlyMessage(t, s)
+	want := []string{"k1abc@example.com", "n1xyz@example.com", "w1log@example.org"}
+	if !slices.Equal(m.To, want) {
+		t.Errorf("envelope recipients %v, want %v", m.To, want)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("Bcc header %q sent", msg.Header.Get("Bcc"))
+	}
+	if bytes.Contains(m.Data, []byte("w1log@example.org")) {
+		t.Error("Bcc address in the message content")
+	}
+	if msg.Header.Get("Cc") != "<n1xyz@example.com>" {
+		t.Errorf("Cc header %q, want <n1xyz@example.com>", msg.Header.Get("Cc"))
+	}
+}
+
+func TestSMTPHTMLWithAttachment(t *testing.T) {
+	s := newSMTPServer(t, false)
+	client := newSMTPClient(t, s, email.SecuritySTARTTLS, email.AuthLogin)
+
+	logData := []byte("QSO log\r\nK1ABC 20m SSB\r\n")
+	err := client.Send(&email.Message{
+		From:    "w1bureau@example.org",
+		To:      []string{"k1abc@example.com"},
+		Subject: "QSL cards waiting",
+		Body:    "<html><body><p>Your cards are <b>here</b>.</p></body></html>",
+		HTML:    true,
+		Attachments: []email.Attachment{
+			{Name: "log.txt", ContentType: "text/plain", Data: logData},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(onlyMessage(t, s).Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := readMultipart(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/mixed")
+	if len(parts) != 2 {
+		t.Fatalf("multipart/mixed has %d parts, want 2", len(parts))
+	}
+
+	// body, text generated from the HTML then the HTML
+	alternative := readMultipart(t, parts[0].header.Get("Content-Type"), bytes.NewReader(parts[0].body), "multipart/alternative")
+	if len(alternative) != 2 {
+		t.Fatalf("multipart/alternative has %d parts, want 2", len(alternative))
+	}
+	for i, want := range []string{"text/plain", "text/html"} {
+		mediaType, _, _ := mime.ParseMediaType(alternative[i].header.Get("Content-Type"))
+		if mediaType != want {
+			t.Errorf("alternative part %d is %s, want %s", i, mediaType, want)
+		}
+	}
+	if text := string(alternative[0].body); !strings.Contains(text, "Your cards are here.") || strings.Contains(text, "<b>") {
+		t.Errorf("text part %q", text)
+	}
+	if html := string(alternative[1].body); !strings.Contains(html, "<b>here</b>") {
+		t.Errorf("HTML part %q", html)
+	}
+
+	// attachment
+	_, params, err := mime.ParseMediaType(parts[1].header.Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["filename"] != "log.txt" {
+		t.Errorf("attachment filename %q, want log.txt", params["filename"])
+	}
+	if got := parts[1].header.Get("Content-Transfer-Encoding"); got != "base64" {
+		t.Errorf("attachment encoding %q, want base64", got)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(parts[1].body), "\r\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, logData) {
+		t.Errorf("attachment %q, want %q", data, logData)
+	}
+}
+
+func TestSMTPReceipts(t *testing.T) {
+	s := newSMTPServer(t, false)
+	client := newSMTPClient(t, s, email.SecuritySTARTTLS, email.AuthPlain)
+
+	err := client.Send(&email.Message{
+		From:            "w1bureau@example.org",
+		To:              []string{"k1abc@example.com"},
+		Bcc:             []string{"w1log@example.org"},
+		Subject:         "Final notice",
+		Body:            "Your cards will be returned.",
+		Importance:      email.ImportanceHigh,
+		ReadReceipt:     true,
+		DeliveryReceipt: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := onlyMessage(t, s)
+	for i, notify := range m.Notify {
+		if notify != "SUCCESS,FAILURE" {
+			t.Errorf("NOTIFY for %s is %q, want SUCCESS,FAILURE", m.To[i], notify)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Disposition-Notification-To"); got != "<w1bureau@example.org>" {
+		t.Errorf("Disposition-Notification-To %q, want <w1bureau@example.org>", got)
+	}
+	if got := msg.Header.Get("Importance"); got != "high" {
+		t.Errorf("Importance %q, want high", got)
+	}
+}
+
+func TestSMTPNoDeferredDelivery(t *testing.T) {
+	s := newSMTPServer(t, false)
+	client := newSMTPClient(t, s, email.SecuritySTARTTLS, email.AuthPlain)
+
+	err := client.Send(&email.Message{
+		From:      "w1bureau@example.org",
+		To:        []string{"k1abc@example.com"},
+		Subject:   "QSL cards waiting",
+		Body:      "Your cards are here.",
+		DeliverAt: time.Now().Add(time.Hour),
+	})
+	var nde *email.NoDeferredDeliveryError
+	if !errors.As(err, &nde) || !nde.Permanent() {
+		t.Errorf("%v, want a permanent NoDeferredDeliveryError", err)
+	}
+	if n := len(s.Messages()); n != 0 {
+		t.Errorf("server received %d messages, want 0", n)
+	}
+}
+
+// mimePart is a part of a multipart entity, its body decoded from quoted-printable
+type mimePart struct {
+	header mail.Header
+	body   []byte
+}
+
+// readMultipart reads the parts of a multipart entity that has to be of mediaType
+func readMultipart(t *testing.T, contentType string, r io.Reader, mediaType string) []mimePart {
+	t.Helper()
+
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != mediaType {
+		t.Fatalf("content type %s, want %s", mt, mediaType)
+	}
+
+	var parts []mimePart
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, mimePart{header: mail.Header(p.Header), body: body})
+	}
+
+	return parts
+}
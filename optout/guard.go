@@ -0,0 +1,84 @@
+package optout
+
+import (
+	"log"
+
+	"github.com/bbathe/goboro/email"
+)
+
+// GuardedSender sits in front of an email backend and refuses to send to anyone on the list,
+// so messages queued before a station opted out aren't sent either
+type GuardedSender struct {
+	sender   email.Sender
+	registry *Registry
+}
+
+// Guard wraps sender so it checks registry before every message
+func Guard(registry *Registry, sender email.Sender) *GuardedSender {
+	return &GuardedSender{
+		sender:   sender,
+		registry: registry,
+	}
+}
+
+// check returns an OptedOutError if msg is to a station or address on the list
+func (g *GuardedSender) check(msg *email.Message) error {
+	addresses := append(append(append([]string(nil), msg.To...), msg.Cc...), msg.Bcc...)
+	if e := g.registry.Check(msg.Callsign, addresses); e != nil {
+		return &OptedOutError{Entry: *e}
+	}
+	return nil
+}
+
+// Send sends msg through the backend unless it's to someone on the list
+func (g *GuardedSender) Send(msg *email.Message) error {
+	err := g.check(msg)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return g.sender.Send(msg)
+}
+
+// SendBatch sends the messages that aren't to anyone on the list, through the backend's
+// batch sending if it has it
+func (g *GuardedSender) SendBatch(msgs []*email.Message) []error {
+	return email.SendAllowed(g.sender, msgs, func(_ int, msg *email.Message) error {
+		err := g.check(msg)
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+		return err
+	})
+}
+
+// SaveDraft saves msg in the Drafts folder through the backend unless it's to someone on the list,
+// a draft is only a step away from being sent
+func (g *GuardedSender) SaveDraft(msg *email.Message) (*email.Draft, error) {
+	drafter, ok := g.sender.(email.Drafter)
+	if !ok {
+		log.Printf("%+v", email.ErrNoDrafts)
+		return nil, email.ErrNoDrafts
+	}
+
+	err := g.check(msg)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return drafter.SaveDraft(msg)
+}
+
+// SendDraft sends the draft id from the Drafts folder of userID through the backend,
+// it was checked against the list when it was saved
+func (g *GuardedSender) SendDraft(userID, id string) error {
+	drafter, ok := g.sender.(email.Drafter)
+	if !ok {
+		log.Printf("%+v", email.ErrNoDrafts)
+		return email.ErrNoDrafts
+	}
+
+	return drafter.SendDraft(userID, id)
+}
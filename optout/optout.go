@@ -0,0 +1,300 @@
+package optout
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbathe/goboro/atomicfile"
+)
+
+// date format in import and export files
+const dateFormat = "2006-01-02"
+
+var (
+	errNoKey     = errors.New("opt-out needs a callsign or an email address")
+	errNotFound  = errors.New("no such opt-out")
+	importHeader = []string{"callsign", "address", "reason", "date"}
+)
+
+// Entry is a station, or an address, that asked not to be emailed
+type Entry struct {
+	Callsign string `json:",omitempty"`
+	Address  string `json:",omitempty"`
+	Reason   string
+	Added    time.Time
+}
+
+// key identifies the entry, the callsign, or the address when it's only for an address
+func (e *Entry) key() string {
+	if e.Callsign != "" {
+		return e.Callsign
+	}
+	return e.Address
+}
+
+// OptedOutError is returned instead of sending to a station or address that opted out
+type OptedOutError struct {
+	Entry Entry
+}
+
+func (e *OptedOutError) Error() string {
+	who := e.Entry.Callsign
+	if who == "" {
+		who = e.Entry.Address
+	}
+	s := fmt.Sprintf("%s asked not to be emailed (%s)", who, e.Entry.Added.Local().Format("Jan 2 2006"))
+	if e.Entry.Reason != "" {
+		s += ": " + e.Entry.Reason
+	}
+	return s
+}
+
+// Permanent is true, sending again won't help
+func (e *OptedOutError) Permanent() bool {
+	return true
+}
+
+// Registry is the persistent do-not-email list
+type Registry struct {
+	fname   string
+	entries []Entry
+
+	// mutex for entries
+	m sync.Mutex
+}
+
+// Open loads the registry from file fname, a missing file is an empty registry
+func Open(fname string) (*Registry, error) {
+	r := &Registry{
+		fname: fname,
+	}
+
+	// #nosec G304
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return r, nil
+		}
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &r.entries)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// save writes the entries to file, caller must hold the lock
+func (r *Registry) save() error {
+	b, err := json.MarshalIndent(r.entries, "", "  ")
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = atomicfile.WriteFile(r.fname, b, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// add adds or replaces e, caller must hold the lock
+func (r *Registry) add(e Entry) error {
+	e.Callsign = strings.ToUpper(strings.TrimSpace(e.Callsign))
+	e.Address = strings.ToLower(strings.TrimSpace(e.Address))
+	e.Reason = strings.TrimSpace(e.Reason)
+	if e.key() == "" {
+		return errNoKey
+	}
+	if e.Added.IsZero() {
+		e.Added = time.Now()
+	}
+
+	for i := range r.entries {
+		if r.entries[i].Callsign == e.Callsign && r.entries[i].Address == e.Address {
+			r.entries[i] = e
+			return nil
+		}
+	}
+	r.entries = append(r.entries, e)
+
+	return nil
+}
+
+// Add puts a station or address on the list, an existing entry for it is replaced
+func (r *Registry) Add(e Entry) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	err := r.add(e)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return r.save()
+}
+
+// Remove takes the entries for callsign, or for address when callsign is empty, off the list
+func (r *Registry) Remove(callsign, address string) error {
+	callsign = strings.ToUpper(strings.TrimSpace(callsign))
+	address = strings.ToLower(strings.TrimSpace(address))
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var entries []Entry
+	for _, e := range r.entries {
+		if (callsign != "" && e.Callsign == callsign) || (callsign == "" && e.Callsign == "" && e.Address == address) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == len(r.entries) {
+		return errNotFound
+	}
+	r.entries = entries
+
+	return r.save()
+}
+
+// List returns the entries in the order they were added
+func (r *Registry) List() []Entry {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return append([]Entry(nil), r.entries...)
+}
+
+// Check returns the entry that stops email to callsign or any of addresses, nil if they can be emailed
+func (r *Registry) Check(callsign string, addresses []string) *Entry {
+	callsign = strings.ToUpper(strings.TrimSpace(callsign))
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for _, e := range r.entries {
+		if callsign != "" && e.Callsign == callsign {
+			c := e
+			return &c
+		}
+		for _, a := range addresses {
+			if e.Address != "" && strings.EqualFold(e.Address, strings.TrimSpace(a)) {
+				c := e
+				return &c
+			}
+		}
+	}
+
+	return nil
+}
+
+// Import adds the entries in CSV with columns callsign, address, reason and date (YYYY-MM-DD),
+// a header row is skipped, returns the number of entries added
+func (r *Registry) Import(rd io.Reader) (int, error) {
+	cr := csv.NewReader(rd)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		log.Printf("%+v", err)
+		return 0, err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	// all or nothing
+	saved := append([]Entry(nil), r.entries...)
+
+	n := 0
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && strings.EqualFold(record[0], importHeader[0]) {
+			continue
+		}
+		for len(record) < len(importHeader) {
+			record = append(record, "")
+		}
+
+		e := Entry{
+			Callsign: record[0],
+			Address:  record[1],
+			Reason:   record[2],
+		}
+		if record[3] != "" {
+			e.Added, err = time.ParseInLocation(dateFormat, strings.TrimSpace(record[3]), time.Local)
+			if err != nil {
+				r.entries = saved
+				err = fmt.Errorf("line %d: invalid date %q, expected YYYY-MM-DD", i+1, record[3])
+				log.Printf("%+v", err)
+				return 0, err
+			}
+		}
+
+		err = r.add(e)
+		if err != nil {
+			r.entries = saved
+			err = fmt.Errorf("line %d: %w", i+1, err)
+			log.Printf("%+v", err)
+			return 0, err
+		}
+		n++
+	}
+
+	err = r.save()
+	if err != nil {
+		r.entries = saved
+		log.Printf("%+v", err)
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Export writes the entries as CSV in the format Import reads
+func (r *Registry) Export(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(importHeader)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	for _, e := range r.List() {
+		err = cw.Write([]string{e.Callsign, e.Address, e.Reason, e.Added.Local().Format(dateFormat)})
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// AsksToOptOut tests if the text of a reply contains any of keywords, ignoring case
+func AsksToOptOut(text string, keywords []string) bool {
+	text = strings.ToLower(text)
+	for _, k := range keywords {
+		if k != "" && strings.Contains(text, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
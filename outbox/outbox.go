@@ -0,0 +1,640 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bbathe/goboro/atomicfile"
+	"github.com/bbathe/goboro/email"
+)
+
+// Status is where a message is in delivery
+type Status string
+
+const (
+	Queued  Status = "queued"  // waiting for delivery
+	Sending Status = "sending" // handed to the email backend
+	Sent    Status = "sent"    // accepted by the email backend
+	Failed  Status = "failed"  // gave up, Reason says why
+
+	Canceled Status = "canceled" // sent for deferred delivery, then canceled before it was delivered
+)
+
+const (
+	// delivery attempts before giving up on a message
+	maxAttempts = 5
+
+	// wait after the first failed attempt, doubles with each attempt after that
+	retryBackoff = time.Minute
+
+	// how often to look for messages that are due when nothing wakes the worker
+	pollInterval = 30 * time.Second
+
+	// sent and failed messages are kept this long so their status can be queried
+	keepSent = 30 * 24 * time.Hour
+)
+
+var (
+	errNotFound    = errors.New("no such outbox message")
+	errInterrupted = errors.New("delivery was interrupted, the message may have been sent so it was not retried")
+)
+
+// permanentError is implemented by errors that sending again won't fix
+type permanentError interface {
+	Permanent() bool
+}
+
+// Entry is a message in the outbox, attachment data is dropped once it's sent to keep the file small
+type Entry struct {
+	ID        string
+	Callsign  string
+	Message   email.Message
+	Status    Status
+	Reason    string    // why the last attempt failed
+	Attempts  int       // delivery attempts made
+	NotBefore time.Time // not delivered before this time, for scheduled delivery and retry backoff
+	Created   time.Time
+	Updated   time.Time
+}
+
+// Interrupted tests if the entry failed because goboro stopped while it was being sent,
+// so it may have been delivered and shouldn't be retried without checking
+func (e Entry) Interrupted() bool {
+	return e.Status == Failed && e.Reason == errInterrupted.Error()
+}
+
+// Outbox is the durable queue of composed messages, every change is written to file
+// before it's acted on so nothing is lost or sent twice across restarts
+type Outbox struct {
+	fname   string
+	entries []*Entry
+
+	// called after an entry changes status
+	onChange func(Entry)
+
+	// wakes the worker when a message is queued
+	wake chan struct{}
+
+	// mutex for entries
+	m sync.Mutex
+}
+
+// Open loads the outbox from file fname, a missing file is an empty outbox
+func Open(fname string) (*Outbox, error) {
+	o := &Outbox{
+		fname: fname,
+		wake:  make(chan struct{}, 1),
+	}
+
+	// #nosec G304
+	b, err := os.ReadFile(fname)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &o.entries)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	var entries []*Entry
+	for _, e := range o.entries {
+		switch e.Status {
+		case Sending:
+			// can't know if the backend got it before we stopped, don't risk sending twice
+			e.Status = Failed
+			e.Reason = errInterrupted.Error()
+			e.Updated = now
+		case Sent, Canceled:
+			if now.Sub(e.Updated) > keepSent {
+				continue
+			}
+			e.Message.Attachments = withoutData(e.Message.Attachments)
+		case Failed:
+			if now.Sub(e.Updated) > keepSent {
+				continue
+			}
+		}
+		entries = append(entries, e)
+	}
+	o.entries = entries
+
+	err = o.save()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// save writes the entries to file, caller must hold the lock
+func (o *Outbox) save() error {
+	b, err := json.MarshalIndent(o.entries, "", "  ")
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = atomicfile.WriteFile(o.fname, b, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// OnChange sets the function called, from the worker goroutine, after an entry changes status
+func (o *Outbox) OnChange(f func(Entry)) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	o.onChange = f
+}
+
+// Enqueue adds msg to the outbox for delivery at or after notBefore.
+// msg is given its tracking headers and Message-ID so the sent message can be linked back to the entry,
+// msg.NoticeID is the entry's ID to query its status with.
+func (o *Outbox) Enqueue(callsign string, msg *email.Message, notBefore time.Time) error {
+	e, err := newEntry(callsign, msg, notBefore)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	o.m.Lock()
+	o.entries = append(o.entries, e)
+	err = o.save()
+	o.m.Unlock()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	o.notify()
+
+	return nil
+}
+
+// newEntry creates a queued entry for msg with a new ID, Message-ID and tracking headers
+func newEntry(callsign string, msg *email.Message, notBefore time.Time) (*Entry, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+
+	// always a new message, even when resending an old one
+	msg.Callsign = callsign
+	msg.NoticeID = id
+	msg.MessageID = ""
+	_, err = msg.AssignMessageID()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	e := &Entry{
+		ID:        id,
+		Callsign:  callsign,
+		Message:   *msg,
+		Status:    Queued,
+		NotBefore: notBefore,
+		Created:   now,
+		Updated:   now,
+	}
+
+	return e, nil
+}
+
+// Get returns the entry with id
+func (o *Outbox) Get(id string) (Entry, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for _, e := range o.entries {
+		if e.ID == id {
+			return *e, nil
+		}
+	}
+
+	return Entry{}, errNotFound
+}
+
+// List returns all the entries, oldest first
+func (o *Outbox) List() []Entry {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	entries := make([]Entry, len(o.entries))
+	for i, e := range o.entries {
+		entries[i] = *e
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+
+	return entries
+}
+
+// Retry puts a failed entry back in the queue
+func (o *Outbox) Retry(id string) error {
+	o.m.Lock()
+	err := o.update(id, func(e *Entry) error {
+		if e.Status != Failed {
+			return fmt.Errorf("outbox message is %s, only failed messages can be retried", e.Status)
+		}
+		e.Status = Queued
+		e.Attempts = 0
+		e.NotBefore = time.Time{}
+		return nil
+	})
+	o.m.Unlock()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	o.notify()
+
+	return nil
+}
+
+// ClearFailed removes the failed entries
+func (o *Outbox) ClearFailed() error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var entries []*Entry
+	for _, e := range o.entries {
+		if e.Status != Failed {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == len(o.entries) {
+		return nil
+	}
+	o.entries = entries
+
+	return o.save()
+}
+
+// Cancel removes an entry that hasn't been sent yet
+func (o *Outbox) Cancel(id string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	for i, e := range o.entries {
+		if e.ID == id {
+			if e.Status == Sending || e.Status == Sent {
+				err := fmt.Errorf("outbox message is %s, it can't be canceled", e.Status)
+				log.Printf("%+v", err)
+				return err
+			}
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			return o.save()
+		}
+	}
+
+	return errNotFound
+}
+
+// CancelDelivery marks the sent message with Internet Message-ID messageID as canceled, for when its deferred
+// delivery is canceled, so it's no longer counted as sent
+func (o *Outbox) CancelDelivery(messageID string) error {
+	o.m.Lock()
+	var found *Entry
+	for _, e := range o.entries {
+		if e.Status == Sent && e.Message.MessageID == messageID {
+			found = e
+			break
+		}
+	}
+	if found == nil {
+		o.m.Unlock()
+		return errNotFound
+	}
+
+	err := o.update(found.ID, func(e *Entry) error {
+		e.Status = Canceled
+		return nil
+	})
+	entry := *found
+	o.m.Unlock()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	o.changed(entry)
+
+	return nil
+}
+
+// update applies f to the entry with id and saves, caller must hold the lock
+func (o *Outbox) update(id string, f func(*Entry) error) error {
+	for _, e := range o.entries {
+		if e.ID == id {
+			err := f(e)
+			if err != nil {
+				return err
+			}
+			e.Updated = time.Now()
+			return o.save()
+		}
+	}
+
+	return errNotFound
+}
+
+// notify wakes the worker without blocking
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// changed tells the onChange function about entry e
+func (o *Outbox) changed(e Entry) {
+	o.m.Lock()
+	f := o.onChange
+	o.m.Unlock()
+
+	if f != nil {
+		f(e)
+	}
+}
+
+// next marks the next due entry as sending and returns it, nil if nothing is due
+func (o *Outbox) next(now time.Time) (*Entry, error) {
+	batch, err := o.nextBatch(now, 1)
+	if err != nil || len(batch) == 0 {
+		return nil, err
+	}
+
+	return batch[0], nil
+}
+
+// nextBatch marks up to n due entries as sending and returns them, saving once for them all
+func (o *Outbox) nextBatch(now time.Time, n int) ([]*Entry, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var batch []*Entry
+	for _, e := range o.entries {
+		if len(batch) == n {
+			break
+		}
+		if e.Status == Queued && !e.NotBefore.After(now) {
+			e.Status = Sending
+			e.Attempts++
+			e.Updated = time.Now()
+
+			c := *e
+			batch = append(batch, &c)
+		}
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	// recorded before delivery starts, see Open
+	err := o.save()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// finish records the outcome of a delivery attempt, returns the entry as it was sent, with its attachments
+func (o *Outbox) finish(id string, sendErr error) (Entry, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var attachments []email.Attachment
+	err := o.update(id, func(e *Entry) error {
+		if sendErr == nil {
+			e.Status = Sent
+			e.Reason = ""
+			attachments = e.Message.Attachments
+			e.Message.Attachments = withoutData(attachments)
+			return nil
+		}
+
+		e.Reason = sendErr.Error()
+
+		// held back by the sender's own limits, not a failed attempt
+		var rle *email.RateLimitError
+		if errors.As(sendErr, &rle) {
+			e.Status = Queued
+			e.Attempts--
+			e.NotBefore = rle.NextAllowed
+			return nil
+		}
+
+		// waiting for the user to sign in again, not a failed attempt either
+		if errors.Is(sendErr, email.ErrSignInRequired) {
+			e.Status = Queued
+			e.Attempts--
+			e.NotBefore = time.Now().Add(retryBackoff)
+			return nil
+		}
+
+		// throttled, Graph says when to try again, not a failed attempt either
+		var ge *email.GraphError
+		isGraph := errors.As(sendErr, &ge)
+		if isGraph && ge.IsThrottled() {
+			e.Status = Queued
+			e.Attempts--
+			e.NotBefore = time.Now().Add(max(ge.RetryAfter, time.Second))
+			return nil
+		}
+
+		// no point retrying what Graph says won't work, or what was refused outright
+		var pe permanentError
+		permanent := (isGraph && !ge.Temporary()) || (errors.As(sendErr, &pe) && pe.Permanent())
+		if e.Attempts >= maxAttempts || permanent {
+			e.Status = Failed
+			return nil
+		}
+
+		e.Status = Queued
+		e.NotBefore = time.Now().Add(retryBackoff << (e.Attempts - 1))
+		if isGraph && ge.RetryAfter > 0 {
+			e.NotBefore = time.Now().Add(ge.RetryAfter)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("%+v", err)
+		return Entry{}, err
+	}
+
+	for _, e := range o.entries {
+		if e.ID == id {
+			finished := *e
+			if attachments != nil {
+				finished.Message.Attachments = attachments
+			}
+			return finished, nil
+		}
+	}
+
+	return Entry{}, errNotFound
+}
+
+// withoutData returns a copy of attachments without their content, they can be loaded again from their path
+func withoutData(attachments []email.Attachment) []email.Attachment {
+	if len(attachments) == 0 {
+		return attachments
+	}
+
+	stripped := make([]email.Attachment, len(attachments))
+	for i, a := range attachments {
+		a.Data = nil
+		stripped[i] = a
+	}
+	return stripped
+}
+
+// deliver sends everything that is due, in batches when the backend can
+func (o *Outbox) deliver(sender email.Sender) {
+	if bs, ok := sender.(email.BatchSender); ok {
+		o.deliverBatches(bs)
+		return
+	}
+
+	for {
+		e, err := o.next(time.Now())
+		if err != nil || e == nil {
+			return
+		}
+
+		sendErr := sender.Send(&e.Message)
+		if sendErr != nil {
+			log.Printf("%+v", sendErr)
+		}
+
+		finished, err := o.finish(e.ID, sendErr)
+		if err != nil {
+			// can't record the outcome, stop rather than risk sending again
+			log.Printf("%+v", err)
+			return
+		}
+
+		o.changed(finished)
+	}
+}
+
+// deliverBatches sends everything that is due a batch at a time
+func (o *Outbox) deliverBatches(bs email.BatchSender) {
+	for {
+		batch, err := o.nextBatch(time.Now(), email.MaxBatchSize)
+		if err != nil || len(batch) == 0 {
+			return
+		}
+
+		msgs := make([]*email.Message, len(batch))
+		for i, e := range batch {
+			msgs[i] = &e.Message
+		}
+		errs := bs.SendBatch(msgs)
+
+		for i, e := range batch {
+			if errs[i] != nil {
+				log.Printf("%+v", errs[i])
+			}
+
+			finished, err := o.finish(e.ID, errs[i])
+			if err != nil {
+				// can't record the outcome, stop rather than risk sending again
+				log.Printf("%+v", err)
+				return
+			}
+
+			o.changed(finished)
+		}
+	}
+}
+
+// nextDue returns when the next queued message is due, the zero time if one is due now,
+// or a time after the poll interval if nothing is queued
+func (o *Outbox) nextDue() time.Time {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	due := time.Now().Add(pollInterval)
+	for _, e := range o.entries {
+		if e.Status == Queued && e.NotBefore.Before(due) {
+			due = e.NotBefore
+		}
+	}
+
+	return due
+}
+
+// SentTimes returns when the messages still in the outbox were sent
+func (o *Outbox) SentTimes() []time.Time {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	var times []time.Time
+	for _, e := range o.entries {
+		if e.Status == Sent {
+			times = append(times, e.Updated)
+		}
+	}
+
+	return times
+}
+
+// Start delivers queued messages using sender in the background, returns a function that stops delivery
+func (o *Outbox) Start(sender email.Sender) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		timer := time.NewTimer(pollInterval)
+		defer timer.Stop()
+
+		for {
+			o.deliver(sender)
+
+			// wake when the next message is due, or poll anyway in case the clock jumped
+			timer.Reset(min(pollInterval, max(time.Until(o.nextDue()), time.Second)))
+
+			select {
+			case <-done:
+				return
+			case <-o.wake:
+			case <-timer.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
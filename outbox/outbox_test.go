@@ -0,0 +1,340 @@
+package outbox
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+)
+
+// recordingSender is an email backend that records what it's asked to send and fails with err
+type recordingSender struct {
+	m    sync.Mutex
+	sent []string
+	err  error
+}
+
+func (s *recordingSender) Send(msg *email.Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, msg.MessageID)
+	return nil
+}
+
+// openOutbox opens the outbox file in the test's temporary directory
+func openOutbox(t *testing.T, dir string) *Outbox {
+	t.Helper()
+
+	o, err := Open(filepath.Join(dir, "outbox.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// enqueue queues a message to station to, returning its entry
+func enqueue(t *testing.T, o *Outbox, to string) Entry {
+	t.Helper()
+
+	msg := &email.Message{
+		From:    "w1bureau@example.org",
+		To:      []string{to},
+		Subject: "QSL cards waiting",
+		Body:    "Your cards are here.",
+		Attachments: []email.Attachment{
+			{Name: "card.jpg", ContentType: "image/jpeg", Data: []byte("jpeg")},
+		},
+	}
+	err := o.Enqueue("K1ABC", msg, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := o.Get(msg.NoticeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestOutboxRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	o := openOutbox(t, dir)
+	queued := enqueue(t, o, "k1abc@example.com")
+	sent := enqueue(t, o, "n1xyz@example.com")
+
+	s := &recordingSender{}
+	e, err := o.next(time.Now())
+	if err != nil || e == nil || e.ID != queued.ID {
+		t.Fatalf("next() = %v, %v, want %s", e, err, queued.ID)
+	}
+	// put back so only the second one is sent
+	_, err = o.finish(e.ID, &email.RateLimitError{Limit: "test", NextAllowed: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.deliver(s)
+	if len(s.sent) != 1 || s.sent[0] != sent.Message.MessageID {
+		t.Fatalf("sent %v, want %s", s.sent, sent.Message.MessageID)
+	}
+
+	o = openOutbox(t, dir)
+	got, err := o.Get(queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != Queued || got.Message.MessageID != queued.Message.MessageID || got.Attempts != 0 {
+		t.Errorf("queued entry after restart = %s, %s, %d attempts", got.Status, got.Message.MessageID, got.Attempts)
+	}
+	if len(got.Message.Attachments) != 1 || string(got.Message.Attachments[0].Data) != "jpeg" {
+		t.Errorf("queued entry lost its attachment")
+	}
+
+	got, err = o.Get(sent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != Sent {
+		t.Errorf("sent entry after restart is %s", got.Status)
+	}
+	if len(got.Message.Attachments) != 1 || got.Message.Attachments[0].Data != nil {
+		t.Errorf("sent entry kept its attachment data")
+	}
+	if times := o.SentTimes(); len(times) != 1 {
+		t.Errorf("%d sent times after restart, want 1", len(times))
+	}
+}
+
+func TestOutboxInterrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	o := openOutbox(t, dir)
+	queued := enqueue(t, o, "k1abc@example.com")
+
+	// stopped while the backend had it
+	e, err := o.next(time.Now())
+	if err != nil || e == nil {
+		t.Fatalf("next() = %v, %v", e, err)
+	}
+
+	o = openOutbox(t, dir)
+	got, err := o.Get(queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != Failed || got.Reason != errInterrupted.Error() || !got.Interrupted() {
+		t.Errorf("interrupted entry after restart = %s, %q", got.Status, got.Reason)
+	}
+
+	s := &recordingSender{}
+	o.deliver(s)
+	if len(s.sent) != 0 {
+		t.Errorf("interrupted message sent again")
+	}
+
+	// until the user says so
+	err = o.Retry(queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.deliver(s)
+	if len(s.sent) != 1 {
+		t.Errorf("retried message sent %d times, want 1", len(s.sent))
+	}
+}
+
+func TestOutboxNextBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	o := openOutbox(t, dir)
+	first := enqueue(t, o, "k1abc@example.com")
+	second := enqueue(t, o, "n1xyz@example.com")
+	third := enqueue(t, o, "w1aw@example.com")
+	err := o.Enqueue("K1ABC", &email.Message{To: []string{"k1abc@example.com"}, Subject: "QSL"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := o.nextBatch(time.Now(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0].ID != first.ID || batch[1].ID != second.ID {
+		t.Fatalf("nextBatch(2) = %v, want %s and %s", batch, first.ID, second.ID)
+	}
+	for _, e := range batch {
+		if e.Status != Sending || e.Attempts != 1 {
+			t.Errorf("batch entry %s is %s after %d attempts", e.ID, e.Status, e.Attempts)
+		}
+	}
+
+	// the rest that's due, not the one held back
+	batch, err = o.nextBatch(time.Now(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 1 || batch[0].ID != third.ID {
+		t.Fatalf("nextBatch(5) = %v, want %s", batch, third.ID)
+	}
+
+	// the whole batch was saved as sending before delivery started
+	o = openOutbox(t, dir)
+	for _, id := range []string{first.ID, second.ID, third.ID} {
+		got, err := o.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Interrupted() {
+			t.Errorf("entry %s after restart is %s, want interrupted", id, got.Status)
+		}
+	}
+}
+
+func TestOutboxClearFailed(t *testing.T) {
+	dir := t.TempDir()
+
+	o := openOutbox(t, dir)
+	failed := enqueue(t, o, "k1abc@example.com")
+	queued := enqueue(t, o, "n1xyz@example.com")
+
+	e, err := o.next(time.Now())
+	if err != nil || e == nil || e.ID != failed.ID {
+		t.Fatalf("next() = %v, %v, want %s", e, err, failed.ID)
+	}
+	_, err = o.finish(e.ID, &email.NoDeferredDeliveryError{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := o.Get(failed.ID); got.Status != Failed || got.Interrupted() {
+		t.Fatalf("entry = %s, interrupted %v, want failed", got.Status, got.Interrupted())
+	}
+
+	err = o.ClearFailed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Get(failed.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("failed entry not cleared: %v", err)
+	}
+	if _, err := o.Get(queued.ID); err != nil {
+		t.Errorf("queued entry cleared: %v", err)
+	}
+
+	// and it stays cleared
+	o = openOutbox(t, dir)
+	if n := len(o.List()); n != 1 {
+		t.Errorf("%d entries after restart, want 1", n)
+	}
+}
+
+func TestOutboxFailedAgedOut(t *testing.T) {
+	dir := t.TempDir()
+
+	o := openOutbox(t, dir)
+	old := enqueue(t, o, "k1abc@example.com")
+	recent := enqueue(t, o, "n1xyz@example.com")
+
+	o.m.Lock()
+	for _, e := range o.entries {
+		e.Status = Failed
+		if e.ID == old.ID {
+			e.Updated = time.Now().Add(-keepSent - time.Hour)
+		}
+	}
+	err := o.save()
+	o.m.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o = openOutbox(t, dir)
+	if _, err := o.Get(old.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("old failed entry kept: %v", err)
+	}
+	if _, err := o.Get(recent.ID); err != nil {
+		t.Errorf("recent failed entry dropped: %v", err)
+	}
+}
+
+func TestOutboxFinish(t *testing.T) {
+	nextAllowed := time.Now().Add(10 * time.Minute).Round(time.Second)
+
+	tests := []struct {
+		name         string
+		attempts     int // attempts made before this one
+		err          error
+		wantStatus   Status
+		wantAttempts int
+		wantDelay    time.Duration // NotBefore from now, 0 to skip the check
+	}{
+		{"sent", 0, nil, Sent, 1, 0},
+		{"first failure", 0, errors.New("connection reset"), Queued, 1, retryBackoff},
+		{"third failure", 2, errors.New("connection reset"), Queued, 3, 4 * retryBackoff},
+		{"last failure", maxAttempts - 1, errors.New("connection reset"), Failed, maxAttempts, 0},
+		{"server error", 0, &email.GraphError{StatusCode: http.StatusServiceUnavailable}, Queued, 1, retryBackoff},
+		{"server error retry after", 0, &email.GraphError{StatusCode: http.StatusServiceUnavailable, RetryAfter: 5 * time.Minute}, Queued, 1, 5 * time.Minute},
+		{"throttled", maxAttempts - 1, &email.GraphError{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Minute}, Queued, maxAttempts - 1, 2 * time.Minute},
+		{"throttled no retry after", 0, &email.GraphError{Code: "ApplicationThrottled", StatusCode: http.StatusServiceUnavailable}, Queued, 0, time.Second},
+		{"rate limited", maxAttempts - 1, &email.RateLimitError{Limit: "test", NextAllowed: nextAllowed}, Queued, maxAttempts - 1, 0},
+		{"sign in", 1, email.ErrSignInRequired, Queued, 1, retryBackoff},
+		{"refused", 0, &email.GraphError{StatusCode: http.StatusBadRequest, Code: "ErrorInvalidRecipients"}, Failed, 1, 0},
+		{"permanent", 0, &email.NoDeferredDeliveryError{}, Failed, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := openOutbox(t, t.TempDir())
+			queued := enqueue(t, o, "k1abc@example.com")
+			o.entries[0].Attempts = tt.attempts
+
+			e, err := o.next(time.Now())
+			if err != nil || e == nil {
+				t.Fatalf("next() = %v, %v", e, err)
+			}
+			start := time.Now()
+			got, err := o.finish(queued.ID, tt.err)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Status != tt.wantStatus || got.Attempts != tt.wantAttempts {
+				t.Errorf("finish() = %s after %d attempts, want %s after %d", got.Status, got.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			if tt.wantDelay > 0 {
+				if delay := got.NotBefore.Sub(start); delay < tt.wantDelay || delay > tt.wantDelay+time.Second {
+					t.Errorf("retried after %s, want %s", delay, tt.wantDelay)
+				}
+			}
+			var rle *email.RateLimitError
+			if errors.As(tt.err, &rle) && !got.NotBefore.Equal(nextAllowed) {
+				t.Errorf("rate limited until %s, want %s", got.NotBefore, nextAllowed)
+			}
+			if got.Status == Sent && string(got.Message.Attachments[0].Data) != "jpeg" {
+				t.Errorf("finished entry doesn't have the attachment data it was sent with")
+			}
+		})
+	}
+}
+
+func TestOutboxNotDueYet(t *testing.T) {
+	o := openOutbox(t, t.TempDir())
+	msg := &email.Message{To: []string{"k1abc@example.com"}, Subject: "QSL"}
+	notBefore := time.Now().Add(time.Hour)
+	err := o.Enqueue("K1ABC", msg, notBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &recordingSender{}
+	o.deliver(s)
+	if len(s.sent) != 0 {
+		t.Errorf("message sent before it was due")
+	}
+}
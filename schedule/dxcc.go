@@ -0,0 +1,125 @@
+package schedule
+
+// dxccOffsets is the standard time UTC offset, in hours, of DXCC entities
+// entities that span several time zones use the zone of the most populated area.
+// DST isn't allowed for, so while it's in effect the window opens and closes an hour late by the station's clock,
+// only used when the QRZ record has no time zone or GMT offset.
+var dxccOffsets = map[int]float64{
+	1:   -5,  // Canada
+	5:   2,   // Aland Islands
+	6:   -9,  // Alaska
+	7:   1,   // Albania
+	14:  4,   // Armenia
+	15:  7,   // Asiatic Russia
+	18:  4,   // Azerbaijan
+	21:  1,   // Balearic Islands
+	27:  3,   // Belarus
+	29:  0,   // Canary Islands
+	40:  2,   // Crete
+	50:  -6,  // Mexico
+	52:  2,   // Estonia
+	54:  3,   // European Russia
+	60:  -5,  // Bahamas
+	62:  -4,  // Barbados
+	64:  -4,  // Bermuda
+	70:  -5,  // Cuba
+	72:  -4,  // Dominican Republic
+	74:  -6,  // El Salvador
+	75:  4,   // Georgia
+	76:  -6,  // Guatemala
+	78:  -5,  // Haiti
+	80:  -6,  // Honduras
+	82:  -5,  // Jamaica
+	86:  -6,  // Nicaragua
+	88:  -5,  // Panama
+	90:  -4,  // Trinidad & Tobago
+	100: -3,  // Argentina
+	104: -4,  // Bolivia
+	106: 0,   // Guernsey
+	108: -3,  // Brazil
+	110: -10, // Hawaii
+	112: -4,  // Chile
+	114: 0,   // Isle of Man
+	116: -5,  // Colombia
+	120: -5,  // Ecuador
+	122: 0,   // Jersey
+	126: 2,   // Kaliningrad
+	130: 5,   // Kazakhstan
+	132: -3,  // Paraguay
+	136: -5,  // Peru
+	137: 9,   // Republic of Korea
+	144: -3,  // Uruguay
+	145: 2,   // Latvia
+	146: 2,   // Lithuania
+	148: -4,  // Venezuela
+	149: -1,  // Azores
+	150: 10,  // Australia
+	170: 12,  // New Zealand
+	179: 2,   // Moldova
+	202: -4,  // Puerto Rico
+	206: 1,   // Austria
+	209: 1,   // Belgium
+	212: 2,   // Bulgaria
+	214: 1,   // Corsica
+	215: 2,   // Cyprus
+	221: 1,   // Denmark
+	223: 0,   // England
+	224: 2,   // Finland
+	225: 1,   // Sardinia
+	227: 1,   // France
+	230: 1,   // Federal Republic of Germany
+	236: 2,   // Greece
+	239: 1,   // Hungary
+	242: 0,   // Iceland
+	245: 0,   // Ireland
+	248: 1,   // Italy
+	254: 1,   // Luxembourg
+	256: 0,   // Madeira Islands
+	257: 1,   // Malta
+	263: 1,   // Netherlands
+	265: 0,   // Northern Ireland
+	266: 1,   // Norway
+	269: 1,   // Poland
+	272: 0,   // Portugal
+	275: 2,   // Romania
+	279: 0,   // Scotland
+	281: 1,   // Spain
+	284: 1,   // Sweden
+	287: 1,   // Switzerland
+	288: 2,   // Ukraine
+	291: -5,  // United States of America
+	293: 7,   // Vietnam
+	294: 0,   // Wales
+	296: 1,   // Serbia
+	299: 8,   // West Malaysia
+	308: -6,  // Costa Rica
+	318: 8,   // China
+	321: 8,   // Hong Kong
+	324: 5.5, // India
+	327: 7,   // Indonesia
+	330: 3.5, // Iran
+	336: 2,   // Israel
+	339: 9,   // Japan
+	348: 3,   // Kuwait
+	372: 5,   // Pakistan
+	375: 8,   // Philippines
+	376: 3,   // Qatar
+	378: 3,   // Saudi Arabia
+	381: 8,   // Singapore
+	386: 8,   // Taiwan
+	387: 7,   // Thailand
+	390: 3,   // Asiatic Turkey
+	391: 4,   // United Arab Emirates
+	430: 3,   // Kenya
+	446: 1,   // Morocco
+	450: 1,   // Nigeria
+	462: 2,   // Republic of South Africa
+	478: 2,   // Egypt
+	497: 1,   // Croatia
+	499: 1,   // Slovenia
+	501: 1,   // Bosnia-Herzegovina
+	502: 1,   // North Macedonia
+	503: 1,   // Czech Republic
+	504: 1,   // Slovak Republic
+	514: 1,   // Montenegro
+}
@@ -0,0 +1,138 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	// embedded zoneinfo, Windows doesn't ship the IANA database
+	_ "time/tzdata"
+
+	"github.com/bbathe/goboro/qrz"
+)
+
+var errNoLocation = errors.New("unable to determine recipient time zone")
+
+// qrzTimeZones maps the QRZ TimeZone names to IANA locations
+var qrzTimeZones = map[string]string{
+	"atlantic": "America/Puerto_Rico",
+	"eastern":  "America/New_York",
+	"central":  "America/Chicago",
+	"mountain": "America/Denver",
+	"arizona":  "America/Phoenix",
+	"pacific":  "America/Los_Angeles",
+	"alaska":   "America/Anchorage",
+	"hawaii":   "Pacific/Honolulu",
+	"samoa":    "Pacific/Pago_Pago",
+	"guam":     "Pacific/Guam",
+}
+
+// RecipientLocation works out the time zone of the station from its QRZ record,
+// trying the named time zone, then the GMT offset & DST flag, then the DXCC entity's standard time offset,
+// which ignores DST
+func RecipientLocation(r *qrz.CallsignLookupResponse, now time.Time) (*time.Location, error) {
+	c := r.Callsign
+
+	// named time zone has the real DST rules
+	if name, ok := qrzTimeZones[strings.ToLower(strings.TrimSpace(c.TimeZone))]; ok {
+		loc, err := time.LoadLocation(name)
+		if err == nil {
+			return loc, nil
+		}
+		log.Printf("%+v", err)
+	}
+
+	// GMT offset from record
+	offset, err := parseOffset(c.GMTOffset)
+	if err == nil {
+		if strings.EqualFold(c.DST, "Y") && inDST(now, c.Lat) {
+			offset += time.Hour
+		}
+		return time.FixedZone(c.Call, int(offset.Seconds())), nil
+	}
+
+	// DXCC entity offset
+	dxcc, err := strconv.Atoi(strings.TrimSpace(c.Dxcc))
+	if err == nil {
+		if hours, ok := dxccOffsets[dxcc]; ok {
+			return time.FixedZone(c.Call, int(hours*3600)), nil
+		}
+	}
+
+	log.Printf("%+v", errNoLocation)
+	return nil, errNoLocation
+}
+
+// parseOffset converts a QRZ GMTOffset, like -5, 5.5 or 5:45, into a duration
+func parseOffset(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errNoLocation
+	}
+
+	if h, m, found := strings.Cut(s, ":"); found {
+		hours, err := strconv.Atoi(h)
+		if err != nil {
+			return 0, err
+		}
+		minutes, err := strconv.Atoi(m)
+		if err != nil {
+			return 0, err
+		}
+		if minutes < 0 || minutes >= 60 {
+			return 0, fmt.Errorf("GMT offset %s out of range", s)
+		}
+		if strings.HasPrefix(h, "-") {
+			minutes = -minutes
+		}
+		offset := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+		if offset < -12*time.Hour || offset > 14*time.Hour {
+			return 0, fmt.Errorf("GMT offset %s out of range", s)
+		}
+		return offset, nil
+	}
+
+	hours, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if hours < -12 || hours > 14 {
+		return 0, fmt.Errorf("GMT offset %s out of range", s)
+	}
+
+	return time.Duration(hours * float64(time.Hour)), nil
+}
+
+// inDST approximates whether daylight saving time is in effect for a station that observes it,
+// northern hemisphere from the last Sunday in March to the last Sunday in October,
+// southern hemisphere from the first Sunday in October to the first Sunday in April
+func inDST(now time.Time, lat string) bool {
+	north := true
+	if l, err := strconv.ParseFloat(strings.TrimSpace(lat), 64); err == nil && l < 0 {
+		north = false
+	}
+
+	year := now.UTC().Year()
+	if north {
+		start := lastSunday(year, time.March)
+		end := lastSunday(year, time.October)
+		return !now.Before(start) && now.Before(end)
+	}
+
+	end := firstSunday(year, time.April)
+	start := firstSunday(year, time.October)
+	return now.Before(end) || !now.Before(start)
+}
+
+func lastSunday(year int, month time.Month) time.Time {
+	t := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+	return t.AddDate(0, 0, -int(t.Weekday()))
+}
+
+func firstSunday(year int, month time.Month) time.Time {
+	t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return t.AddDate(0, 0, (7-int(t.Weekday()))%7)
+}
@@ -0,0 +1,93 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/qrz"
+)
+
+func TestRecipientLocation(t *testing.T) {
+	summer := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+	winter := time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                          string
+		timeZone, gmtOffset, dst, lat string
+		dxcc                          string
+		now                           time.Time
+		wantOffset                    time.Duration
+	}{
+		{"named summer", "Eastern", "", "", "", "", summer, -4 * time.Hour},
+		{"named winter", "Eastern", "", "", "", "", winter, -5 * time.Hour},
+		{"named no dst", "Arizona", "", "", "", "", summer, -7 * time.Hour},
+		{"named over offset", "Pacific", "-5", "Y", "", "", summer, -7 * time.Hour},
+		{"offset", "", "5:30", "N", "", "", summer, 5*time.Hour + 30*time.Minute},
+		{"negative minutes", "", "-3:30", "N", "47.5", "", summer, -3*time.Hour - 30*time.Minute},
+		{"offset dst north summer", "", "1", "Y", "48.1", "", summer, 2 * time.Hour},
+		{"offset dst north winter", "", "1", "Y", "48.1", "", winter, time.Hour},
+		{"offset dst south summer", "", "10", "Y", "-33.9", "", winter, 11 * time.Hour},
+		{"offset dst south winter", "", "10", "Y", "-33.9", "", summer, 10 * time.Hour},
+		{"dxcc", "", "", "", "", "281", summer, time.Hour},
+		{"bad offset dxcc", "", "x", "", "", "291", summer, -5 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &qrz.CallsignLookupResponse{}
+			r.Callsign.Call = "W1AW"
+			r.Callsign.TimeZone = tt.timeZone
+			r.Callsign.GMTOffset = tt.gmtOffset
+			r.Callsign.DST = tt.dst
+			r.Callsign.Lat = tt.lat
+			r.Callsign.Dxcc = tt.dxcc
+
+			loc, err := RecipientLocation(r, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, offset := tt.now.In(loc).Zone()
+			if got := time.Duration(offset) * time.Second; got != tt.wantOffset {
+				t.Errorf("offset = %v, want %v", got, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestRecipientLocationUnknown(t *testing.T) {
+	r := &qrz.CallsignLookupResponse{}
+	r.Callsign.Dxcc = "99999"
+	if _, err := RecipientLocation(r, time.Now()); err == nil {
+		t.Error("RecipientLocation succeeded with nothing to go on")
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"-5", -5 * time.Hour, false},
+		{" 5.5 ", 5*time.Hour + 30*time.Minute, false},
+		{"5:45", 5*time.Hour + 45*time.Minute, false},
+		{"-9:30", -9*time.Hour - 30*time.Minute, false},
+		{"14", 14 * time.Hour, false},
+		{"-12", -12 * time.Hour, false},
+		{"", 0, true},
+		{"15", 0, true},
+		{"-12:30", 0, true},
+		{"5:60", 0, true},
+		{"five", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseOffset(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOffset() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseOffset() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package schedule
+
+import (
+	"log"
+	"time"
+)
+
+// Window is the time of day, in the recipient's local time, messages may be delivered
+type Window struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// NewWindow creates a Window from HH:MM start and end times, end before start wraps past midnight,
+// the same start and end is open all day
+func NewWindow(start, end string) (Window, error) {
+	s, err := time.Parse("15:04", start)
+	if err != nil {
+		log.Printf("%+v", err)
+		return Window{}, err
+	}
+	e, err := time.Parse("15:04", end)
+	if err != nil {
+		log.Printf("%+v", err)
+		return Window{}, err
+	}
+
+	return Window{
+		start: time.Duration(s.Hour())*time.Hour + time.Duration(s.Minute())*time.Minute,
+		end:   time.Duration(e.Hour())*time.Hour + time.Duration(e.Minute())*time.Minute,
+	}, nil
+}
+
+// contains tests if the time of day falls inside the window
+func (w Window) contains(tod time.Duration) bool {
+	if w.start == w.end {
+		return true
+	}
+	if w.start < w.end {
+		return tod >= w.start && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+// Next returns now if now is inside the window at loc, otherwise the next time the window opens.
+// Times are wall clock times, so the window opens at the same local time on the days clocks change.
+func (w Window) Next(now time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+	tod := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond())
+
+	if w.contains(tod) {
+		return now
+	}
+
+	day := local.Day()
+	if tod >= w.start {
+		day++
+	}
+
+	return time.Date(local.Year(), local.Month(), day, int(w.start/time.Hour), int(w.start%time.Hour/time.Minute), 0, 0, loc)
+}
@@ -0,0 +1,76 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		start, end string
+		now        time.Time
+		loc        *time.Location
+		want       time.Time
+	}{
+		{"inside", "09:00", "17:00", time.Date(2026, 6, 1, 12, 0, 0, 0, ny), ny, time.Date(2026, 6, 1, 12, 0, 0, 0, ny)},
+		{"before", "09:00", "17:00", time.Date(2026, 6, 1, 7, 30, 0, 0, ny), ny, time.Date(2026, 6, 1, 9, 0, 0, 0, ny)},
+		{"at end", "09:00", "17:00", time.Date(2026, 6, 1, 17, 0, 0, 0, ny), ny, time.Date(2026, 6, 2, 9, 0, 0, 0, ny)},
+		{"after", "09:00", "17:00", time.Date(2026, 6, 1, 22, 0, 0, 0, ny), ny, time.Date(2026, 6, 2, 9, 0, 0, 0, ny)},
+		{"end of month", "09:00", "17:00", time.Date(2026, 6, 30, 22, 0, 0, 0, ny), ny, time.Date(2026, 7, 1, 9, 0, 0, 0, ny)},
+		{"wraps inside late", "22:00", "06:00", time.Date(2026, 6, 1, 23, 0, 0, 0, ny), ny, time.Date(2026, 6, 1, 23, 0, 0, 0, ny)},
+		{"wraps inside early", "22:00", "06:00", time.Date(2026, 6, 1, 3, 0, 0, 0, ny), ny, time.Date(2026, 6, 1, 3, 0, 0, 0, ny)},
+		{"wraps outside", "22:00", "06:00", time.Date(2026, 6, 1, 12, 0, 0, 0, ny), ny, time.Date(2026, 6, 1, 22, 0, 0, 0, ny)},
+		{"all day", "00:00", "00:00", time.Date(2026, 6, 1, 3, 0, 0, 0, ny), ny, time.Date(2026, 6, 1, 3, 0, 0, 0, ny)},
+		{"all day afternoon", "14:00", "14:00", time.Date(2026, 6, 1, 13, 59, 0, 0, ny), ny, time.Date(2026, 6, 1, 13, 59, 0, 0, ny)},
+
+		// clocks go forward at 02:00 on 2026-03-08 and back at 02:00 on 2026-11-01 in New York
+		{"spring forward", "09:00", "17:00", time.Date(2026, 3, 7, 20, 0, 0, 0, ny), ny, time.Date(2026, 3, 8, 9, 0, 0, 0, ny)},
+		{"spring forward morning", "09:00", "17:00", time.Date(2026, 3, 8, 8, 30, 0, 0, ny), ny, time.Date(2026, 3, 8, 9, 0, 0, 0, ny)},
+		{"fall back", "09:00", "17:00", time.Date(2026, 10, 31, 20, 0, 0, 0, ny), ny, time.Date(2026, 11, 1, 9, 0, 0, 0, ny)},
+		{"fall back morning", "09:00", "17:00", time.Date(2026, 11, 1, 8, 30, 0, 0, ny), ny, time.Date(2026, 11, 1, 9, 0, 0, 0, ny)},
+		{"fall back inside", "09:00", "17:00", time.Date(2026, 11, 1, 16, 30, 0, 0, ny), ny, time.Date(2026, 11, 1, 16, 30, 0, 0, ny)},
+
+		// sender in New York, recipient elsewhere
+		{"remote inside", "09:00", "17:00", time.Date(2026, 6, 1, 22, 0, 0, 0, ny), tokyo, time.Date(2026, 6, 1, 22, 0, 0, 0, ny)},
+		{"remote before", "09:00", "17:00", time.Date(2026, 6, 1, 12, 0, 0, 0, ny), tokyo, time.Date(2026, 6, 2, 9, 0, 0, 0, tokyo)},
+		{"remote southern hemisphere", "09:00", "17:00", time.Date(2026, 10, 3, 20, 0, 0, 0, time.UTC), sydney, time.Date(2026, 10, 4, 9, 0, 0, 0, sydney)},
+		{"remote fixed zone", "09:00", "17:00", time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC), time.FixedZone("VU2", 5*3600+1800), time.Date(2026, 6, 2, 3, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWindow(tt.start, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Next(tt.now, tt.loc); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWindowInvalid(t *testing.T) {
+	for _, tt := range []struct{ start, end string }{
+		{"9am", "17:00"},
+		{"09:00", "24:00"},
+		{"", ""},
+	} {
+		if _, err := NewWindow(tt.start, tt.end); err == nil {
+			t.Errorf("NewWindow(%q, %q) succeeded", tt.start, tt.end)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bbathe/goboro/atomicfile"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters, about 100ms to derive the key on a desktop
+const (
+	scryptN             = 1 << 15
+	scryptR             = 8
+	scryptP             = 1
+	keyLength           = 32 // AES-256
+	saltLength          = 16
+	fileVersion         = 1
+	minPassphraseLength = 8
+)
+
+var (
+	errWrongPassphrase = errors.New("wrong passphrase for the secrets file, or the file is damaged")
+	errShortPassphrase = fmt.Errorf("the passphrase must be at least %d characters", minPassphraseLength)
+)
+
+// file is the format of the secrets file, the values are encrypted as one JSON object
+type file struct {
+	Version int
+	N       int
+	R       int
+	P       int
+	Salt    []byte
+	Nonce   []byte
+	Data    []byte
+}
+
+// deriveKey turns the passphrase into the AES key
+func deriveKey(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, keyLength)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Exists tests if there is a secrets file fname
+func Exists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+// Load decrypts secrets file fname with passphrase and returns the secrets by name
+func Load(fname, passphrase string) (map[string]string, error) {
+	// #nosec G304
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	var f file
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if f.Version != fileVersion {
+		err = fmt.Errorf("secrets file %s is version %d, expected %d", fname, f.Version, fileVersion)
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	// only what Save writes, a damaged or tampered file could otherwise make deriving the key take forever
+	if f.N != scryptN || f.R != scryptR || f.P != scryptP || len(f.Salt) != saltLength {
+		err = fmt.Errorf("secrets file %s has unexpected key derivation parameters, it may be damaged", fname)
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	aead, err := deriveKey(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		log.Printf("%+v", errWrongPassphrase)
+		return nil, errWrongPassphrase
+	}
+
+	plain, err := aead.Open(nil, f.Nonce, f.Data, nil)
+	if err != nil {
+		log.Printf("%+v", errWrongPassphrase)
+		return nil, errWrongPassphrase
+	}
+
+	var values map[string]string
+	err = json.Unmarshal(plain, &values)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Save encrypts values with passphrase and writes them to secrets file fname, replacing it,
+// a new salt and nonce are used every time
+func Save(fname, passphrase string, values map[string]string) error {
+	if len(passphrase) < minPassphraseLength {
+		return errShortPassphrase
+	}
+
+	f := file{
+		Version: fileVersion,
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, saltLength),
+	}
+	_, err := rand.Read(f.Salt)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	aead, err := deriveKey(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(f.Nonce)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	plain, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	f.Data = aead.Seal(nil, f.Nonce, plain, nil)
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = atomicfile.WriteFile(fname, b, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	values := map[string]string{
+		"qrz":  "hunter22",
+		"smtp": "p@ss word ✓",
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		tamper     func(f *file)
+		wantErr    error // the error Load returns, if it's a known one
+		ok         bool
+	}{
+		{"round trip", "correct horse", nil, nil, true},
+		{"wrong passphrase", "wrong horse", nil, errWrongPassphrase, false},
+		{"tampered data", "correct horse", func(f *file) { f.Data[0] ^= 1 }, errWrongPassphrase, false},
+		{"tampered salt", "correct horse", func(f *file) { f.Salt[0] ^= 1 }, errWrongPassphrase, false},
+		{"short nonce", "correct horse", func(f *file) { f.Nonce = f.Nonce[1:] }, errWrongPassphrase, false},
+		{"key derivation parameters", "correct horse", func(f *file) { f.N = 1 << 30 }, nil, false},
+		{"version", "correct horse", func(f *file) { f.Version = 2 }, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "goboro.secrets")
+			err := Save(fname, "correct horse", values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.tamper != nil {
+				b, err := os.ReadFile(fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var f file
+				err = json.Unmarshal(b, &f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.tamper(&f)
+				b, err = json.Marshal(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(fname, b, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := Load(fname, tt.passphrase)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("Load() = %v, want an error", got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("Load() error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(values) {
+				t.Errorf("Load() = %v, want %v", got, values)
+			}
+			for k, v := range values {
+				if got[k] != v {
+					t.Errorf("secret %s is %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveEncrypts(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "goboro.secrets")
+	err := Save(fname, "correct horse", map[string]string{"qrz": "hunter22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f file
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Data) == "" || json.Valid(f.Data) {
+		t.Errorf("secrets not encrypted: %q", f.Data)
+	}
+
+	// a new salt and nonce every time
+	err = Save(fname, "correct horse", map[string]string{"qrz": "hunter22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f2 file
+	err = json.Unmarshal(b, &f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Salt) == string(f2.Salt) || string(f.Nonce) == string(f2.Nonce) {
+		t.Error("salt or nonce reused")
+	}
+}
+
+func TestSaveShortPassphrase(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "goboro.secrets")
+	err := Save(fname, "short", map[string]string{"qrz": "hunter22"})
+	if !errors.Is(err, errShortPassphrase) {
+		t.Errorf("Save() error %v, want %v", err, errShortPassphrase)
+	}
+	if Exists(fname) {
+		t.Error("secrets file written")
+	}
+}
@@ -0,0 +1,530 @@
+package tracking
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbathe/goboro/atomicfile"
+	"github.com/bbathe/goboro/email"
+)
+
+// State is where a notice is in the conversation with the station
+type State string
+
+const (
+	AwaitingReply State = "awaiting reply"
+	Replied       State = "replied"
+	Bounced       State = "bounced"  // a non-delivery report came back
+	Canceled      State = "canceled" // deferred delivery was canceled, it never went out
+)
+
+const (
+	// stop looking for replies to notices this old
+	replyWindow = 90 * 24 * time.Hour
+
+	// messages can show up in a mailbox listing a little after the time they were received,
+	// so each poll looks back this far before the last one
+	pollOverlap = 5 * time.Minute
+)
+
+var errNotFound = errors.New("no such notice")
+
+// Notice is a message sent to a station
+type Notice struct {
+	ID        string // outbox ID of the message, sent in its X-Goboro-Notice-ID header, or the Graph ID of a draft
+	MessageID string `json:",omitempty"` // Internet Message-ID of the message
+	Callsign  string
+	To        []string
+	Subject   string
+	SentAt    time.Time
+
+	State        State
+	ReplyAt      time.Time `json:",omitempty"`
+	ReplyFrom    string    `json:",omitempty"`
+	ReplySnippet string    `json:",omitempty"`
+
+	BouncedAddresses []string `json:",omitempty"` // addresses a non-delivery report came back for
+	BounceReason     string   `json:",omitempty"`
+}
+
+// SentTo is true if the notice was sent to address
+func (n *Notice) SentTo(address string) bool {
+	return contains(n.To, address)
+}
+
+// file is the format of the tracking file
+type file struct {
+	Notices []*Notice
+
+	// messages received before this have been looked at
+	PolledUntil time.Time `json:",omitempty"`
+
+	// delivery reports received after PolledUntil, less the overlap, that have been applied, by Graph message ID
+	Reports map[string]time.Time `json:",omitempty"`
+}
+
+// Store is the persistent record of the notices sent
+type Store struct {
+	fname string
+	file
+
+	// mutex for file
+	m sync.Mutex
+}
+
+// Open loads the notices from file fname, a missing file is an empty store
+func Open(fname string) (*Store, error) {
+	s := &Store{
+		fname: fname,
+	}
+
+	// #nosec G304
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &s.file)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// save writes the notices to file, caller must hold the lock
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.file, "", "  ")
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = atomicfile.WriteFile(s.fname, b, 0600)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// add adds n awaiting a reply unless it's already recorded, returns if it was added, caller must hold the lock
+func (s *Store) add(n Notice) bool {
+	for _, e := range s.Notices {
+		if e.ID == n.ID {
+			return false
+		}
+	}
+
+	n.State = AwaitingReply
+	to := make([]string, len(n.To))
+	for i, a := range n.To {
+		to[i] = strings.ToLower(a)
+	}
+	n.To = to
+
+	s.Notices = append(s.Notices, &n)
+
+	return true
+}
+
+// Record adds a sent notice, it starts out awaiting a reply, a notice already recorded is left alone
+func (s *Store) Record(n Notice) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.add(n) {
+		return nil
+	}
+
+	return s.save()
+}
+
+// Import adds notices sent before, like another sorter's history, the ones already recorded are left alone.
+// The next poll goes back to the oldest one added that could still get a reply, to find its replies and bounces.
+// Returns how many were added.
+func (s *Store) Import(notices []Notice) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	cutoff := time.Now().Add(-replyWindow)
+	added := 0
+	for _, n := range notices {
+		if !s.add(n) {
+			continue
+		}
+		added++
+
+		if n.SentAt.After(cutoff) && n.SentAt.Before(s.PolledUntil) {
+			s.PolledUntil = n.SentAt
+		}
+	}
+	if added == 0 {
+		return 0, nil
+	}
+
+	err := s.save()
+	if err != nil {
+		log.Printf("%+v", err)
+		return 0, err
+	}
+
+	return added, nil
+}
+
+// Cancel marks the notice with Internet Message-ID messageID as canceled, it isn't awaiting a reply anymore
+func (s *Store) Cancel(messageID string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, n := range s.Notices {
+		if n.MessageID == messageID {
+			n.State = Canceled
+			return s.save()
+		}
+	}
+
+	return errNotFound
+}
+
+// List returns all the notices, oldest first
+func (s *Store) List() []Notice {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	notices := make([]Notice, len(s.Notices))
+	for i, n := range s.Notices {
+		notices[i] = *n
+	}
+
+	return notices
+}
+
+// ByCallsign returns the notices sent to callsign, oldest first
+func (s *Store) ByCallsign(callsign string) []Notice {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var notices []Notice
+	for _, n := range s.Notices {
+		if strings.EqualFold(n.Callsign, callsign) {
+			notices = append(notices, *n)
+		}
+	}
+
+	return notices
+}
+
+// awaiting returns copies of the notices still waiting for a reply that are recent enough to get one
+func (s *Store) awaiting(now time.Time) []Notice {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var notices []Notice
+	for _, n := range s.Notices {
+		if n.State == AwaitingReply && now.Sub(n.SentAt) < replyWindow {
+			notices = append(notices, *n)
+		}
+	}
+
+	return notices
+}
+
+// applyReply marks the notices awaiting a reply that m answers. A reply that quotes the Message-ID of a notice
+// answers that one and no other, which finds replies from forwarding addresses too, even if it has already been
+// answered. Otherwise it answers every notice sent to its sender before it was received. Returns the notices marked.
+func (s *Store) applyReply(m email.ReceivedMessage) ([]Notice, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	canAnswer := func(n *Notice) bool {
+		return n.State == AwaitingReply && m.Received.After(n.SentAt) && m.Received.Sub(n.SentAt) <= replyWindow
+	}
+
+	var matches []*Notice
+	var answered *Notice
+	for _, n := range s.Notices {
+		if m.Answers(n.MessageID) {
+			answered = n
+			break
+		}
+	}
+	if answered != nil {
+		if canAnswer(answered) {
+			matches = []*Notice{answered}
+		}
+	} else {
+		for _, n := range s.Notices {
+			if canAnswer(n) && n.SentTo(m.From) {
+				matches = append(matches, n)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	replied := make([]Notice, len(matches))
+	for i, n := range matches {
+		n.State = Replied
+		n.ReplyAt = m.Received
+		n.ReplyFrom = m.From
+		n.ReplySnippet = m.Preview
+		replied[i] = *n
+	}
+
+	err := s.save()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return replied, nil
+}
+
+func contains(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBad is true if a message to address has bounced
+func (s *Store) IsBad(address string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, n := range s.Notices {
+		if contains(n.BouncedAddresses, address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AlternateAddress returns the first callsign@domain address that hasn't bounced, "" if they all have
+func (s *Store) AlternateAddress(callsign string, domains []string) string {
+	for _, d := range domains {
+		address := strings.ToLower(callsign + "@" + d)
+		if !s.IsBad(address) {
+			return address
+		}
+	}
+
+	return ""
+}
+
+// reportApplied is true if the delivery report with Graph message id has already been applied
+func (s *Store) reportApplied(id string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	_, ok := s.Reports[id]
+	return ok
+}
+
+// applyReport records the failed deliveries in report against the notices they're about and
+// remembers the report so it isn't applied again, returns the notices that bounced
+func (s *Store) applyReport(report email.DeliveryReport) ([]Notice, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var bounced []Notice
+	for _, rs := range report.Failures() {
+		if n := s.markBounced(report, rs); n != nil {
+			bounced = append(bounced, *n)
+		}
+	}
+
+	if s.Reports == nil {
+		s.Reports = make(map[string]time.Time)
+	}
+	s.Reports[report.ID] = report.Received
+
+	err := s.save()
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	return bounced, nil
+}
+
+// markBounced records a failed delivery to the most recent notice sent to the address before the report,
+// returns the notice, nil if there isn't one or the bounce was already recorded, caller must hold the lock
+func (s *Store) markBounced(report email.DeliveryReport, rs email.RecipientStatus) *Notice {
+	var match *Notice
+	for _, n := range s.Notices {
+		if n.SentTo(rs.Address) && !n.SentAt.After(report.Received) {
+			match = n
+		}
+	}
+
+	// the report usually quotes the Message-ID, which picks the right one when the address was sent to more than once
+	if report.OriginalMessageID != "" {
+		for _, n := range s.Notices {
+			if strings.Trim(n.MessageID, "<>") == report.OriginalMessageID && n.SentTo(rs.Address) {
+				match = n
+				break
+			}
+		}
+	}
+	if match == nil || contains(match.BouncedAddresses, rs.Address) {
+		return nil
+	}
+
+	match.State = Bounced
+	match.BouncedAddresses = append(match.BouncedAddresses, rs.Address)
+	match.BounceReason = strings.TrimSpace(rs.Status + " " + rs.Diagnostic)
+
+	c := *match
+	return &c
+}
+
+// pollSince is when to list the mailbox from, just before the last poll, but no later than the oldest notice awaiting a reply
+func (s *Store) pollSince(awaiting []Notice) time.Time {
+	since := awaiting[0].SentAt
+	for _, n := range awaiting[1:] {
+		if n.SentAt.Before(since) {
+			since = n.SentAt
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if last := s.PolledUntil.Add(-pollOverlap); last.After(since) {
+		since = last
+	}
+	return since
+}
+
+// polled records that the messages received before until have been looked at
+func (s *Store) polled(until time.Time) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.PolledUntil = until
+
+	// reports before the overlap won't be listed again
+	for id, received := range s.Reports {
+		if received.Before(until.Add(-pollOverlap)) {
+			delete(s.Reports, id)
+		}
+	}
+
+	return s.save()
+}
+
+// Poll checks the messages received in the mailbox of userID since the last poll for replies and bounces
+// to the notices awaiting a reply, returns the notices that changed
+func (s *Store) Poll(reader email.Reader, userID string) ([]Notice, error) {
+	now := time.Now()
+	awaiting := s.awaiting(now)
+	if len(awaiting) == 0 {
+		return nil, nil
+	}
+
+	messages, err := reader.MessagesReceived(userID, s.pollSince(awaiting))
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+
+	// bounces first, so an auto-reply that comes with one isn't taken for the station replying
+	var changed []Notice
+	for _, m := range messages {
+		if !m.IsDeliveryReport() || s.reportApplied(m.ID) {
+			continue
+		}
+
+		report, err := reader.DeliveryReport(userID, m.ID)
+		if err != nil {
+			// one unreadable report shouldn't hide the rest
+			if errors.Is(err, email.ErrUnreadableReport) {
+				continue
+			}
+			log.Printf("%+v", err)
+			return changed, err
+		}
+		report.Received = m.Received
+
+		bounced, err := s.applyReport(*report)
+		if err != nil {
+			log.Printf("%+v", err)
+			return changed, err
+		}
+		changed = append(changed, bounced...)
+	}
+
+	// read receipts and auto-replies aren't the station replying
+	for _, m := range messages {
+		if m.IsDeliveryReport() || m.IsAutomatic() {
+			continue
+		}
+
+		replied, err := s.applyReply(m)
+		if err != nil {
+			log.Printf("%+v", err)
+			return changed, err
+		}
+		changed = append(changed, replied...)
+	}
+
+	err = s.polled(now)
+	if err != nil {
+		log.Printf("%+v", err)
+		return changed, err
+	}
+
+	return changed, nil
+}
+
+// Start polls for replies and bounces every interval in the background, calling onChange for each notice
+// that got one, returns a function that stops polling
+func (s *Store) Start(reader email.Reader, userID string, interval time.Duration, onChange func(Notice)) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			changed, err := s.Poll(reader, userID)
+			if err != nil {
+				log.Printf("%+v", err)
+			}
+			for _, n := range changed {
+				onChange(n)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
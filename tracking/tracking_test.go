@@ -0,0 +1,303 @@
+package tracking
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bbathe/goboro/email"
+)
+
+// fakeReader is a mailbox with messages and the delivery reports among them, by Graph message ID
+type fakeReader struct {
+	messages []email.ReceivedMessage
+	reports  map[string]*email.DeliveryReport
+	since    time.Time // asked for in the last MessagesReceived
+}
+
+func (r *fakeReader) MessagesReceived(userID string, since time.Time) ([]email.ReceivedMessage, error) {
+	r.since = since
+
+	var messages []email.ReceivedMessage
+	for _, m := range r.messages {
+		if !m.Received.Before(since) {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+func (r *fakeReader) DeliveryReport(userID, id string) (*email.DeliveryReport, error) {
+	report, ok := r.reports[id]
+	if !ok {
+		return nil, email.ErrUnreadableReport
+	}
+	c := *report
+	return &c, nil
+}
+
+// openStore opens the tracking file in the test's temporary directory
+func openStore(t *testing.T, dir string) *Store {
+	t.Helper()
+
+	s, err := Open(filepath.Join(dir, "tracking.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// record records a notice to address sent at sentAt
+func record(t *testing.T, s *Store, id, address string, sentAt time.Time) Notice {
+	t.Helper()
+
+	n := Notice{
+		ID:        id,
+		MessageID: "<" + id + "@goboro>",
+		Callsign:  "K1ABC",
+		To:        []string{address},
+		Subject:   "QSL cards waiting",
+		SentAt:    sentAt,
+	}
+	err := s.Record(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// state returns the state of the notice with id
+func state(t *testing.T, s *Store, id string) Notice {
+	t.Helper()
+
+	for _, n := range s.List() {
+		if n.ID == id {
+			return n
+		}
+	}
+	t.Fatalf("no notice %s", id)
+	return Notice{}
+}
+
+func TestPollReplies(t *testing.T) {
+	now := time.Now()
+	older := now.Add(-48 * time.Hour)
+	newer := now.Add(-24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		replied map[string]bool // notice ID to whether it's marked replied
+		message email.ReceivedMessage
+	}{
+		{
+			"quotes the older notice",
+			map[string]bool{"older": true, "newer": false},
+			email.ReceivedMessage{ID: "m1", From: "k1abc@example.com", References: []string{"older@goboro"}},
+		},
+		{
+			"from a forwarding address",
+			map[string]bool{"older": false, "newer": true},
+			email.ReceivedMessage{ID: "m1", From: "k1abc@forwarder.example", References: []string{"other@example.com", "newer@goboro"}},
+		},
+		{
+			"no Message-ID quoted",
+			map[string]bool{"older": true, "newer": true},
+			email.ReceivedMessage{ID: "m1", From: "K1ABC@example.com"},
+		},
+		{
+			"someone else",
+			map[string]bool{"older": false, "newer": false},
+			email.ReceivedMessage{ID: "m1", From: "n1xyz@example.com"},
+		},
+		{
+			"auto-reply",
+			map[string]bool{"older": false, "newer": false},
+			email.ReceivedMessage{ID: "m1", From: "k1abc@example.com", AutoSubmitted: "auto-replied", References: []string{"older@goboro"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openStore(t, t.TempDir())
+			record(t, s, "older", "k1abc@example.com", older)
+			record(t, s, "newer", "k1abc@example.com", newer)
+
+			m := tt.message
+			m.Received = now.Add(-time.Hour)
+			m.Preview = "Envelopes are on their way"
+			changed, err := s.Poll(&fakeReader{messages: []email.ReceivedMessage{m}}, "w1bureau@example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n := 0
+			for id, replied := range tt.replied {
+				got := state(t, s, id)
+				if replied {
+					n++
+					if got.State != Replied || got.ReplyFrom != m.From || got.ReplySnippet != m.Preview {
+						t.Errorf("notice %s is %s, reply from %q, want replied from %s", id, got.State, got.ReplyFrom, m.From)
+					}
+				} else if got.State != AwaitingReply {
+					t.Errorf("notice %s is %s, want %s", id, got.State, AwaitingReply)
+				}
+			}
+			if len(changed) != n {
+				t.Errorf("%d notices changed, want %d", len(changed), n)
+			}
+		})
+	}
+}
+
+func TestReplyToAnsweredNotice(t *testing.T) {
+	now := time.Now()
+	s := openStore(t, t.TempDir())
+	record(t, s, "older", "k1abc@example.com", now.Add(-48*time.Hour))
+	record(t, s, "newer", "k1abc@example.com", now.Add(-24*time.Hour))
+
+	// the older notice was answered, then answered again after the newer one went out
+	for i, received := range []time.Time{now.Add(-30 * time.Hour), now.Add(-time.Hour)} {
+		_, err := s.applyReply(email.ReceivedMessage{
+			ID:         fmt.Sprint("m", i),
+			From:       "k1abc@example.com",
+			Received:   received,
+			References: []string{"older@goboro"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := state(t, s, "older"); got.State != Replied || !got.ReplyAt.Equal(now.Add(-30*time.Hour)) {
+		t.Errorf("older notice is %s, replied at %s, want the first reply", got.State, got.ReplyAt)
+	}
+	if got := state(t, s, "newer"); got.State != AwaitingReply {
+		t.Errorf("newer notice is %s, want %s", got.State, AwaitingReply)
+	}
+}
+
+func TestPollBounces(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	s := openStore(t, dir)
+	record(t, s, "older", "k1abc@example.com", now.Add(-48*time.Hour))
+	record(t, s, "newer", "k1abc@example.com", now.Add(-24*time.Hour))
+	record(t, s, "other", "n1xyz@example.com", now.Add(-24*time.Hour))
+
+	reader := &fakeReader{
+		messages: []email.ReceivedMessage{
+			{ID: "ndr", Received: now.Add(-time.Hour), ContentType: "multipart/report; report-type=delivery-status; boundary=x"},
+			{ID: "unreadable", Received: now.Add(-time.Hour), ContentType: "multipart/report; report-type=delivery-status; boundary=x"},
+		},
+		reports: map[string]*email.DeliveryReport{
+			"ndr": {
+				ID:                "ndr",
+				OriginalMessageID: "older@goboro",
+				Recipients: []email.RecipientStatus{
+					{Address: "k1abc@example.com", Action: "failed", Status: "5.1.1", Diagnostic: "user unknown"},
+					{Address: "n1xyz@example.com", Action: "delayed", Status: "4.4.7"},
+				},
+			},
+		},
+	}
+	changed, err := s.Poll(reader, "w1bureau@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0].ID != "older" {
+		t.Fatalf("changed %v, want the older notice", changed)
+	}
+
+	got := state(t, s, "older")
+	if got.State != Bounced || got.BounceReason != "5.1.1 user unknown" {
+		t.Errorf("older notice is %s, %q", got.State, got.BounceReason)
+	}
+	for _, id := range []string{"newer", "other"} {
+		if got := state(t, s, id); got.State != AwaitingReply {
+			t.Errorf("notice %s is %s, want %s", id, got.State, AwaitingReply)
+		}
+	}
+	if !s.IsBad("K1ABC@example.com") || s.IsBad("n1xyz@example.com") {
+		t.Error("bad addresses not recorded")
+	}
+	if a := s.AlternateAddress("K1ABC", []string{"example.com", "arrl.net"}); a != "k1abc@arrl.net" {
+		t.Errorf("alternate address %q, want k1abc@arrl.net", a)
+	}
+
+	// the report isn't applied again, even after a restart
+	s = openStore(t, dir)
+	changed, err = s.Poll(reader, "w1bureau@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("changed %v after polling again, want none", changed)
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	s := openStore(t, dir)
+	record(t, s, "recent", "k1abc@example.com", now.Add(-time.Hour))
+
+	reader := &fakeReader{}
+	_, err := s.Poll(reader, "w1bureau@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := []Notice{
+		{ID: "recent", MessageID: "<recent@goboro>", To: []string{"k1abc@example.com"}, SentAt: now.Add(-time.Hour)},
+		{ID: "handed over", MessageID: "<handed-over@goboro>", To: []string{"N1XYZ@example.com"}, SentAt: now.Add(-10 * 24 * time.Hour), State: Replied},
+		{ID: "ancient", MessageID: "<ancient@goboro>", To: []string{"w1aw@example.com"}, SentAt: now.Add(-2 * replyWindow)},
+	}
+	added, err := s.Import(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Errorf("added %d notices, want 2", added)
+	}
+
+	// imported notices await a reply, with their addresses as recorded ones are
+	got := state(t, s, "handed over")
+	if got.State != AwaitingReply || !got.SentTo("n1xyz@example.com") || got.To[0] != "n1xyz@example.com" {
+		t.Errorf("imported notice is %s to %v", got.State, got.To)
+	}
+
+	// the next poll goes back to the oldest one that can still get a reply, not the one past the reply window
+	_, err = s.Poll(reader, "w1bureau@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reader.since.Equal(now.Add(-10 * 24 * time.Hour)) {
+		t.Errorf("polled since %s, want %s", reader.since, now.Add(-10*24*time.Hour))
+	}
+
+	// importing again adds nothing, and it's all kept
+	added, err = s.Import(imported)
+	if err != nil || added != 0 {
+		t.Errorf("import again added %d, %v, want 0", added, err)
+	}
+	if n := len(openStore(t, dir).List()); n != 3 {
+		t.Errorf("%d notices after restart, want 3", n)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	n := record(t, s, "scheduled", "k1abc@example.com", time.Now().Add(-time.Hour))
+
+	err := s.Cancel(n.MessageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state(t, s, n.ID); got.State != Canceled {
+		t.Errorf("notice is %s, want %s", got.State, Canceled)
+	}
+	if err := s.Cancel("<unknown@goboro>"); !errors.Is(err, errNotFound) {
+		t.Errorf("canceling an unknown notice: %v", err)
+	}
+}
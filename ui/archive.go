@@ -0,0 +1,161 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bbathe/goboro/archive"
+	"github.com/bbathe/goboro/tracking"
+
+	"github.com/lxn/walk"
+	"github.com/lxn/walk/declarative"
+)
+
+// mbox files for export and import
+const mboxFilter = "Mailbox files (*.mbox)|*.mbox|All files (*.*)|*.*"
+
+// showArchive offers to export the archive for handing over to the next sorter, or to import
+// the archive of the previous one, along with the tracking records in it
+func showArchive(arch *archive.Archive, ts *tracking.Store) {
+	var dlg *walk.Dialog
+	var lblCount *walk.Label
+
+	count := func() string {
+		entries, err := arch.List()
+		if err != nil {
+			log.Printf("%+v", err)
+			return err.Error()
+		}
+		return fmt.Sprintf("%d messages archived", len(entries))
+	}
+
+	buttonFont := declarative.Font{
+		Family:    "MS Shell Dlg 2",
+		PointSize: 9,
+	}
+
+	// the previous sorter's archive can be an mbox file or a Maildir folder
+	importFrom := func(path string) {
+		added, err := arch.Import(path)
+		if err != nil {
+			MsgError(dlg, err)
+			log.Printf("%+v", err)
+			return
+		}
+
+		var notices []tracking.Notice
+		for _, e := range added {
+			if e.NoticeID == "" {
+				continue
+			}
+			notices = append(notices, tracking.Notice{
+				ID:        e.NoticeID,
+				MessageID: e.MessageID,
+				Callsign:  e.Callsign,
+				To:        e.To,
+				Subject:   e.Subject,
+				SentAt:    e.Date,
+			})
+		}
+		_, err = ts.Import(notices)
+		if err != nil {
+			MsgError(dlg, err)
+			log.Printf("%+v", err)
+			return
+		}
+
+		lblCount.SetText(count())
+		MsgInformation(dlg, fmt.Sprintf("Imported %d messages", len(added)))
+	}
+
+	err := declarative.Dialog{
+		AssignTo: &dlg,
+		Title:    appName + " - Archive",
+		Icon:     appIcon,
+		Font: declarative.Font{
+			Family:    "MS Shell Dlg 2",
+			PointSize: 10,
+		},
+		Layout: declarative.VBox{},
+		Children: []declarative.Widget{
+			declarative.Label{
+				AssignTo: &lblCount,
+				Text:     count(),
+			},
+			declarative.Composite{
+				Layout: declarative.HBox{MarginsZero: true},
+				Children: []declarative.Widget{
+					declarative.PushButton{
+						Text:        "Export",
+						ToolTipText: "save every archived message to an mbox file to hand over",
+						Font:        buttonFont,
+						OnClicked: func() {
+							fd := walk.FileDialog{
+								Title:    "Export archive",
+								Filter:   mboxFilter,
+								FilePath: "goboro.mbox",
+							}
+							ok, err := fd.ShowSave(dlg)
+							if err != nil || !ok {
+								return
+							}
+
+							err = arch.Export(fd.FilePath)
+							if err != nil {
+								MsgError(dlg, err)
+								log.Printf("%+v", err)
+								return
+							}
+						},
+					},
+					declarative.PushButton{
+						Text:        "Import mbox",
+						ToolTipText: "add the messages in an exported archive",
+						Font:        buttonFont,
+						OnClicked: func() {
+							fd := walk.FileDialog{
+								Title:  "Import archive",
+								Filter: mboxFilter,
+							}
+							ok, err := fd.ShowOpen(dlg)
+							if err != nil || !ok {
+								return
+							}
+							importFrom(fd.FilePath)
+						},
+					},
+					declarative.PushButton{
+						Text:        "Import Maildir",
+						ToolTipText: "add the messages in a Maildir archive folder",
+						Font:        buttonFont,
+						OnClicked: func() {
+							fd := walk.FileDialog{
+								Title: "Import archive",
+							}
+							ok, err := fd.ShowBrowseFolder(dlg)
+							if err != nil || !ok {
+								return
+							}
+							importFrom(fd.FilePath)
+						},
+					},
+					declarative.HSpacer{},
+					declarative.PushButton{
+						Text: "Close",
+						Font: buttonFont,
+						OnClicked: func() {
+							dlg.Accept()
+						},
+					},
+				},
+			},
+		},
+	}.Create(mainWin)
+	if err != nil {
+		MsgError(mainWin, err)
+		log.Printf("%+v", err)
+		return
+	}
+
+	dlg.Run()
+}
@@ -1,18 +1,23 @@
 package ui
 
 import (
-	"bytes"
 	"errors"
-	"html/template"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/bbathe/goboro/archive"
 	"github.com/bbathe/goboro/config"
 	"github.com/bbathe/goboro/email"
+	"github.com/bbathe/goboro/optout"
+	"github.com/bbathe/goboro/outbox"
 	"github.com/bbathe/goboro/qrz"
+	"github.com/bbathe/goboro/schedule"
+	"github.com/bbathe/goboro/tracking"
 
 	"github.com/lxn/walk"
 	"github.com/lxn/walk/declarative"
@@ -47,6 +52,11 @@ func launchQRZPage(call string) error {
 		u += "/db/" + strings.Replace(call, "%", "", -1)
 	}
 
+	return launchURL(u)
+}
+
+// launchURL opens the users default web browser to u
+func launchURL(u string) error {
 	err := exec.Command(runDll32, "url.dll,FileProtocolHandler", u).Start()
 	if err != nil {
 		log.Printf("%+v", err)
@@ -56,6 +66,198 @@ func launchQRZPage(call string) error {
 	return nil
 }
 
+// saveDraft saves msg to callsign in the Drafts folder and offers to open it for review, it's tracked
+// from when it's saved, under its draft ID, so replies and bounces are found once it's sent from Outlook
+func saveDraft(drafter email.Drafter, ts *tracking.Store, callsign string, msg *email.Message) error {
+	msg.Callsign = callsign
+	draft, err := drafter.SaveDraft(msg)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = ts.Record(tracking.Notice{
+		ID:        draft.ID,
+		MessageID: msg.MessageID,
+		Callsign:  callsign,
+		To:        msg.To,
+		Subject:   msg.Subject,
+		SentAt:    time.Now(),
+	})
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	if draft.WebLink != "" {
+		if walk.MsgBox(mainWin, appName, "Draft saved, open it in Outlook?", walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) == walk.DlgCmdYes {
+			err = launchURL(draft.WebLink)
+			if err != nil {
+				log.Printf("%+v", err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// newSender creates the email backend selected in config
+func newSender() (email.Sender, error) {
+	switch {
+	case config.Email.DryRun != "":
+		return email.NewFileSender(config.Email.DryRun, false)
+	case config.Email.UsesFile():
+		return email.NewFileSender(config.ResolvePath(config.File.Dir), config.File.Mbox)
+	case config.Email.Backend == config.BackendSMTP:
+		return email.NewSMTPClient(config.SMTP.Host, config.SMTP.Port, config.SMTP.Security, config.SMTP.Auth, config.SMTP.Username, config.SMTP.Password.Value())
+	}
+
+	o := &config.Office365AppRegistration
+	endpoints := email.Endpoints{
+		AuthorityHost: o.AuthorityHost,
+		GraphURL:      o.GraphURL,
+		GraphVersion:  o.GraphVersion,
+	}
+	switch {
+	case o.IsDelegated():
+		client, err := email.Office365DelegatedClient(endpoints, o.Tenant(), o.ClientID, config.DataFile("tokencache.json"), showDeviceCode)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+		client.OnSignInRequired(func() {
+			askSignIn(client)
+		})
+		return client, nil
+	case o.Certificate != "":
+		return email.Office365CertClient(endpoints, o.TenantID, o.ClientID, config.ResolvePath(o.Certificate), o.CertificatePassword.Value())
+	}
+
+	return email.Office365Client(endpoints, o.TenantID, o.ClientID, o.Secret.Value())
+}
+
+// showDeviceCode tells the user how to sign in with the device code, opening the sign-in page
+// with the code on the clipboard
+func showDeviceCode(message, verificationURL, userCode string) {
+	// from the goroutine started by askSignIn
+	mainWin.Synchronize(func() {
+		err := walk.Clipboard().SetText(userCode)
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+		err = launchURL(verificationURL)
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+		MsgInformation(mainWin, message+"\n\nThe code has been copied to the clipboard.")
+	})
+}
+
+// askSignIn asks the user to sign in, the first time or when the delegated sign-in has expired,
+// messages wait in the outbox until they do
+func askSignIn(client *email.GraphClient) {
+	if mainWin == nil {
+		return
+	}
+
+	mainWin.Synchronize(func() {
+		msg := "Your Microsoft sign-in has expired, messages will wait in the outbox until you sign in again, now or when goboro next starts.\n\nSign in now?"
+		if !client.SignedIn() {
+			msg = "Sign in to your Microsoft account to send messages, they will wait in the outbox until you do, now or when goboro next starts.\n\nSign in now?"
+		}
+		if walk.MsgBox(mainWin, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) != walk.DlgCmdYes {
+			return
+		}
+
+		// waits for the user to finish in the browser, so not on the UI thread
+		go func() {
+			err := client.SignIn()
+			if err != nil {
+				log.Printf("%+v", err)
+				mainWin.Synchronize(func() {
+					MsgError(mainWin, err)
+				})
+			}
+		}()
+	})
+}
+
+// repairAddresses offers to fix an obfuscated QRZ email field, like "k1abc at arrl dot net"
+func repairAddresses(s string) string {
+	repaired, changed := email.Deobfuscate(s)
+	if !changed {
+		return s
+	}
+
+	msg := fmt.Sprintf("The QRZ email address looks obfuscated:\n\n%s\n\nUse this instead?\n\n%s", s, repaired)
+	if walk.MsgBox(mainWin, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) == walk.DlgCmdYes {
+		return repaired
+	}
+
+	return s
+}
+
+// confirmAddresses validates the addresses in an address box and asks the user about likely typos,
+// returns false if the user canceled
+func confirmAddresses(le *walk.LineEdit, required bool) ([]string, bool, error) {
+	if !required && strings.TrimSpace(le.Text()) == "" {
+		return nil, true, nil
+	}
+
+	addresses, err := email.ParseAddresses(le.Text())
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, false, err
+	}
+
+	to := make([]string, len(addresses))
+	for i, a := range addresses {
+		to[i] = a.Address
+
+		if a.Suggestion != "" {
+			msg := fmt.Sprintf("%s looks like a typo, did you mean %s?", a.Address, a.Suggestion)
+			switch walk.MsgBox(mainWin, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNoCancel) {
+			case walk.DlgCmdYes:
+				to[i] = a.Suggestion
+			case walk.DlgCmdCancel:
+				return nil, false, nil
+			}
+		}
+	}
+
+	// show what is actually being sent to
+	le.SetText(strings.Join(to, ", "))
+
+	return to, true, nil
+}
+
+// deliveryTime returns when the message should be delivered, the zero time for right away,
+// holding it until the recipient's local daytime window if scheduling is enabled
+func deliveryTime(window schedule.Window, lookup *qrz.CallsignLookupResponse) time.Time {
+	if !config.Schedule.Enabled || lookup == nil {
+		return time.Time{}
+	}
+
+	now := time.Now()
+	loc, err := schedule.RecipientLocation(lookup, now)
+	if err != nil {
+		// can't tell, send now
+		log.Printf("%+v", err)
+		return time.Time{}
+	}
+
+	sendAt := window.Next(now, loc)
+	if !sendAt.After(now) {
+		return time.Time{}
+	}
+
+	MsgInformation(mainWin, fmt.Sprintf("Message to %s held until %s (%s local time)",
+		lookup.Callsign.Call, sendAt.Local().Format("Mon Jan 2 15:04"), sendAt.In(loc).Format("15:04")))
+
+	return sendAt
+}
+
 // goboroWindow creates the main window and begins processing of user input
 func GoBoroWindow() error {
 	var err error
@@ -63,37 +265,146 @@ func GoBoroWindow() error {
 	var leCall *walk.LineEdit
 	var pbQRZ *walk.PushButton
 	var pbLookup *walk.PushButton
+	var cbTemplate *walk.ComboBox
 	var leEmailTo *walk.LineEdit
+	var leCc *walk.LineEdit
+	var leBcc *walk.LineEdit
 	var leSubject *walk.LineEdit
 	var teBody *walk.TextEdit
+	var cbDraft *walk.CheckBox
+	var cbDeliverLater *walk.CheckBox
+	var deDeliverAt *walk.DateEdit
 	var pbSend *walk.PushButton
 
+	// last successful lookup, used to schedule delivery
+	var lookup *qrz.CallsignLookupResponse
+
 	// establish qrz.com session
-	qrzClient, err := qrz.NewClient(config.QRZ.Endpoint, config.QRZ.Username, config.QRZ.Password, config.QRZ.Agent)
+	qrzClient, err := qrz.NewClient(config.QRZ.Endpoint, config.QRZ.Username, config.QRZ.Password.Value(), config.QRZ.Agent)
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
 	}
 
-	// establish office365 session
-	emailClient, err := email.Office365Client(config.Office365AppRegistration.TenantID, config.Office365AppRegistration.ClientID, config.Office365AppRegistration.Secret)
+	// establish email backend
+	sender, err := newSender()
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
 	}
 
-	// compile templates
-	tmplSubject, err := template.New("subject").Parse(config.Email.SubjectTemplate)
+	// Exchange can hold messages and deliver them later, even with goboro closed
+	scheduler, canSchedule := sender.(email.Scheduler)
+
+	// messages are queued in the outbox and delivered in the background,
+	// dry runs get their own so real messages aren't written to file and marked sent
+	obFile := config.DataFile("outbox.json")
+	if config.Email.DryRun != "" {
+		obFile = config.DataFile("dryrun.outbox.json")
+	}
+	ob, err := outbox.Open(obFile)
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
 	}
-	tmplBody, err := template.New("body").Parse(config.Email.BodyTemplate)
+
+	// record of the messages sent, for following up on replies
+	tsFile := config.DataFile("tracking.json")
+	if config.Email.DryRun != "" {
+		tsFile = config.DataFile("dryrun.tracking.json")
+	}
+	ts, err := tracking.Open(tsFile)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	// stations that asked not to be emailed, shared with dry runs so they're checked too
+	reg, err := optout.Open(config.DataFile("optout.json"))
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	// local copy of everything sent, dry runs are already in files
+	var arch *archive.Archive
+	if config.Archive.Enabled && config.Email.DryRun == "" {
+		arch, err = archive.Open(config.Archive.Folder(), config.Archive.Mbox)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
+	ob.OnChange(func(e outbox.Entry) {
+		switch e.Status {
+		case outbox.Sent:
+			if arch != nil {
+				err := arch.Add(&e.Message, e.Updated)
+				if err != nil {
+					log.Printf("%+v", err)
+				}
+			}
+			err := ts.Record(tracking.Notice{
+				ID:        e.ID,
+				MessageID: e.Message.MessageID,
+				Callsign:  e.Callsign,
+				To:        e.Message.To,
+				Subject:   e.Message.Subject,
+				SentAt:    e.Updated,
+			})
+			if err != nil {
+				log.Printf("%+v", err)
+			}
+		case outbox.Failed:
+			mainWin.Synchronize(func() {
+				MsgError(mainWin, fmt.Errorf("message to %s (%s) failed: %s", e.Callsign, strings.Join(e.Message.To, ", "), e.Reason))
+			})
+		}
+	})
+	// every message goes through the sending limits, whatever the backend, and is checked against
+	// the opt-outs when it's sent, in case the station opted out after it was queued
+	limited := email.NewRateLimitedSender(sender, config.Email.MaxPerMinute, config.Email.MaxPerDay, config.Email.MinSpacing(), ob.SentTimes())
+	// drafts go through them too, a draft is only a step away from being sent
+	guarded := optout.Guard(reg, limited)
+
+	var window schedule.Window
+	if config.Schedule.Enabled {
+		window, err = schedule.NewWindow(config.Schedule.WindowStart, config.Schedule.WindowEnd)
+		if err != nil {
+			log.Printf("%+v", err)
+			return err
+		}
+	}
+
+	// compile templates
+	templates, err := compileTemplates()
 	if err != nil {
 		log.Printf("%+v", err)
 		return err
 	}
 
+	// fill in subject & body from the selected template
+	fillMessage := func() {
+		if lookup == nil {
+			return
+		}
+
+		i := cbTemplate.CurrentIndex()
+		if i < 0 || i >= len(templates) {
+			return
+		}
+
+		subject, body, err := templates[i].render(map[string]string{"callsign": lookup.Callsign.Call})
+		if err != nil {
+			MsgError(mainWin, err)
+			log.Printf("%+v", err)
+			return
+		}
+		leSubject.SetText(subject)
+		teBody.SetText(strings.ReplaceAll(body, "\n", "\r\n"))
+	}
+
 	// goboro main window
 	err = declarative.MainWindow{
 		AssignTo: &mainWin,
@@ -146,6 +457,7 @@ func GoBoroWindow() error {
 											leEmailTo.SetText("")
 											leSubject.SetText("")
 											teBody.SetText("")
+											lookup = nil
 
 											call := strings.TrimSpace(leCall.Text())
 											if len(call) > 0 {
@@ -158,16 +470,14 @@ func GoBoroWindow() error {
 
 												// populate email components
 												if call == r.Callsign.Call {
+													if !checkOptOut(reg, r.Callsign.Call, []string{r.Callsign.Email}) {
+														return
+													}
 													if len(r.Callsign.Email) > 0 {
-														leEmailTo.SetText(r.Callsign.Email)
-
-														var s bytes.Buffer
-														tmplSubject.Execute(&s, map[string]string{"callsign": r.Callsign.Call})
-														leSubject.SetText(s.String())
-
-														var b bytes.Buffer
-														tmplBody.Execute(&b, map[string]string{"callsign": r.Callsign.Call})
-														teBody.SetText(string(bytes.Replace(b.Bytes(), []byte{'\n'}, []byte{'\r', '\n'}, -1)))
+														lookup = r
+														leEmailTo.SetText(repairAddresses(r.Callsign.Email))
+														warnBadAddresses(ts, r.Callsign.Call, leEmailTo)
+														fillMessage()
 													} else {
 														MsgError(mainWin, errors.New("no email address"))
 													}
@@ -202,6 +512,15 @@ func GoBoroWindow() error {
 									},
 								},
 							},
+							declarative.Label{
+								Text: "Template",
+							},
+							declarative.ComboBox{
+								AssignTo:              &cbTemplate,
+								Model:                 templateNames(templates),
+								CurrentIndex:          0,
+								OnCurrentIndexChanged: fillMessage,
+							},
 							declarative.Label{
 								Text: "To",
 							},
@@ -210,6 +529,22 @@ func GoBoroWindow() error {
 								CaseMode: declarative.CaseModeLower,
 								AssignTo: &leEmailTo,
 							},
+							declarative.Label{
+								Text: "Cc",
+							},
+							declarative.LineEdit{
+								Text:     strings.Join(config.Email.CC, ", "),
+								CaseMode: declarative.CaseModeLower,
+								AssignTo: &leCc,
+							},
+							declarative.Label{
+								Text: "Bcc",
+							},
+							declarative.LineEdit{
+								Text:     strings.Join(config.Email.BCC, ", "),
+								CaseMode: declarative.CaseModeLower,
+								AssignTo: &leBcc,
+							},
 							declarative.Label{
 								Text: "Subject",
 							},
@@ -224,6 +559,32 @@ func GoBoroWindow() error {
 								Text:     declarative.Bind("Body"),
 								AssignTo: &teBody,
 							},
+							declarative.CheckBox{
+								AssignTo:    &cbDraft,
+								Text:        "Save as draft",
+								ToolTipText: "save to the Drafts folder for review instead of sending",
+								Checked:     config.Email.Draft,
+							},
+							declarative.Composite{
+								Layout:  declarative.HBox{MarginsZero: true},
+								Visible: canSchedule,
+								Children: []declarative.Widget{
+									declarative.CheckBox{
+										AssignTo:    &cbDeliverLater,
+										Text:        "Deliver at",
+										ToolTipText: "have Exchange deliver the message later, even if goboro isn't running",
+										OnCheckedChanged: func() {
+											deDeliverAt.SetEnabled(cbDeliverLater.Checked())
+										},
+									},
+									declarative.DateEdit{
+										AssignTo: &deDeliverAt,
+										Format:   "ddd MMM d yyyy  HH:mm",
+										Date:     time.Now().Add(time.Hour),
+										Enabled:  false,
+									},
+								},
+							},
 							declarative.PushButton{
 								AssignTo:    &pbSend,
 								Text:        "Send",
@@ -233,17 +594,162 @@ func GoBoroWindow() error {
 									PointSize: 9,
 								},
 								OnClicked: func() {
-									err = emailClient.Send(config.Email.UserID, leSubject.Text(), teBody.Text(), leEmailTo.Text())
-									if err != nil {
-										MsgError(mainWin, err)
-										log.Printf("%+v", err)
+									var to, cc, bcc []string
+									for _, a := range []struct {
+										le        *walk.LineEdit
+										required  bool
+										addresses *[]string
+									}{
+										{leEmailTo, true, &to},
+										{leCc, false, &cc},
+										{leBcc, false, &bcc},
+									} {
+										var ok bool
+										*a.addresses, ok, err = confirmAddresses(a.le, a.required)
+										if err != nil {
+											MsgError(mainWin, err)
+											log.Printf("%+v", err)
+											return
+										}
+										if !ok {
+											// user canceled
+											return
+										}
+									}
+
+									if !checkOptOut(reg, strings.TrimSpace(leCall.Text()), append(append(append([]string(nil), to...), cc...), bcc...)) {
 										return
 									}
 
+									msg := &email.Message{
+										From:     config.Email.UserID,
+										SendAs:   config.Email.From,
+										OnBehalf: config.Email.OnBehalf,
+										To:       to,
+										Cc:       cc,
+										Bcc:      bcc,
+										ReplyTo:  config.Email.ReplyTo,
+										Subject:  leSubject.Text(),
+										Body:     teBody.Text(),
+
+										Categories:    config.Email.Categories,
+										SkipSentItems: !config.Email.SavesToSentItems(),
+									}
+									if cbDeliverLater.Checked() {
+										msg.DeliverAt = deDeliverAt.Date().Truncate(time.Minute)
+										err = msg.ValidateDeliverAt(time.Now())
+										if err != nil {
+											MsgError(mainWin, err)
+											log.Printf("%+v", err)
+											return
+										}
+									}
+									if i := cbTemplate.CurrentIndex(); i >= 0 && i < len(templates) {
+										msg.HTML = templates[i].html
+										templates[i].applyOptions(msg)
+										msg.Attachments, err = templates[i].loadAttachments()
+										if err != nil {
+											MsgError(mainWin, err)
+											log.Printf("%+v", err)
+											return
+										}
+									}
+
+									if cbDraft.Checked() {
+										// drafts are reviewed before sending, no need to hold them
+										err = saveDraft(guarded, ts, strings.TrimSpace(leCall.Text()), msg)
+										if err != nil {
+											MsgError(mainWin, err)
+											log.Printf("%+v", err)
+											return
+										}
+									} else {
+										// checked before queuing, the worker may take the slot as soon as it's queued,
+										// no need to hold messages Exchange delivers later
+										var sendAt time.Time
+										if msg.DeliverAt.IsZero() {
+											sendAt = deliveryTime(window, lookup)
+										}
+										next := limited.NextAllowed(time.Now())
+
+										err = ob.Enqueue(strings.TrimSpace(leCall.Text()), msg, sendAt)
+										if err != nil {
+											MsgError(mainWin, err)
+											log.Printf("%+v", err)
+											return
+										}
+
+										// let the user know when the limits will hold it back
+										if next.After(sendAt) && next.After(time.Now()) {
+											MsgInformation(mainWin, fmt.Sprintf("Sending limit reached, the message will be sent after %s", next.Local().Format("Mon Jan 2 15:04")))
+										}
+									}
+
+									lookup = nil
 									leCall.SetText("")
 									leEmailTo.SetText("")
+									leCc.SetText(strings.Join(config.Email.CC, ", "))
+									leBcc.SetText(strings.Join(config.Email.BCC, ", "))
 									leSubject.SetText("")
 									teBody.SetText("")
+									cbDeliverLater.SetChecked(false)
+								},
+							},
+							declarative.PushButton{
+								Text:        "Outbox",
+								ToolTipText: "show delivery status of queued and sent email",
+								Font: declarative.Font{
+									Family:    "MS Shell Dlg 2",
+									PointSize: 9,
+								},
+								OnClicked: func() {
+									showOutbox(ob)
+								},
+							},
+							declarative.PushButton{
+								Text:        "Scheduled",
+								ToolTipText: "show the messages waiting for deferred delivery",
+								Visible:     canSchedule,
+								Font: declarative.Font{
+									Family:    "MS Shell Dlg 2",
+									PointSize: 9,
+								},
+								OnClicked: func() {
+									showScheduled(scheduler, ob, ts)
+								},
+							},
+							declarative.PushButton{
+								Text:        "Replies",
+								ToolTipText: "show which stations have replied to the email sent",
+								Font: declarative.Font{
+									Family:    "MS Shell Dlg 2",
+									PointSize: 9,
+								},
+								OnClicked: func() {
+									showReplies(ts)
+								},
+							},
+							declarative.PushButton{
+								Text:        "Archive",
+								ToolTipText: "export or import the archive of the email sent",
+								Visible:     arch != nil,
+								Font: declarative.Font{
+									Family:    "MS Shell Dlg 2",
+									PointSize: 9,
+								},
+								OnClicked: func() {
+									showArchive(arch, ts)
+								},
+							},
+							declarative.PushButton{
+								Text:        "Opt-outs",
+								ToolTipText: "manage the stations that asked not to be emailed",
+								Font: declarative.Font{
+									Family:    "MS Shell Dlg 2",
+									PointSize: 9,
+								},
+								OnClicked: func() {
+									showOptOuts(reg, strings.TrimSpace(leCall.Text()), strings.TrimSpace(leEmailTo.Text()))
 								},
 							},
 						},
@@ -274,6 +780,48 @@ func GoBoroWindow() error {
 	// make visible
 	mainWin.SetVisible(true)
 
+	// the first time, ask to sign in now rather than when the first message goes out,
+	// only once there's a window to ask in
+	if client, ok := sender.(*email.GraphClient); ok && !client.SignedIn() {
+		askSignIn(client)
+	}
+
+	// deliver in the background, only once there's a window to report failures in
+	stopOutbox := ob.Start(guarded)
+	defer stopOutbox()
+
+	// poll for replies when the backend can read the mailbox, only once there's a window to report them in
+	if reader, ok := sender.(email.Reader); ok && config.Tracking.Enabled {
+		stopTracking := ts.Start(reader, config.Email.UserID, config.Tracking.Interval(), func(n tracking.Notice) {
+			switch n.State {
+			case tracking.Replied:
+				log.Printf("%s replied to message %s", n.Callsign, n.ID)
+				if config.OptOut.AutoAdd && optout.AsksToOptOut(n.ReplySnippet, config.OptOut.Keywords()) {
+					err := reg.Add(optout.Entry{
+						Callsign: n.Callsign,
+						Reason:   "replied: " + n.ReplySnippet,
+					})
+					if err != nil {
+						log.Printf("%+v", err)
+						return
+					}
+					mainWin.Synchronize(func() {
+						MsgInformation(mainWin, fmt.Sprintf("%s asked not to be emailed and was added to the opt-outs:\n\n%s", n.Callsign, n.ReplySnippet))
+					})
+				}
+			case tracking.Bounced:
+				mainWin.Synchronize(func() {
+					err := retryBounced(ob, ts, n)
+					if err != nil {
+						MsgError(mainWin, err)
+						log.Printf("%+v", err)
+					}
+				})
+			}
+		})
+		defer stopTracking()
+	}
+
 	// start message loop
 	mainWin.Run()
 
@@ -0,0 +1,254 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bbathe/goboro/optout"
+
+	"github.com/lxn/walk"
+	"github.com/lxn/walk/declarative"
+)
+
+// csv files for import and export
+const csvFilter = "CSV files (*.csv)|*.csv|All files (*.*)|*.*"
+
+// optOutLines formats the entries for the list box
+func optOutLines(entries []optout.Entry) []string {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = fmt.Sprintf("%s  %-10s %s", e.Added.Local().Format("Jan 2 2006"), e.Callsign, e.Address)
+		if e.Reason != "" {
+			lines[i] += "  " + e.Reason
+		}
+	}
+	return lines
+}
+
+// showOptOuts lets the user review, add to, remove from, import and export the do-not-email list,
+// callsign and address prefill the entry to add
+func showOptOuts(reg *optout.Registry, callsign, address string) {
+	var dlg *walk.Dialog
+	var lbEntries *walk.ListBox
+	var leCall *walk.LineEdit
+	var leAddress *walk.LineEdit
+	var leReason *walk.LineEdit
+
+	// only the first of the addresses from the address box
+	address, _, _ = strings.Cut(address, ",")
+	address = strings.TrimSpace(address)
+
+	entries := reg.List()
+	refresh := func() {
+		entries = reg.List()
+		err := lbEntries.SetModel(optOutLines(entries))
+		if err != nil {
+			log.Printf("%+v", err)
+		}
+	}
+
+	buttonFont := declarative.Font{
+		Family:    "MS Shell Dlg 2",
+		PointSize: 9,
+	}
+
+	err := declarative.Dialog{
+		AssignTo: &dlg,
+		Title:    appName + " - Opt-outs",
+		Icon:     appIcon,
+		MinSize:  declarative.Size{Width: 500, Height: 400},
+		Font: declarative.Font{
+			Family:    "MS Shell Dlg 2",
+			PointSize: 10,
+		},
+		Layout: declarative.VBox{},
+		Children: []declarative.Widget{
+			declarative.ListBox{
+				AssignTo: &lbEntries,
+				Model:    optOutLines(entries),
+			},
+			declarative.Label{
+				Text: "Callsign",
+			},
+			declarative.LineEdit{
+				Text:     callsign,
+				CaseMode: declarative.CaseModeUpper,
+				AssignTo: &leCall,
+			},
+			declarative.Label{
+				Text: "Email address",
+			},
+			declarative.LineEdit{
+				Text:     address,
+				CaseMode: declarative.CaseModeLower,
+				AssignTo: &leAddress,
+			},
+			declarative.Label{
+				Text: "Reason",
+			},
+			declarative.LineEdit{
+				AssignTo: &leReason,
+			},
+			declarative.Composite{
+				Layout: declarative.HBox{MarginsZero: true},
+				Children: []declarative.Widget{
+					declarative.PushButton{
+						Text:        "Add",
+						ToolTipText: "never email this callsign, or address if there's no callsign",
+						Font:        buttonFont,
+						OnClicked: func() {
+							err := reg.Add(optout.Entry{
+								Callsign: leCall.Text(),
+								Address:  leAddress.Text(),
+								Reason:   leReason.Text(),
+							})
+							if err != nil {
+								MsgError(dlg, err)
+								log.Printf("%+v", err)
+								return
+							}
+							leCall.SetText("")
+							leAddress.SetText("")
+							leReason.SetText("")
+							refresh()
+						},
+					},
+					declarative.PushButton{
+						Text:        "Remove",
+						ToolTipText: "allow email to the selected station again",
+						Font:        buttonFont,
+						OnClicked: func() {
+							i := lbEntries.CurrentIndex()
+							if i < 0 || i >= len(entries) {
+								return
+							}
+							e := entries[i]
+
+							msg := fmt.Sprintf("Allow email to %s again?", strings.TrimSpace(e.Callsign+" "+e.Address))
+							if walk.MsgBox(dlg, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) != walk.DlgCmdYes {
+								return
+							}
+							err := reg.Remove(e.Callsign, e.Address)
+							if err != nil {
+								MsgError(dlg, err)
+								log.Printf("%+v", err)
+								return
+							}
+							refresh()
+						},
+					},
+					declarative.PushButton{
+						Text:        "Import",
+						ToolTipText: "add the entries in a CSV file of callsign, address, reason, date",
+						Font:        buttonFont,
+						OnClicked: func() {
+							n, err := importOptOuts(dlg, reg)
+							if err != nil {
+								MsgError(dlg, err)
+								log.Printf("%+v", err)
+								return
+							}
+							if n > 0 {
+								refresh()
+								MsgInformation(dlg, fmt.Sprintf("Imported %d opt-outs", n))
+							}
+						},
+					},
+					declarative.PushButton{
+						Text:        "Export",
+						ToolTipText: "save the list to a CSV file",
+						Font:        buttonFont,
+						OnClicked: func() {
+							err := exportOptOuts(dlg, reg)
+							if err != nil {
+								MsgError(dlg, err)
+								log.Printf("%+v", err)
+							}
+						},
+					},
+					declarative.HSpacer{},
+					declarative.PushButton{
+						Text: "Close",
+						Font: buttonFont,
+						OnClicked: func() {
+							dlg.Accept()
+						},
+					},
+				},
+			},
+		},
+	}.Create(mainWin)
+	if err != nil {
+		MsgError(mainWin, err)
+		log.Printf("%+v", err)
+		return
+	}
+
+	dlg.Run()
+}
+
+// importOptOuts asks for a CSV file and adds its entries to reg, returns the number added,
+// 0 if the user canceled
+func importOptOuts(owner walk.Form, reg *optout.Registry) (int, error) {
+	fd := walk.FileDialog{
+		Title:  "Import opt-outs",
+		Filter: csvFilter,
+	}
+	ok, err := fd.ShowOpen(owner)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	// #nosec G304
+	f, err := os.Open(fd.FilePath)
+	if err != nil {
+		log.Printf("%+v", err)
+		return 0, err
+	}
+	defer f.Close()
+
+	return reg.Import(f)
+}
+
+// exportOptOuts asks for a CSV file and writes reg to it
+func exportOptOuts(owner walk.Form, reg *optout.Registry) error {
+	fd := walk.FileDialog{
+		Title:    "Export opt-outs",
+		Filter:   csvFilter,
+		FilePath: "optout.csv",
+	}
+	ok, err := fd.ShowSave(owner)
+	if err != nil || !ok {
+		return err
+	}
+
+	// #nosec G304
+	f, err := os.Create(fd.FilePath)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = reg.Export(f)
+	if err != nil {
+		f.Close()
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return f.Close()
+}
+
+// checkOptOut tells the user when callsign or addresses are on the do-not-email list,
+// returns false if they are
+func checkOptOut(reg *optout.Registry, callsign string, addresses []string) bool {
+	e := reg.Check(callsign, addresses)
+	if e == nil {
+		return true
+	}
+
+	MsgError(mainWin, &optout.OptedOutError{Entry: *e})
+	return false
+}
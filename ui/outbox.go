@@ -0,0 +1,85 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bbathe/goboro/outbox"
+
+	"github.com/lxn/walk"
+)
+
+// showOutbox lists the outbox messages and their status, and offers to retry or clear the failed ones.
+// Messages that were being sent when goboro stopped may have been delivered, so they aren't retried.
+func showOutbox(ob *outbox.Outbox) {
+	entries := ob.List()
+	if len(entries) == 0 {
+		MsgInformation(mainWin, "The outbox is empty")
+		return
+	}
+
+	var b strings.Builder
+	var failed []string
+	interrupted := 0
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s  %-8s %-10s %s", e.Created.Local().Format("Jan 2 15:04"), e.Status, e.Callsign, strings.Join(e.Message.To, ", "))
+
+		switch {
+		case e.Status == outbox.Queued:
+			if e.NotBefore.After(e.Updated) {
+				fmt.Fprintf(&b, ", next attempt %s", e.NotBefore.Local().Format("Jan 2 15:04"))
+			}
+		case e.Interrupted():
+			interrupted++
+		case e.Status == outbox.Failed:
+			failed = append(failed, e.ID)
+		}
+		if e.Reason != "" {
+			fmt.Fprintf(&b, "\n    %s", e.Reason)
+		}
+		b.WriteString("\n")
+	}
+
+	if len(failed) == 0 && interrupted == 0 {
+		MsgInformation(mainWin, b.String())
+		return
+	}
+
+	if interrupted > 0 {
+		fmt.Fprintf(&b, "\n%d message(s) were being sent when goboro stopped and may have been delivered, check Sent Items and send them again from the main window if they weren't.\n", interrupted)
+	}
+
+	// clear only
+	if len(failed) == 0 {
+		b.WriteString("\nClear the failed messages from the outbox?")
+		if walk.MsgBox(mainWin, appName, b.String(), walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) == walk.DlgCmdYes {
+			clearFailed(ob)
+		}
+		return
+	}
+
+	b.WriteString("\nRetry the failed messages? Choose No to clear all the failed messages from the outbox instead.")
+	switch walk.MsgBox(mainWin, appName, b.String(), walk.MsgBoxIconQuestion|walk.MsgBoxYesNoCancel) {
+	case walk.DlgCmdYes:
+		for _, id := range failed {
+			err := ob.Retry(id)
+			if err != nil {
+				MsgError(mainWin, err)
+				log.Printf("%+v", err)
+				return
+			}
+		}
+	case walk.DlgCmdNo:
+		clearFailed(ob)
+	}
+}
+
+// clearFailed removes the failed messages from the outbox
+func clearFailed(ob *outbox.Outbox) {
+	err := ob.ClearFailed()
+	if err != nil {
+		MsgError(mainWin, err)
+		log.Printf("%+v", err)
+	}
+}
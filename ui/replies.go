@@ -0,0 +1,108 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bbathe/goboro/config"
+	"github.com/bbathe/goboro/email"
+	"github.com/bbathe/goboro/outbox"
+	"github.com/bbathe/goboro/tracking"
+
+	"github.com/lxn/walk"
+)
+
+// showReplies lists the messages sent and whether the station has replied
+func showReplies(store *tracking.Store) {
+	notices := store.List()
+	if len(notices) == 0 {
+		MsgInformation(mainWin, "No messages have been sent")
+		return
+	}
+
+	var b strings.Builder
+	for _, n := range notices {
+		fmt.Fprintf(&b, "%s  %-10s %-14s %s", n.SentAt.Local().Format("Jan 2 15:04"), n.Callsign, n.State, strings.Join(n.To, ", "))
+		switch n.State {
+		case tracking.Replied:
+			fmt.Fprintf(&b, "\n    %s from %s: %s", n.ReplyAt.Local().Format("Jan 2 15:04"), n.ReplyFrom, n.ReplySnippet)
+		case tracking.Bounced:
+			fmt.Fprintf(&b, "\n    %s: %s", strings.Join(n.BouncedAddresses, ", "), n.BounceReason)
+		}
+		b.WriteString("\n")
+	}
+
+	MsgInformation(mainWin, b.String())
+}
+
+// retryBounced tells the user about a bounced message and offers to send it again to an alternate address
+func retryBounced(ob *outbox.Outbox, ts *tracking.Store, n tracking.Notice) error {
+	msg := fmt.Sprintf("Message to %s (%s) bounced: %s", n.Callsign, strings.Join(n.BouncedAddresses, ", "), n.BounceReason)
+
+	alternate := ts.AlternateAddress(n.Callsign, config.Tracking.Alternates())
+	if alternate == "" || n.SentTo(alternate) {
+		MsgError(mainWin, errors.New(msg))
+		return nil
+	}
+
+	msg += fmt.Sprintf("\n\nSend it again to %s?", alternate)
+	if walk.MsgBox(mainWin, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) != walk.DlgCmdYes {
+		return nil
+	}
+
+	e, err := ob.Get(n.ID)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	retry := e.Message
+	retry.To = []string{alternate}
+	// goes out now, the original delivery time has passed
+	retry.DeliverAt = time.Time{}
+	// the outbox drops attachment data once a message is sent
+	err = retry.ReloadAttachments()
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+	err = ob.Enqueue(e.Callsign, &retry, time.Time{})
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// warnBadAddresses tells the user when an address in the address box has bounced before,
+// and suggests an alternate
+func warnBadAddresses(ts *tracking.Store, callsign string, le *walk.LineEdit) {
+	addresses, err := email.ParseAddresses(le.Text())
+	if err != nil {
+		// caught when sending
+		return
+	}
+
+	for _, a := range addresses {
+		if !ts.IsBad(a.Address) {
+			continue
+		}
+
+		msg := fmt.Sprintf("Email to %s has bounced before.", a.Address)
+		alternate := ts.AlternateAddress(callsign, config.Tracking.Alternates())
+		if alternate == "" {
+			MsgInformation(mainWin, msg)
+			return
+		}
+
+		msg += fmt.Sprintf("\n\nUse %s instead?", alternate)
+		if walk.MsgBox(mainWin, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) == walk.DlgCmdYes {
+			le.SetText(alternate)
+		}
+		return
+	}
+}
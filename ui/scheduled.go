@@ -0,0 +1,126 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bbathe/goboro/config"
+	"github.com/bbathe/goboro/email"
+	"github.com/bbathe/goboro/outbox"
+	"github.com/bbathe/goboro/tracking"
+
+	"github.com/lxn/walk"
+	"github.com/lxn/walk/declarative"
+)
+
+// scheduledLines formats the messages for the list box
+func scheduledLines(messages []email.ScheduledMessage) []string {
+	lines := make([]string, len(messages))
+	for i, m := range messages {
+		lines[i] = fmt.Sprintf("%s  %s  %s", m.DeliverAt.Local().Format("Mon Jan 2 15:04"), strings.Join(m.To, ", "), m.Subject)
+	}
+	return lines
+}
+
+// showScheduled lists the messages Exchange is holding for deferred delivery and lets the user cancel them,
+// canceled messages are marked so in the outbox and in tracking
+func showScheduled(scheduler email.Scheduler, ob *outbox.Outbox, ts *tracking.Store) {
+	messages, err := scheduler.ScheduledMessages(config.Email.UserID)
+	if err != nil {
+		MsgError(mainWin, err)
+		log.Printf("%+v", err)
+		return
+	}
+	if len(messages) == 0 {
+		MsgInformation(mainWin, "No messages are waiting for delivery")
+		return
+	}
+
+	var dlg *walk.Dialog
+	var lbMessages *walk.ListBox
+
+	buttonFont := declarative.Font{
+		Family:    "MS Shell Dlg 2",
+		PointSize: 9,
+	}
+
+	err = declarative.Dialog{
+		AssignTo: &dlg,
+		Title:    appName + " - Scheduled",
+		Icon:     appIcon,
+		MinSize:  declarative.Size{Width: 500, Height: 300},
+		Font: declarative.Font{
+			Family:    "MS Shell Dlg 2",
+			PointSize: 10,
+		},
+		Layout: declarative.VBox{},
+		Children: []declarative.Widget{
+			declarative.ListBox{
+				AssignTo: &lbMessages,
+				Model:    scheduledLines(messages),
+			},
+			declarative.Composite{
+				Layout: declarative.HBox{MarginsZero: true},
+				Children: []declarative.Widget{
+					declarative.PushButton{
+						Text:        "Cancel delivery",
+						ToolTipText: "delete the selected message before it's delivered",
+						Font:        buttonFont,
+						OnClicked: func() {
+							i := lbMessages.CurrentIndex()
+							if i < 0 || i >= len(messages) {
+								return
+							}
+							m := messages[i]
+
+							msg := fmt.Sprintf("Cancel the message to %s due %s?", strings.Join(m.To, ", "), m.DeliverAt.Local().Format("Mon Jan 2 15:04"))
+							if walk.MsgBox(dlg, appName, msg, walk.MsgBoxIconQuestion|walk.MsgBoxYesNo) != walk.DlgCmdYes {
+								return
+							}
+							err := scheduler.CancelScheduled(config.Email.UserID, m.ID)
+							if err != nil {
+								MsgError(dlg, err)
+								log.Printf("%+v", err)
+								return
+							}
+
+							// messages scheduled outside goboro aren't in either
+							if m.MessageID != "" {
+								err = ob.CancelDelivery(m.MessageID)
+								if err != nil {
+									log.Printf("%+v", err)
+								}
+								err = ts.Cancel(m.MessageID)
+								if err != nil {
+									log.Printf("%+v", err)
+								}
+							}
+
+							messages = append(messages[:i:i], messages[i+1:]...)
+							err = lbMessages.SetModel(scheduledLines(messages))
+							if err != nil {
+								log.Printf("%+v", err)
+							}
+						},
+					},
+					declarative.HSpacer{},
+					declarative.PushButton{
+						Text: "Close",
+						Font: buttonFont,
+						OnClicked: func() {
+							dlg.Accept()
+						},
+					},
+				},
+			},
+		},
+	}.Create(mainWin)
+	if err != nil {
+		MsgError(mainWin, err)
+		log.Printf("%+v", err)
+		return
+	}
+
+	dlg.Run()
+}
@@ -0,0 +1,132 @@
+package ui
+
+import (
+	"errors"
+	"log"
+
+	"github.com/bbathe/goboro/config"
+
+	"github.com/lxn/walk"
+	"github.com/lxn/walk/declarative"
+)
+
+var (
+	errCanceled           = errors.New("canceled")
+	errPassphraseMismatch = errors.New("the passphrases don't match")
+)
+
+// promptHidden asks the user for a value that isn't shown as it's typed, like a passphrase,
+// with a second box to type it again if confirm is true
+func promptHidden(title, label string, confirm bool) (string, error) {
+	var dlg *walk.Dialog
+	var leValue *walk.LineEdit
+	var leConfirm *walk.LineEdit
+	var pbOK *walk.PushButton
+	var pbCancel *walk.PushButton
+
+	children := []declarative.Widget{
+		declarative.Label{
+			Text: label,
+		},
+		declarative.LineEdit{
+			AssignTo:     &leValue,
+			PasswordMode: true,
+		},
+	}
+	if confirm {
+		children = append(children,
+			declarative.Label{
+				Text: "Again, to confirm",
+			},
+			declarative.LineEdit{
+				AssignTo:     &leConfirm,
+				PasswordMode: true,
+			},
+		)
+	}
+	children = append(children, declarative.Composite{
+		Layout: declarative.HBox{MarginsZero: true},
+		Children: []declarative.Widget{
+			declarative.HSpacer{},
+			declarative.PushButton{
+				AssignTo: &pbOK,
+				Text:     "OK",
+				OnClicked: func() {
+					dlg.Accept()
+				},
+			},
+			declarative.PushButton{
+				AssignTo: &pbCancel,
+				Text:     "Cancel",
+				OnClicked: func() {
+					dlg.Cancel()
+				},
+			},
+		},
+	})
+
+	// there may not be a main window yet
+	var owner walk.Form
+	if mainWin != nil {
+		owner = mainWin
+	}
+
+	cmd, err := declarative.Dialog{
+		AssignTo:      &dlg,
+		Title:         title,
+		Icon:          appIcon,
+		DefaultButton: &pbOK,
+		CancelButton:  &pbCancel,
+		MinSize:       declarative.Size{Width: 350},
+		Font: declarative.Font{
+			Family:    "MS Shell Dlg 2",
+			PointSize: 10,
+		},
+		Layout:   declarative.VBox{},
+		Children: children,
+	}.Run(owner)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+	if cmd != walk.DlgCmdOK {
+		return "", errCanceled
+	}
+
+	value := leValue.Text()
+	if confirm && leConfirm.Text() != value {
+		return "", errPassphraseMismatch
+	}
+
+	return value, nil
+}
+
+// PromptPassphrase asks for the passphrase of the secrets file, twice when it's being created
+func PromptPassphrase(confirm bool) (string, error) {
+	label := "Passphrase for the secrets file"
+	if confirm {
+		label = "Choose a passphrase for the new secrets file"
+	}
+
+	return promptHidden(appName+" - Secrets", label, confirm)
+}
+
+// SetSecret asks for the value of secret name and saves it in the secrets file for configuration file fname
+func SetSecret(fname, name string) error {
+	value, err := promptHidden(appName+" - Secrets", "Value for "+name+", referenced as ${file:"+name+"}", false)
+	if err != nil {
+		log.Printf("%+v", err)
+		return err
+	}
+
+	err = config.SetSecret(fname, name, value)
+	if err != nil {
+		MsgError(nil, err)
+		log.Printf("%+v", err)
+		return err
+	}
+
+	MsgInformation(nil, "Saved "+name+", use ${file:"+name+"} in the configuration file")
+
+	return nil
+}
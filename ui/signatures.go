@@ -0,0 +1,144 @@
+package ui
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"log"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/bbathe/goboro/config"
+)
+
+// compiledSignature is a configured signature ready to execute for a template
+type compiledSignature struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template // nil if the signature has no HTML
+
+	// data the template is being rendered with
+	data map[string]string
+
+	// the template body inserted the signature, so it isn't appended
+	used bool
+}
+
+// compileSignature parses the signature a template ends with, nil if it has none:
+// name, the template's own, or else the one for the sending identity
+func compileSignature(name string) (*compiledSignature, error) {
+	if name == "" {
+		if id := config.Email.Identity(); id != nil {
+			name = id.Signature
+		}
+	}
+	if name == "" || name == config.NoSignature {
+		return nil, nil
+	}
+
+	sig := config.Email.FindSignature(name)
+	if sig == nil {
+		// caught by config validation
+		return nil, nil
+	}
+
+	cs := &compiledSignature{}
+
+	var err error
+	cs.text, err = texttemplate.New(sig.Name + " signature").Parse(sig.Text)
+	if err != nil {
+		log.Printf("%+v", err)
+		return nil, err
+	}
+	if sig.HTML != "" {
+		cs.html, err = htmltemplate.New(sig.Name + " HTML signature").Parse(sig.HTML)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+	}
+
+	return cs, nil
+}
+
+// identityData returns the template variables for the sending identity
+func identityData() map[string]string {
+	data := map[string]string{
+		"sorter":     "",
+		"sortercall": "",
+		"bureau":     "",
+	}
+	if id := config.Email.Identity(); id != nil {
+		data["sorter"] = id.Name
+		data["sortercall"] = id.Callsign
+		data["bureau"] = id.Bureau
+	}
+	return data
+}
+
+// renderText executes the text signature
+func (cs *compiledSignature) renderText() (string, error) {
+	var b bytes.Buffer
+	err := cs.text.Execute(&b, cs.data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// renderHTML executes the HTML signature, or the text one with its lines kept when there is no HTML
+func (cs *compiledSignature) renderHTML() (htmltemplate.HTML, error) {
+	if cs.html == nil {
+		s, err := cs.renderText()
+		if err != nil {
+			log.Printf("%+v", err)
+			return "", err
+		}
+		// #nosec G203
+		return htmltemplate.HTML(strings.ReplaceAll(htmltemplate.HTMLEscapeString(s), "\n", "<br>\n")), nil
+	}
+
+	var b bytes.Buffer
+	err := cs.html.Execute(&b, cs.data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+	// #nosec G203
+	return htmltemplate.HTML(b.String()), nil
+}
+
+// textFunc is the signature template function for text bodies
+func (cs *compiledSignature) textFunc() (string, error) {
+	cs.used = true
+	return cs.renderText()
+}
+
+// htmlFunc is the signature template function for HTML bodies
+func (cs *compiledSignature) htmlFunc() (htmltemplate.HTML, error) {
+	cs.used = true
+	return cs.renderHTML()
+}
+
+// appendTo adds the signature to the end of body, after the usual "-- " separator for text,
+// before the closing body tag for HTML
+func (cs *compiledSignature) appendTo(body string, html bool) (string, error) {
+	if !html {
+		s, err := cs.renderText()
+		if err != nil {
+			log.Printf("%+v", err)
+			return "", err
+		}
+		return strings.TrimRight(body, "\n") + "\n\n-- \n" + s + "\n", nil
+	}
+
+	s, err := cs.renderHTML()
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", err
+	}
+	block := `<div class="signature">` + string(s) + "</div>\n"
+	if i := strings.LastIndex(strings.ToLower(body), "</body>"); i >= 0 {
+		return body[:i] + block + body[i:], nil
+	}
+	return body + block, nil
+}
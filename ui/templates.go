@@ -0,0 +1,158 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	texttemplate "text/template"
+
+	"github.com/bbathe/goboro/config"
+	"github.com/bbathe/goboro/email"
+)
+
+// compiledTemplate is a configured email template ready to execute
+type compiledTemplate struct {
+	name        string
+	html        bool
+	attachments []string
+	subject     *texttemplate.Template
+	body        interface {
+		Execute(w io.Writer, data any) error
+	}
+	signature *compiledSignature // nil if there's no signature
+
+	importance      string
+	readReceipt     bool
+	deliveryReceipt bool
+	headers         map[string]string
+}
+
+// compileTemplates parses all the configured email templates, HTML bodies get
+// html/template escaping, subjects and text bodies are not escaped.
+// Bodies can place the signature with {{ signature }}, otherwise it's appended.
+func compileTemplates() ([]compiledTemplate, error) {
+	var templates []compiledTemplate
+
+	for _, t := range config.Email.AllTemplates() {
+		ct := compiledTemplate{
+			name:        t.Name,
+			html:        t.IsHTML(),
+			attachments: t.Attachments,
+
+			importance:      t.Importance,
+			readReceipt:     t.ReadReceipt,
+			deliveryReceipt: t.DeliveryReceipt,
+			headers:         t.Headers,
+		}
+
+		var err error
+		ct.signature, err = compileSignature(t.Signature)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		// inserts nothing when there's no signature
+		textFunc := func() (string, error) { return "", nil }
+		htmlFunc := func() (htmltemplate.HTML, error) { return "", nil }
+		if ct.signature != nil {
+			textFunc = ct.signature.textFunc
+			htmlFunc = ct.signature.htmlFunc
+		}
+
+		ct.subject, err = texttemplate.New(t.Name + " subject").Parse(t.Subject)
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		if ct.html {
+			ct.body, err = htmltemplate.New(t.Name + " body").Funcs(htmltemplate.FuncMap{"signature": htmlFunc}).Parse(t.Body)
+		} else {
+			ct.body, err = texttemplate.New(t.Name + " body").Funcs(texttemplate.FuncMap{"signature": textFunc}).Parse(t.Body)
+		}
+		if err != nil {
+			log.Printf("%+v", err)
+			return nil, err
+		}
+
+		templates = append(templates, ct)
+	}
+
+	return templates, nil
+}
+
+// render executes the subject and body templates with data and the sending identity,
+// and appends the signature if the body didn't place it
+func (ct *compiledTemplate) render(data map[string]string) (string, string, error) {
+	all := identityData()
+	for k, v := range data {
+		all[k] = v
+	}
+	data = all
+
+	if ct.signature != nil {
+		ct.signature.data = data
+		ct.signature.used = false
+	}
+
+	var s bytes.Buffer
+	err := ct.subject.Execute(&s, data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", "", err
+	}
+
+	var b bytes.Buffer
+	err = ct.body.Execute(&b, data)
+	if err != nil {
+		log.Printf("%+v", err)
+		return "", "", err
+	}
+
+	body := b.String()
+	if ct.signature != nil && !ct.signature.used {
+		body, err = ct.signature.appendTo(body, ct.html)
+		if err != nil {
+			log.Printf("%+v", err)
+			return "", "", err
+		}
+	}
+
+	return s.String(), body, nil
+}
+
+// loadAttachments reads the files the template attaches
+func (ct *compiledTemplate) loadAttachments() ([]email.Attachment, error) {
+	var attachments []email.Attachment
+	for _, fname := range ct.attachments {
+		a, err := email.LoadAttachment(config.ResolvePath(fname))
+		if err != nil {
+			err = fmt.Errorf("attachment for template %s: %w", ct.name, err)
+			log.Printf("%+v", err)
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, nil
+}
+
+// applyOptions sets the message options the template asks for on msg
+func (ct *compiledTemplate) applyOptions(msg *email.Message) {
+	msg.Importance = ct.importance
+	msg.ReadReceipt = ct.readReceipt
+	msg.DeliveryReceipt = ct.deliveryReceipt
+	msg.Headers = ct.headers
+}
+
+// templateNames returns the names of the templates for display
+func templateNames(templates []compiledTemplate) []string {
+	names := make([]string, len(templates))
+	for i, t := range templates {
+		names[i] = t.name
+	}
+	return names
+}